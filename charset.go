@@ -0,0 +1,94 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"strings"
+	"unicode/utf8"
+)
+
+// encodings are the encodings a book can be read in regardless of its XML
+// declaration.
+var encodings = []string{"utf-8", "windows-1251", "koi8-r"}
+
+func knownEncoding(enc string) bool {
+	for _, e := range encodings {
+		if e == enc {
+			return true
+		}
+	}
+	return false
+}
+
+// detectEncoding guesses the encoding of the data: UTF-8 if the data is
+// valid UTF-8, otherwise windows-1251 or KOI8-R, whichever of them makes most
+// of the Cyrillic letters lowercase. It returns "" for plain ASCII.
+func detectEncoding(data []byte) string {
+	// Drop a rune cut off at the end of the data.
+	for i := 0; i < utf8.UTFMax-1 && len(data) > 0; i++ {
+		r, size := utf8.DecodeLastRune(data)
+		if r != utf8.RuneError || size != 1 {
+			break
+		}
+		data = data[:len(data)-1]
+	}
+
+	var upper, lower, other int
+	for _, c := range data {
+		switch {
+		case c >= 0xe0:
+			lower++
+		case c >= 0xc0:
+			upper++
+		case c >= 0x80:
+			other++
+		}
+	}
+
+	switch {
+	case upper+lower+other == 0:
+		return ""
+	case utf8.Valid(data):
+		return "utf-8"
+	case lower >= upper:
+		// In windows-1251 the lowercase letters are 0xe0-0xff, in KOI8-R
+		// they are 0xc0-0xdf.
+		return "windows-1251"
+	}
+	return "koi8-r"
+}
+
+// garbled reports whether the description has invalid characters left
+// after decoding.
+func (desc *fb2desc) garbled() bool {
+	bad := func(s string) bool {
+		return strings.ContainsRune(s, utf8.RuneError)
+	}
+
+	if bad(desc.Title) || bad(desc.Annotation) {
+		return true
+	}
+	for _, a := range desc.Authors {
+		if bad(a.FirstName) || bad(a.MiddleName) || bad(a.LastName) || bad(a.Nickname) {
+			return true
+		}
+	}
+	for _, s := range desc.Sequences {
+		if bad(s.Name) {
+			return true
+		}
+	}
+
+	return false
+}
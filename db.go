@@ -16,426 +16,228 @@ package main
 import (
 	"database/sql"
 	"log"
+	"strings"
+	"sync"
 
 	"github.com/jmoiron/sqlx"
-	_ "github.com/mattn/go-sqlite3"
+	"github.com/mattn/go-sqlite3"
 	"github.com/opennota/fb2index/trigram"
 )
 
-var (
-	db *sqlx.DB
+// The rows of book_texts are numbered so that the rows of a book make up a
+// contiguous range of rowids starting at textRowID(id, 0).
+const maxTextRows = 1 << 16
 
-	ErrNoRows = sql.ErrNoRows
-)
+func textRowID(bookID uint32, n int) int64 {
+	return int64(bookID)*maxTextRows + int64(n)
+}
+
+// sqliteStore is the Store kept in an SQLite database. The names and titles
+// are also indexed by trigrams in memory.
+type sqliteStore struct {
+	*sqlx.DB
+
+	// path is the database file, or "" if the database is in memory.
+	path string
+
+	// tx is the transaction of the books added since the last flush, and
+	// trgm are their trigrams, added to the indexes once tx is committed.
+	tx   *sqlx.Tx
+	trgm trigramAdditions
+
+	// fts is whether the annotations and the texts are searched with FTS5.
+	fts bool
+
+	// trgmMu guards the trigram indexes, which can be updated by the
+	// insert worker while the HTTP handlers query them.
+	trgmMu            sync.RWMutex
+	trgmAuthorIndex   *trigram.Index
+	trgmSequenceIndex *trigram.Index
+	trgmBookIndex     *trigram.Index
+
+	// trgmSaved is the change counter the saved trigram indexes were made
+	// at, or -1 if they were not saved or loaded.
+	trgmSaved int64
+}
+
+func init() {
+	// In a shared-cache in-memory database, the HTTP handlers would be
+	// locked out (SQLITE_LOCKED) of the tables written by the insert worker,
+	// and the worker out of the tables they read. Reading uncommitted books
+	// is harmless.
+	sql.Register("sqlite3_fb2index", &sqlite3.SQLiteDriver{
+		ConnectHook: func(c *sqlite3.SQLiteConn) error {
+			_, err := c.Exec("PRAGMA read_uncommitted = 1", nil)
+			return err
+		},
+	})
+}
+
+// sqliteDSN adds to the data source a busy timeout, so that a write waits
+// for another one to finish instead of failing, and the WAL journal mode, in
+// which the database can be read while the books are being inserted. The
+// parameters already in the data source take precedence.
+func sqliteDSN(dataSource string) string {
+	sep := "?"
+	if strings.Contains(dataSource, "?") {
+		sep = "&"
+	}
+	return dataSource + sep + "_busy_timeout=10000&_journal_mode=WAL"
+}
 
-func initDB() {
-	db = sqlx.MustConnect("sqlite3", *dataSource)
-	db.MustExec(`CREATE TABLE IF NOT EXISTS books (
-				id              INTEGER PRIMARY KEY AUTOINCREMENT,
-				title           TEXT,
-				lang            TEXT,
-				archive         TEXT,
-				filename        TEXT,
-				offset          INTEGER,
-				compressed_size INTEGER,
-				uncompressed_size INTEGER,
-				crc32           INTEGER,
-				UNIQUE (archive, filename)
-			);
-			CREATE TABLE IF NOT EXISTS genres (
-				id              INTEGER PRIMARY KEY AUTOINCREMENT,
-				name            TEXT,
-				desc            TEXT,
-				meta            TEXT,
-				UNIQUE (name)
-			);
-			CREATE TABLE IF NOT EXISTS authors (
-				id              INTEGER PRIMARY KEY AUTOINCREMENT,
-				first_name      TEXT,
-				middle_name     TEXT,
-				last_name       TEXT,
-				nickname        TEXT,
-				UNIQUE (first_name, middle_name, last_name, nickname)
-			);
-			CREATE TABLE IF NOT EXISTS sequences (
-				id              INTEGER PRIMARY KEY AUTOINCREMENT,
-				name            TEXT,
-				UNIQUE (name)
-			);
-			CREATE TABLE IF NOT EXISTS book_genres (
-				book_id         INTEGER,
-				genre_id        INTEGER,
-				PRIMARY KEY (book_id, genre_id)
-			);
-			CREATE TABLE IF NOT EXISTS book_authors (
-				book_id         INTEGER,
-				author_id       INTEGER,
-				PRIMARY KEY (book_id, author_id)
-			);
-			CREATE TABLE IF NOT EXISTS book_translators (
-				book_id         INTEGER,
-				author_id       INTEGER,
-				PRIMARY KEY (book_id, author_id)
-			);
-			CREATE TABLE IF NOT EXISTS book_sequences (
-				book_id         INTEGER,
-				sequence_id     INTEGER,
-				number          INTEGER,
-				PRIMARY KEY (book_id, sequence_id)
-			);
-
-			CREATE INDEX IF NOT EXISTS books_title_idx ON books (title);
-			CREATE INDEX IF NOT EXISTS book_genres_idx ON book_genres (genre_id);
-			CREATE INDEX IF NOT EXISTS book_authors_idx ON book_authors (author_id);
-			CREATE INDEX IF NOT EXISTS book_translators_idx ON book_translators (author_id);
-			CREATE INDEX IF NOT EXISTS book_sequences_idx ON book_sequences (sequence_id);
-			CREATE INDEX IF NOT EXISTS authors_idx ON authors (last_name, first_name, nickname);
-
-			INSERT OR IGNORE INTO genres (name, desc, meta) VALUES
-				('adv_animal', 'Природа и животные', 'Приключения'),
-				('adventure', 'Приключения', 'Приключения'),
-				('adv_geo', 'Путешествия и география', 'Приключения'),
-				('adv_history', 'Исторические приключения', 'Приключения'),
-				('adv_indian', 'Вестерн, про индейцев', 'Приключения'),
-				('adv_maritime', 'Морские приключения', 'Приключения'),
-				('adv_modern', 'Приключения в современном мире', 'Приключения'),
-				('adv_story', 'Авантюрный роман', 'Приключения'),
-				('antique', 'antique', 'Старинное'),
-				('antique_ant', 'Античная литература', 'Старинное'),
-				('antique_east', 'Древневосточная литература', 'Старинное'),
-				('antique_european', 'Европейская старинная литература', 'Старинное'),
-				('antique_myths', 'Мифы. Легенды. Эпос', 'Фольклор'),
-				('antique_russian', 'Древнерусская литература', 'Старинное'),
-				('aphorisms', 'Афоризмы, цитаты', 'Проза'),
-				('architecture_book', 'Скульптура и архитектура', 'Искусство, Искусствоведение, Дизайн'),
-				('art_criticism', 'Искусствоведение', 'Искусство, Искусствоведение, Дизайн'),
-				('art_world_culture', 'Мировая художественная культура', 'Искусство, Искусствоведение, Дизайн'),
-				('astrology', 'Астрология и хиромантия', 'Религия, духовность, эзотерика'),
-				('auto_business', 'Автодело', 'Техника'),
-				('auto_regulations', 'Автомобили и ПДД', 'Дом и семья'),
-				('banking', 'Финансы', 'Деловая литература'),
-				('child_adv', 'Приключения для детей и подростков', 'Приключения'),
-				('child_classical', 'Классическая детская литература', 'Литература для детей'),
-				('child_det', 'Детская остросюжетная литература', 'Литература для детей'),
-				('child_education', 'Детская образовательная литература', 'Литература для детей'),
-				('child_folklore', 'Детский фольклор', 'Фольклор'),
-				('child_prose', 'Проза для детей', 'Литература для детей'),
-				('children', 'Детская литература', 'Литература для детей'),
-				('child_sf', 'Фантастика для детей', 'Литература для детей'),
-				('child_tale_rus', 'Русские сказки', 'Литература для детей'),
-				('child_tale', 'Сказки народов мира', 'Литература для детей'),
-				('child_verse', 'Стихи для детей', 'Литература для детей'),
-				('cine', 'Кино', 'Искусство, Искусствоведение, Дизайн'),
-				('comedy', 'Комедия', 'Драматургия'),
-				('comics', 'Комиксы', 'Прочее'),
-				('comp_db', 'Программирование, программы, базы данных', 'Компьютеры и Интернет'),
-				('comp_hard', 'Компьютерное ''железо'' (аппаратное обеспечение), цифровая обработка сигналов', 'Компьютеры и Интернет'),
-				('computers', 'Зарубежная компьютерная, околокомпьютерная литература', 'Компьютеры и Интернет'),
-				('comp_www', 'ОС и Сети, интернет', 'Компьютеры и Интернет'),
-				('design', 'Искусство и Дизайн', 'Искусство, Искусствоведение, Дизайн'),
-				('det_action', 'Боевик', 'Детективы и Триллеры'),
-				('det_classic', 'Классический детектив', 'Детективы и Триллеры'),
-				('det_crime', 'Криминальный детектив', 'Детективы и Триллеры'),
-				('detective', 'Детективы', 'Детективы и Триллеры'),
-				('det_espionage', 'Шпионский детектив', 'Детективы и Триллеры'),
-				('det_hard', 'Крутой детектив', 'Детективы и Триллеры'),
-				('det_history', 'Исторический детектив', 'Детективы и Триллеры'),
-				('det_irony', 'Иронический детектив, дамский детективный роман', 'Детективы и Триллеры'),
-				('det_maniac', 'Про маньяков', 'Детективы и Триллеры'),
-				('det_police', 'Полицейский детектив', 'Детективы и Триллеры'),
-				('det_political', 'Политический детектив', 'Детективы и Триллеры'),
-				('det_su', 'Советский детектив', 'Детективы и Триллеры'),
-				('drama_antique', 'Античная драма', 'Драматургия'),
-				('dramaturgy', 'Драматургия', 'Драматургия'),
-				('drama', 'Драма', 'Драматургия'),
-				('economics_ref', 'Деловая литература', 'Деловая литература'),
-				('economics', 'Экономика', 'Деловая литература'),
-				('epic', 'Былины, эпопея', 'Фольклор'),
-				('epistolary_fiction', 'Эпистолярная проза', 'Проза'),
-				('equ_history', 'История техники', 'Техника'),
-				('fairy_fantasy', 'Мифологическое фэнтези', 'Фантастика'),
-				('family', 'Семейные отношения', 'Дом и семья'),
-				('fanfiction', 'Фанфик', 'Прочее'),
-				('folklore', 'Фольклор, загадки', 'Фольклор'),
-				('folk_songs', 'Народные песни', 'Фольклор'),
-				('folk_tale', 'Народные сказки', 'Фольклор'),
-				('foreign_antique', 'Средневековая классическая проза', 'Проза'),
-				('foreign_children', 'Зарубежная литература для детей', 'Литература для детей'),
-				('foreign_prose', 'Зарубежная классическая проза', 'Проза'),
-				('geo_guides', 'Путеводители, карты, атласы', 'Справочная литература'),
-				('gothic_novel', 'Готический роман', 'Проза'),
-				('great_story', 'Роман, повесть', 'Проза'),
-				('home_collecting', 'Коллекционирование', 'Дом и семья'),
-				('home_cooking', 'Кулинария', 'Дом и семья'),
-				('home_crafts', 'Хобби и ремесла', 'Дом и семья'),
-				('home_diy', 'Сделай сам', 'Дом и семья'),
-				('home_entertain', 'Развлечения', 'Дом и семья'),
-				('home_garden', 'Сад и огород', 'Дом и семья'),
-				('home_health', 'Здоровье', 'Дом и семья'),
-				('home_pets', 'Домашние животные', 'Дом и семья'),
-				('home_sex', 'Семейные отношения, секс', 'Дом и семья'),
-				('home_sport', 'Боевые искусства, спорт', 'Дом и семья'),
-				('home', 'Домоводство', 'Дом и семья'),
-				('hronoopera', 'Хроноопера', 'Фантастика'),
-				('humor_anecdote', 'Анекдоты', 'Юмор'),
-				('humor_prose', 'Юмористическая проза', 'Юмор'),
-				('humor_satire', 'Сатира', 'Юмор'),
-				('humor_verse', 'Юмористические стихи, басни', 'Поэзия'),
-				('humor', 'Юмор', 'Юмор'),
-				('limerick', 'Частушки, прибаутки, потешки', 'Фольклор'),
-				('literature_18', 'Классическая проза XVII-XVIII веков', 'Проза'),
-				('literature_19', 'Классическая проза ХIX века', 'Проза'),
-				('literature_20', 'Классическая проза ХX века', 'Проза'),
-				('love_contemporary', 'Современные любовные романы', 'Любовные романы'),
-				('love_detective', 'Остросюжетные любовные романы', 'Любовные романы'),
-				('love_erotica', 'Эротическая литература', 'Любовные романы'),
-				('love_hard', 'Порно', 'Любовные романы'),
-				('love_history', 'Исторические любовные романы', 'Любовные романы'),
-				('love_sf', 'Любовное фэнтези, любовно-фантастические романы', 'Любовные романы'),
-				('love_short', 'Короткие любовные романы', 'Любовные романы'),
-				('love', 'Любовные романы', 'Любовные романы'),
-				('lyrics', 'Лирика', 'Поэзия'),
-				('military_history', 'Военная история', 'Наука, Образование'),
-				('military_special', 'Военное дело', 'Документальная литература'),
-				('military_weapon', 'Военное дело, военная техника и вооружение', 'Техника'),
-				('modern_tale', 'Современная сказка', 'Фантастика'),
-				('music', 'Музыка', 'Искусство, Искусствоведение, Дизайн'),
-				('network_literature', 'Самиздат, сетевая литература', 'Прочее'),
-				('nonf_biography', 'Биографии и Мемуары', 'Документальная литература'),
-				('nonf_criticism', 'Критика', 'Искусство, Искусствоведение, Дизайн'),
-				('nonfiction', 'Документальная литература', 'Документальная литература'),
-				('nonf_military', 'Военная документалистика и аналитика', 'Документальная литература'),
-				('nonf_publicism', 'Публицистика', 'Документальная литература'),
-				('notes', 'Партитуры', 'Искусство, Искусствоведение, Дизайн'),
-				('org_behavior', 'Маркетинг, PR', 'Деловая литература'),
-				('other', 'Неотсортированное', 'Прочее'),
-				('painting', 'Живопись, альбомы, иллюстрированные каталоги', 'Искусство, Искусствоведение, Дизайн'),
-				('palindromes', 'Визуальная и экспериментальная поэзия, верлибры, палиндромы', 'Поэзия'),
-				('periodic', 'Журналы, газеты', 'Прочее'),
-				('poem', 'Поэма, эпическая поэзия', 'Поэзия'),
-				('poetry_classical', 'Классическая поэзия', 'Поэзия'),
-				('poetry_east', 'Поэзия Востока', 'Поэзия'),
-				('poetry_for_classical', 'Классическая зарубежная поэзия', 'Поэзия'),
-				('poetry_for_modern', 'Современная зарубежная поэзия', 'Поэзия'),
-				('poetry_modern', 'Современная поэзия', 'Поэзия'),
-				('poetry_rus_classical', 'Классическая русская поэзия', 'Поэзия'),
-				('poetry_rus_modern', 'Современная русская поэзия', 'Поэзия'),
-				('poetry', 'Поэзия', 'Поэзия'),
-				('popular_business', 'Карьера, кадры', 'Деловая литература'),
-				('prose_abs', 'Фантасмагория, абсурдистская проза', 'Проза'),
-				('prose_classic', 'Классическая проза', 'Проза'),
-				('prose_contemporary', 'Современная русская и зарубежная проза', 'Проза'),
-				('prose_counter', 'Контркультура', 'Проза'),
-				('prose_game', 'Игры, упражнения для детей', 'Литература для детей'),
-				('prose_history', 'Историческая проза', 'Проза'),
-				('prose_magic', 'Магический реализм', 'Проза'),
-				('prose_military', 'Проза о войне', 'Проза'),
-				('prose_neformatny', 'Экспериментальная, неформатная проза', 'Проза'),
-				('prose_rus_classic', 'Русская классическая проза', 'Проза'),
-				('prose_su_classics', 'Советская классическая проза', 'Проза'),
-				('prose', 'Проза', 'Проза'),
-				('proverbs', 'Пословицы, поговорки', 'Фольклор'),
-				('ref_dict', 'Словари', 'Справочная литература'),
-				('ref_encyc', 'Энциклопедии', 'Справочная литература'),
-				('reference', 'Справочная литература', 'Справочная литература'),
-				('ref_guide', 'Руководства', 'Справочная литература'),
-				('ref_ref', 'Справочники', 'Справочная литература'),
-				('religion_budda', 'Буддизм', 'Религия, духовность, эзотерика'),
-				('religion_catholicism', 'Католицизм', 'Религия, духовность, эзотерика'),
-				('religion_christianity', 'Христианство', 'Религия, духовность, эзотерика'),
-				('religion_esoterics', 'Эзотерика, эзотерическая литература', 'Религия, духовность, эзотерика'),
-				('religion_hinduism', 'Индуизм', 'Религия, духовность, эзотерика'),
-				('religion_islam', 'Ислам', 'Религия, духовность, эзотерика'),
-				('religion_judaism', 'Иудаизм', 'Религия, духовность, эзотерика'),
-				('religion_orthodoxy', 'Православие', 'Религия, духовность, эзотерика'),
-				('religion_paganism', 'Язычество', 'Религия, духовность, эзотерика'),
-				('religion_protestantism', 'Протестантизм', 'Религия, духовность, эзотерика'),
-				('religion_self', 'Самосовершенствование', 'Религия, духовность, эзотерика'),
-				('religion', 'Религия, религиозная литература', 'Религия, духовность, эзотерика'),
-				('russian_fantasy', 'Славянское фэнтези', 'Фантастика'),
-				('sci_biology', 'Биология, биофизика, биохимия', 'Наука, Образование'),
-				('sci_botany', 'Ботаника', 'Наука, Образование'),
-				('sci_build', 'Строительство и сопромат', 'Техника'),
-				('sci_chem', 'Химия', 'Наука, Образование'),
-				('sci_cosmos', 'Астрономия и Космос', 'Наука, Образование'),
-				('sci_culture', 'Культурология', 'Искусство, Искусствоведение, Дизайн'),
-				('sci_ecology', 'Экология', 'Наука, Образование'),
-				('sci_economy', 'Экономика', 'Наука, Образование'),
-				('science', 'Научная литература', 'Наука, Образование'),
-				('sci_geo', 'Геология и география', 'Наука, Образование'),
-				('sci_history', 'История', 'Наука, Образование'),
-				('sci_juris', 'Юриспруденция', 'Наука, Образование'),
-				('sci_linguistic', 'Языкознание, иностранные языки', 'Наука, Образование'),
-				('sci_math', 'Математика', 'Наука, Образование'),
-				('sci_medicine_alternative', 'Альтернативная медицина', 'Наука, Образование'),
-				('sci_medicine', 'Медицина', 'Наука, Образование'),
-				('sci_metal', 'Металлургия', 'Техника'),
-				('sci_oriental', 'Востоковедение', 'Наука, Образование'),
-				('sci_pedagogy', 'Педагогика, воспитание детей, литература для родителей', 'Дом и семья'),
-				('sci_philology', 'Литературоведение', 'Наука, Образование'),
-				('sci_philosophy', 'Философия', 'Наука, Образование'),
-				('sci_phys', 'Физика', 'Наука, Образование'),
-				('sci_politics', 'Политика', 'Наука, Образование'),
-				('sci_popular', 'Зарубежная образовательная литература, зарубежная прикладная,  научно-популярная  литература', 'Наука, Образование'),
-				('sci_psychology', 'Психология и психотерапия', 'Наука, Образование'),
-				('sci_radio', 'Радиоэлектроника', 'Техника'),
-				('sci_religion', 'Религиоведение', 'Религия, духовность, эзотерика'),
-				('sci_social_studies', 'Обществознание, социология', 'Наука, Образование'),
-				('sci_state', 'Государство и право', 'Наука, Образование'),
-				('sci_tech', 'Технические науки', 'Техника'),
-				('sci_textbook', 'Учебники и пособия', 'Учебники и пособия'),
-				('sci_theories', 'Альтернативные науки и научные теории', 'Наука, Образование'),
-				('sci_transport', 'Транспорт и авиация', 'Техника'),
-				('sci_veterinary', 'Ветеринария', 'Наука, Образование'),
-				('sci_zoo', 'Зоология', 'Наука, Образование'),
-				('screenplays', 'Сценарий', 'Драматургия'),
-				('sf_action', 'Боевая фантастика', 'Фантастика'),
-				('sf_cyberpunk', 'Киберпанк', 'Фантастика'),
-				('sf_detective', 'Детективная фантастика', 'Фантастика'),
-				('sf_epic', 'Эпическая фантастика', 'Фантастика'),
-				('sf_etc', 'Фантастика', 'Фантастика'),
-				('sf_fantasy_city', 'Городское фэнтези', 'Фантастика'),
-				('sf_fantasy', 'Фэнтези', 'Фантастика'),
-				('sf_heroic', 'Героическая фантастика', 'Фантастика'),
-				('sf_history', 'Альтернативная история, попаданцы', 'Фантастика'),
-				('sf_horror', 'Ужасы', 'Фантастика'),
-				('sf_humor', 'Юмористическая фантастика', 'Фантастика'),
-				('sf_litrpg', 'ЛитРПГ', 'Фантастика'),
-				('sf_mystic', 'Мистика', 'Фантастика'),
-				('sf_postapocalyptic', 'Постапокалипсис', 'Фантастика'),
-				('sf_social', 'Социально-психологическая фантастика', 'Фантастика'),
-				('sf_space', 'Космическая фантастика', 'Фантастика'),
-				('sf_stimpank', 'Стимпанк', 'Фантастика'),
-				('sf_technofantasy', 'Технофэнтези', 'Фантастика'),
-				('sf', 'Научная Фантастика', 'Фантастика'),
-				('song_poetry', 'Песенная поэзия', 'Поэзия'),
-				('story', 'Малые литературные формы прозы: рассказы, эссе, новеллы, феерия', 'Проза'),
-				('tale_chivalry', 'Рыцарский роман', 'Приключения'),
-				('tbg_computers', 'Учебные пособия, самоучители', 'Компьютеры и Интернет'),
-				('tbg_higher', 'Учебники и пособия ВУЗов', 'Учебники и пособия'),
-				('tbg_school', 'Школьные учебники и пособия, рефераты, шпаргалки', 'Учебники и пособия'),
-				('tbg_secondary', 'Учебники и пособия для среднего и специального образования', 'Учебники и пособия'),
-				('theatre', 'Театр', 'Искусство, Искусствоведение, Дизайн'),
-				('thriller', 'Триллер', 'Детективы и Триллеры'),
-				('tragedy', 'Трагедия', 'Драматургия'),
-				('travel_notes', 'География, путевые заметки', 'Документальная литература'),
-				('unfinished', 'Незавершенное', 'Прочее'),
-				('vaudeville', 'Мистерия, буффонада, водевиль', 'Драматургия');
-	`)
-
-	// Make trigram indexes from the existing data.
-
-	// Authors
-
-	type author struct {
-		ID         uint32
-		FirstName  string `db:"first_name"`
-		MiddleName string `db:"middle_name"`
-		LastName   string `db:"last_name"`
-		Nickname   string
-	}
-	var authors []author
-	err := db.Select(&authors, "SELECT * FROM authors ORDER BY id")
+// openSQLite opens the database and brings its schema up to date.
+func openSQLite(dataSource string) (*sqlx.DB, error) {
+	conn, err := sqlx.Connect("sqlite3_fb2index", sqliteDSN(dataSource))
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
-	mAuthors := make(map[uint32][]trigram.T, len(authors))
-	for _, a := range authors {
-		tt := trigram.Extract(a.FirstName)
-		tt = append(tt, trigram.Extract(a.MiddleName)...)
-		tt = append(tt, trigram.Extract(a.LastName)...)
-		tt = append(tt, trigram.Extract(a.Nickname)...)
-		mAuthors[a.ID] = tt
-		trgmAuthorIndex.AddTrigrams(a.ID, tt)
+
+	err = migrate(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
 	}
 
-	// Sequences
+	return conn, nil
+}
 
-	type sequence struct {
-		Name string
-		ID   uint32
+// newSQLiteStore opens the database, migrating its schema if needed, and
+// loads or makes the trigram indexes.
+func newSQLiteStore(dataSource string) (*sqliteStore, error) {
+	conn, err := openSQLite(dataSource)
+	if err != nil {
+		return nil, err
 	}
-	var sequences []sequence
-	err = db.Select(&sequences, "SELECT * FROM sequences ORDER BY id")
+	db := &sqliteStore{DB: conn, path: databasePath(dataSource), trgmSaved: -1}
+
+	db.fts, err = hasFTS(conn)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
-	mSequences := make(map[uint32][]trigram.T, len(sequences))
-	for _, s := range sequences {
-		tt := trigram.Extract(s.Name)
-		mSequences[s.ID] = tt
-		trgmSequenceIndex.AddTrigrams(s.ID, tt)
+	if !db.fts {
+		log.Print("SQLite is built without FTS5 (-tags sqlite_fts5), the annotations and the texts are searched by substring")
 	}
 
-	// Books
+	err = db.syncGenres()
+	if err != nil {
+		return nil, err
+	}
 
-	type book struct {
-		ID    uint32
-		Title string
+	if !db.loadTrigramIndexes() {
+		db.initTrigramIndexes()
 	}
-	var books []book
-	err = db.Select(&books, "SELECT id, title FROM books ORDER BY id")
+
+	return db, nil
+}
+
+func commit(tx *sqlx.Tx) error {
+	err := tx.Commit()
 	if err != nil {
-		log.Fatal(err)
+		log.Printf("Commit failed: %v", err)
+		tx.Rollback()
 	}
-	for _, b := range books {
-		trgmBookIndex.Add(b.ID, b.Title)
-
-		var authorIDs []uint32
-		var translatorIDs []uint32
-		var sequenceIDs []uint32
+	return err
+}
 
-		err := db.Select(&authorIDs, "SELECT author_id FROM book_authors WHERE book_id = ? ORDER BY author_id", b.ID)
+func (db *sqliteStore) AddBook(b book) error {
+	if db.tx == nil {
+		tx, err := db.Beginx()
 		if err != nil {
-			log.Fatal(err)
-		}
-		for _, id := range authorIDs {
-			trgmBookIndex.AddTrigrams(b.ID, mAuthors[id])
+			return err
 		}
+		db.tx = tx
+	}
 
-		err = db.Select(&translatorIDs, "SELECT author_id FROM book_translators WHERE book_id = ? ORDER BY author_id", b.ID)
-		if err != nil {
-			log.Fatal(err)
-		}
-		for _, id := range translatorIDs {
-			trgmBookIndex.AddTrigrams(b.ID, mAuthors[id])
-		}
+	return db.indexBook(db.tx, b, &db.trgm)
+}
 
-		err = db.Select(&sequenceIDs, "SELECT sequence_id FROM book_sequences WHERE book_id = ? ORDER BY sequence_id", b.ID)
-		if err != nil {
-			log.Fatal(err)
+// Flush records the queued index errors and commits the transaction,
+// beginning one if there are errors but no transaction. The trigrams of the
+// books are added to the indexes if the commit succeeds, and dropped
+// otherwise.
+func (db *sqliteStore) Flush() error {
+	tx, trgm := db.tx, db.trgm
+	db.tx, db.trgm = nil, trigramAdditions{}
+
+	if havePendingErrors() {
+		if tx == nil {
+			var err error
+			tx, err = db.Beginx()
+			if err != nil {
+				return err
+			}
 		}
-		for _, id := range sequenceIDs {
-			trgmBookIndex.AddTrigrams(b.ID, mSequences[id])
+		err := recordIndexErrors(tx)
+		if err != nil {
+			log.Printf("Failed to record index errors: %v", err)
 		}
 	}
+
+	if tx == nil {
+		return nil
+	}
+
+	err := commit(tx)
+	if err != nil {
+		return err
+	}
+
+	db.addTrigrams(&trgm)
+
+	return nil
+}
+
+// flushResult is the reply to a flush: the result of the commit, and the
+// archives some of whose books could not be added.
+type flushResult struct {
+	err    error
+	failed map[string]bool
 }
 
-func insertWorker(tx *sqlx.Tx, books <-chan book, done chan<- bool) {
+func insertWorker(books <-chan book, flush <-chan chan flushResult, done chan<- bool) {
 	defer close(done)
 
-	for book := range books {
-		err := indexBook(tx, book)
+	failed := make(map[string]bool)
+	add := func(b book) {
+		err := store.AddBook(b)
 		if err != nil {
-			log.Printf("%s/%s: failed to add book: %v", book.Archive, book.Filename, err)
+			reportIndexError(b.Archive, b.Filename, stageInsert, err)
+			failed[b.Archive] = true
 		}
 	}
 
-	err := tx.Commit()
-	if err != nil {
-		log.Printf("Commit failed: %v", err)
-		tx.Rollback()
+	for {
+		select {
+		case book, ok := <-books:
+			if !ok {
+				store.Flush()
+				return
+			}
+
+			add(book)
+		case reply := <-flush:
+			// The books sent before the flush may still be buffered.
+			for len(books) > 0 {
+				add(<-books)
+			}
+
+			reply <- flushResult{store.Flush(), failed}
+			failed = make(map[string]bool)
+		}
 	}
 }
 
-func startInsertWorker() (chan<- book, <-chan bool) {
-	tx := db.MustBegin()
-
+// startInsertWorker starts a worker which adds books to the database. The
+// books are committed when the books channel is closed or when a reply
+// channel is sent on the flush channel; in the latter case the result of the
+// commit is sent back on the reply channel.
+func startInsertWorker() (chan<- book, chan<- chan flushResult, <-chan bool) {
 	jobs := make(chan book, *parallel)
+	flush := make(chan chan flushResult)
 	done := make(chan bool)
-	go insertWorker(tx, jobs, done)
+	go insertWorker(jobs, flush, done)
 
-	return jobs, done
+	return jobs, flush, done
 }
 
 func lastInsertID(tx *sqlx.Tx) (id uint32, err error) {
@@ -458,15 +260,23 @@ func getOrInsertGenre(tx *sqlx.Tx, g string) (id uint32, inserted bool, err erro
 	return id, err == nil, err
 }
 
+// getOrInsertAuthor returns the author with the same name, ignoring case and
+// whitespace, or the author it is an alias of; otherwise it inserts a new
+// author.
 func getOrInsertAuthor(tx *sqlx.Tx, a author) (id uint32, inserted bool, err error) {
-	err = tx.Get(&id, "SELECT id FROM authors WHERE last_name = ? AND first_name = ? AND middle_name = ? AND nickname = ?",
-		a.LastName, a.FirstName, a.MiddleName, a.Nickname)
+	norm := authorKey(a)
+	err = tx.Get(&id, "SELECT author_id FROM author_aliases WHERE norm = ?", norm)
+	if err != sql.ErrNoRows {
+		return
+	}
+
+	err = tx.Get(&id, "SELECT id FROM authors WHERE norm = ? ORDER BY id LIMIT 1", norm)
 	if err != sql.ErrNoRows {
 		return
 	}
 
-	_, err = tx.Exec("INSERT INTO authors (first_name, middle_name, last_name, nickname) VALUES (?, ?, ?, ?)",
-		a.FirstName, a.MiddleName, a.LastName, a.Nickname)
+	_, err = tx.Exec("INSERT INTO authors (first_name, middle_name, last_name, nickname, norm) VALUES (?, ?, ?, ?, ?)",
+		a.FirstName, a.MiddleName, a.LastName, a.Nickname, norm)
 	if err != nil {
 		return
 	}
@@ -475,13 +285,23 @@ func getOrInsertAuthor(tx *sqlx.Tx, a author) (id uint32, inserted bool, err err
 	return id, err == nil, err
 }
 
-func getOrInsertSequence(tx *sqlx.Tx, name string) (id uint32, inserted bool, err error) {
-	err = tx.Get(&id, "SELECT id FROM sequences WHERE name = ?", name)
+// getOrInsertSequence returns the sequence with the given name and kind,
+// inserting it if needed. The parent, unless zero, is recorded if the
+// sequence does not have one yet.
+func getOrInsertSequence(tx *sqlx.Tx, name string, kind int, parentID uint32) (id uint32, inserted bool, err error) {
+	var s sequence
+	err = tx.Get(&s, "SELECT id, parent_id FROM sequences WHERE name = ? AND kind = ?", name, kind)
+	if err == nil {
+		if s.ParentID == 0 && parentID != 0 && parentID != s.ID {
+			_, err = tx.Exec("UPDATE sequences SET parent_id = ? WHERE id = ?", parentID, s.ID)
+		}
+		return s.ID, false, err
+	}
 	if err != sql.ErrNoRows {
 		return
 	}
 
-	_, err = tx.Exec("INSERT INTO sequences (name) VALUES (?)", name)
+	_, err = tx.Exec("INSERT INTO sequences (name, kind, parent_id) VALUES (?, ?, ?)", name, kind, parentID)
 	if err != nil {
 		return
 	}
@@ -490,9 +310,9 @@ func getOrInsertSequence(tx *sqlx.Tx, name string) (id uint32, inserted bool, er
 	return id, err == nil, err
 }
 
-func indexBook(tx *sqlx.Tx, b book) error {
-	_, err := tx.Exec("INSERT INTO books (title, lang, archive, filename, offset, compressed_size, uncompressed_size, crc32) VALUES (?, ?, ?, ?, ?, ?, ?, ?);",
-		b.Title, b.Lang, b.Archive, b.Filename, b.Offset, b.CompressedSize, b.UncompressedSize, b.CRC32)
+func (db *sqliteStore) indexBook(tx *sqlx.Tx, b book, ta *trigramAdditions) error {
+	_, err := tx.Exec("INSERT INTO books (title, lang, archive, filename, offset, compressed_size, uncompressed_size, crc32, method, kind, lib_id, added, deleted, src_lang, date, keywords, encoding, raw_lang) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?);",
+		b.Title, b.Lang, b.Archive, b.Filename, b.Offset, b.CompressedSize, b.UncompressedSize, b.CRC32, b.Method, b.Kind, b.LibID, b.Added, b.Deleted, b.SrcLang, b.Date, b.Keywords, b.Encoding, b.RawLang)
 	if err != nil {
 		return err
 	}
@@ -502,7 +322,59 @@ func indexBook(tx *sqlx.Tx, b book) error {
 		return err
 	}
 
-	var trigrams []trigram.T
+	return db.indexBookDesc(tx, bookID, b, ta)
+}
+
+func insertBookText(tx *sqlx.Tx, bookID uint32, text []textSection) error {
+	for i, t := range text {
+		if i >= maxTextRows {
+			break
+		}
+		_, err := tx.Exec("INSERT INTO book_texts (rowid, section, text) VALUES (?, ?, ?)", textRowID(bookID, i), t.Section, t.Text)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// indexBookDesc adds what the description of the book has besides the row in
+// books: the publish and document info, the annotation, the text, the genres,
+// the authors and the sequences. The trigrams of the book, and those of its
+// new authors and sequences, are added to ta.
+func (db *sqliteStore) indexBookDesc(tx *sqlx.Tx, bookID uint32, b book, ta *trigramAdditions) error {
+	var err error
+	if pi := b.PublishInfo; pi != (publishInfo{}) {
+		_, err = tx.Exec("INSERT INTO publish_info (book_id, publisher, city, year, isbn) VALUES (?, ?, ?, ?, ?)",
+			bookID, pi.Publisher, pi.City, pi.Year, pi.ISBN)
+		if err != nil {
+			return err
+		}
+	}
+
+	if di := b.DocumentInfo; di != (documentInfo{}) {
+		_, err = tx.Exec("INSERT INTO document_info (book_id, doc_id, version, program_used, date) VALUES (?, ?, ?, ?, ?)",
+			bookID, di.ID, di.Version, di.ProgramUsed, di.Date)
+		if err != nil {
+			return err
+		}
+	}
+
+	if b.Annotation != "" {
+		_, err = tx.Exec("INSERT INTO book_annotations (rowid, annotation) VALUES (?, ?)", bookID, b.Annotation)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = insertBookText(tx, bookID, b.Text)
+	if err != nil {
+		return err
+	}
+
+	bf := new(bookFields)
+	bf[fieldTitle] = trigram.Extract(b.Title)
 
 	for _, g := range b.Genres {
 		genreID, _, err := getOrInsertGenre(tx, g.Name)
@@ -527,13 +399,13 @@ func indexBook(tx *sqlx.Tx, b book) error {
 			return err
 		}
 
+		// The book is found by the names of the authors known before
+		// too, but only the new authors are added to the author index.
+		trgm := authorTrigrams(nil, a)
 		if inserted {
-			for _, s := range []string{a.FirstName, a.MiddleName, a.LastName, a.Nickname} {
-				trgm := trigram.Extract(s)
-				trgmAuthorIndex.AddTrigrams(authorID, trgm)
-				trigrams = append(trigrams, trgm...)
-			}
+			ta.authors = append(ta.authors, idTrigrams{authorID, trgm})
 		}
+		bf[fieldAuthor] = append(bf[fieldAuthor], trgm...)
 	}
 
 	for _, a := range b.Translators {
@@ -547,35 +419,43 @@ func indexBook(tx *sqlx.Tx, b book) error {
 			return err
 		}
 
+		trgm := authorTrigrams(nil, a)
 		if inserted {
-			for _, s := range []string{a.FirstName, a.MiddleName, a.LastName, a.Nickname} {
-				trgm := trigram.Extract(s)
-				trgmAuthorIndex.AddTrigrams(authorID, trgm)
-				trigrams = append(trigrams, trgm...)
-			}
+			ta.authors = append(ta.authors, idTrigrams{authorID, trgm})
 		}
+		bf[fieldTranslator] = append(bf[fieldTranslator], trgm...)
 	}
 
+	type seqKey struct {
+		name string
+		kind int
+	}
+	seqIDs := make(map[seqKey]uint32, len(b.Sequences))
 	for _, s := range b.Sequences {
-		seqID, inserted, err := getOrInsertSequence(tx, s.Name)
+		var parentID uint32
+		if s.Parent != "" {
+			parentID = seqIDs[seqKey{s.Parent, s.Kind}]
+		}
+
+		seqID, inserted, err := getOrInsertSequence(tx, s.Name, s.Kind, parentID)
 		if err != nil {
 			return err
 		}
+		seqIDs[seqKey{s.Name, s.Kind}] = seqID
 
-		_, err = tx.Exec("INSERT OR IGNORE INTO book_sequences (book_id, sequence_id, number) VALUES (?, ?, ?)", bookID, seqID, s.Number)
+		_, err = tx.Exec("INSERT OR IGNORE INTO book_sequences (book_id, sequence_id, number, position) VALUES (?, ?, ?, ?)", bookID, seqID, s.Number, s.Position)
 		if err != nil {
 			return err
 		}
 
+		trgm := trigram.Extract(s.Name)
 		if inserted {
-			trgm := trigram.Extract(s.Name)
-			trgmSequenceIndex.AddTrigrams(seqID, trgm)
-			trigrams = append(trigrams, trgm...)
+			ta.sequences = append(ta.sequences, idTrigrams{seqID, trgm})
 		}
+		bf[fieldSequence] = append(bf[fieldSequence], trgm...)
 	}
 
-	trgmBookIndex.AddTrigrams(bookID, trigrams)
-	trgmBookIndex.Add(bookID, b.Title)
+	ta.books = append(ta.books, idFields{bookID, bf})
 
 	return nil
 }
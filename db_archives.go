@@ -0,0 +1,339 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"archive/zip"
+	"log"
+	"os"
+
+	"github.com/jmoiron/sqlx"
+)
+
+type archive struct {
+	Name    string
+	Size    int64
+	ModTime int64 `db:"mtime"`
+}
+
+func (db *sqliteStore) recordedArchives() (map[string]archive, error) {
+	var archives []archive
+	err := db.Select(&archives, "SELECT name, size, mtime FROM archives")
+	if err != nil {
+		return nil, err
+	}
+
+	m := make(map[string]archive, len(archives))
+	for _, a := range archives {
+		m[a.Name] = a
+	}
+
+	return m, nil
+}
+
+func (db *sqliteStore) RecordArchives(archives []archive) error {
+	tx, err := db.Beginx()
+	if err != nil {
+		return err
+	}
+
+	for _, a := range archives {
+		_, err := tx.Exec("INSERT OR REPLACE INTO archives (name, size, mtime) VALUES (?, ?, ?)", a.Name, a.Size, a.ModTime)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (db *sqliteStore) RemoveArchives(names []string) error {
+	tx, err := db.Beginx()
+	if err != nil {
+		return err
+	}
+
+	var removedBooks []uint32
+	for _, name := range names {
+		removed, err := removeArchive(tx, name)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		removedBooks = append(removedBooks, removed...)
+	}
+
+	removedAuthors, removedSequences, err := removeOrphans(tx)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	err = commit(tx)
+	if err != nil {
+		return err
+	}
+
+	db.removeTrigrams(removedBooks, removedAuthors, removedSequences)
+
+	return nil
+}
+
+// removeTrigrams removes the books, the authors and the sequences from the
+// trigram indexes.
+func (db *sqliteStore) removeTrigrams(books, authors, sequences []uint32) {
+	db.trgmMu.Lock()
+	defer db.trgmMu.Unlock()
+
+	db.trgmBookIndex.Remove(books...)
+	db.trgmAuthorIndex.Remove(authors...)
+	db.trgmSequenceIndex.Remove(sequences...)
+}
+
+// removeBookDesc removes what the description of the book adds besides the
+// row in books and the text (see indexBookDesc).
+func removeBookDesc(tx *sqlx.Tx, id uint32) error {
+	for _, q := range []string{
+		"DELETE FROM book_genres WHERE book_id = ?",
+		"DELETE FROM book_authors WHERE book_id = ?",
+		"DELETE FROM book_translators WHERE book_id = ?",
+		"DELETE FROM book_sequences WHERE book_id = ?",
+		"DELETE FROM publish_info WHERE book_id = ?",
+		"DELETE FROM document_info WHERE book_id = ?",
+		"DELETE FROM book_annotations WHERE rowid = ?",
+	} {
+		_, err := tx.Exec(q, id)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func removeBookText(tx *sqlx.Tx, id uint32) error {
+	_, err := tx.Exec("DELETE FROM book_texts WHERE rowid >= ? AND rowid < ?", textRowID(id, 0), textRowID(id+1, 0))
+	return err
+}
+
+func removeBooks(tx *sqlx.Tx, ids []uint32) error {
+	for _, id := range ids {
+		err := removeBookDesc(tx, id)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec("DELETE FROM books WHERE id = ?", id)
+		if err != nil {
+			return err
+		}
+
+		err = removeBookText(tx, id)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// removeArchive removes the books of the archive, and returns their ids.
+func removeArchive(tx *sqlx.Tx, name string) ([]uint32, error) {
+	var ids []uint32
+	err := tx.Select(&ids, "SELECT id FROM books WHERE archive = ?", name)
+	if err != nil {
+		return nil, err
+	}
+
+	err = removeBooks(tx, ids)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = tx.Exec("DELETE FROM archives WHERE name = ?", name)
+	if err != nil {
+		return nil, err
+	}
+
+	return ids, clearIndexErrors(tx, name)
+}
+
+// removeOrphans removes the authors and the sequences left without books,
+// and returns their ids.
+func removeOrphans(tx *sqlx.Tx) ([]uint32, []uint32, error) {
+	const orphanAuthors = `FROM authors
+			    WHERE id NOT IN (SELECT author_id FROM book_authors)
+			      AND id NOT IN (SELECT author_id FROM book_translators)`
+	const orphanSequences = `FROM sequences
+			    WHERE id NOT IN (SELECT sequence_id FROM book_sequences)`
+
+	var authorIDs, sequenceIDs []uint32
+	err := tx.Select(&authorIDs, "SELECT id "+orphanAuthors)
+	if err != nil {
+		return nil, nil, err
+	}
+	err = tx.Select(&sequenceIDs, "SELECT id "+orphanSequences)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	_, err = tx.Exec(`DELETE ` + orphanAuthors + `;
+			   DELETE FROM author_aliases
+			    WHERE author_id NOT IN (SELECT id FROM authors);
+			   DELETE ` + orphanSequences + `;
+			   UPDATE sequences SET parent_id = 0
+			    WHERE parent_id <> 0 AND parent_id NOT IN (SELECT id FROM sequences);
+			`)
+	return authorIDs, sequenceIDs, err
+}
+
+// pruneArchive removes the books whose entries have changed or disappeared
+// from the archive, and returns the names of the entries that are still
+// indexed and the ids of the removed books. A changed FB2 file is always
+// removed.
+func pruneArchive(tx *sqlx.Tx, name string) (map[string]bool, []uint32, error) {
+	var books []book
+	err := tx.Select(&books, `SELECT id, filename, offset, compressed_size, crc32, method
+				    FROM books
+				   WHERE archive = ?
+				`, name)
+	if err != nil || len(books) == 0 {
+		return nil, nil, err
+	}
+
+	if isFB2(name) {
+		ids := []uint32{books[0].ID}
+		return nil, ids, removeBooks(tx, ids)
+	}
+
+	r, err := zip.OpenReader(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer r.Close()
+
+	files := make(map[string]*zip.File, len(r.File))
+	for _, f := range r.File {
+		files[f.Name] = f
+	}
+
+	indexed := make(map[string]bool, len(books))
+	var stale []uint32
+	for _, b := range books {
+		if f := files[b.Filename]; f != nil {
+			offset, err := f.DataOffset()
+			if err == nil && offset == b.Offset && int64(f.CompressedSize64) == b.CompressedSize && f.CRC32 == b.CRC32 && f.Method == b.Method {
+				indexed[b.Filename] = true
+				continue
+			}
+		}
+		stale = append(stale, b.ID)
+	}
+
+	if len(stale) > 0 {
+		log.Printf("%s: removing %d stale book(s)", name, len(stale))
+	}
+
+	return indexed, stale, removeBooks(tx, stale)
+}
+
+// ScanArchives compares the given archives with those recorded in the
+// database. Unchanged archives are skipped, books from the changed ones are
+// pruned, and archives which no longer exist are removed altogether. The
+// removed books, authors and sequences are removed from the trigram indexes.
+func (db *sqliteStore) ScanArchives(names []string) ([]archive, map[string]map[string]bool, error) {
+	recorded, err := db.recordedArchives()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var removedBooks []uint32
+	seen := make(map[string]bool, len(names))
+	indexed := make(map[string]map[string]bool)
+	var pending []archive
+	for _, name := range names {
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+
+		fi, err := os.Stat(name)
+		if err != nil {
+			log.Printf("%s: stat: %v", name, err)
+			continue
+		}
+
+		a := archive{
+			Name:    name,
+			Size:    fi.Size(),
+			ModTime: fi.ModTime().Unix(),
+		}
+		if r, ok := recorded[name]; ok && r == a {
+			continue
+		}
+
+		err = clearIndexErrors(tx, name)
+		if err != nil {
+			tx.Rollback()
+			return nil, nil, err
+		}
+
+		entries, removed, err := pruneArchive(tx, name)
+		if err != nil {
+			reportIndexError(name, "", stageOpen, err)
+			continue
+		}
+		indexed[name] = entries
+		removedBooks = append(removedBooks, removed...)
+
+		pending = append(pending, a)
+	}
+
+	for name := range recorded {
+		if seen[name] {
+			continue
+		}
+
+		if _, err := os.Stat(name); os.IsNotExist(err) {
+			log.Printf("%s: archive disappeared, removing", name)
+			removed, err := removeArchive(tx, name)
+			if err != nil {
+				tx.Rollback()
+				return nil, nil, err
+			}
+			removedBooks = append(removedBooks, removed...)
+		}
+	}
+
+	removedAuthors, removedSequences, err := removeOrphans(tx)
+	if err != nil {
+		tx.Rollback()
+		return nil, nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	db.removeTrigrams(removedBooks, removedAuthors, removedSequences)
+
+	return pending, indexed, nil
+}
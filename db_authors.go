@@ -13,7 +13,49 @@
 
 package main
 
-func updateAuthorWithBookCount(a *author) error {
+import (
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// maxCandidateBucket is the number of authors sharing a name word above
+// which the word is too common to suggest merging them.
+const maxCandidateBucket = 1000
+
+type mergeCandidate struct {
+	A, B  author
+	Score int
+}
+
+type byMergeScore []mergeCandidate
+
+func (c byMergeScore) Len() int { return len(c) }
+func (c byMergeScore) Less(i, j int) bool {
+	return c[i].Score > c[j].Score
+}
+func (c byMergeScore) Swap(i, j int) { c[i], c[j] = c[j], c[i] }
+
+var yoReplacer = strings.NewReplacer("ё", "е")
+
+// normalizeName lowercases the name and collapses its whitespace.
+func normalizeName(s string) string {
+	return strings.Join(strings.Fields(yoReplacer.Replace(strings.ToLower(s))), " ")
+}
+
+// authorKey returns the key by which the authors with the same name are
+// matched.
+func authorKey(a author) string {
+	return strings.Join([]string{
+		normalizeName(a.FirstName),
+		normalizeName(a.MiddleName),
+		normalizeName(a.LastName),
+		normalizeName(a.Nickname),
+	}, "|")
+}
+
+func (db *sqliteStore) updateAuthorWithBookCount(a *author) error {
 	var count int
 	err := db.Get(&count, `SELECT COUNT(book_id) FROM (
 					SELECT book_id, author_id
@@ -34,9 +76,9 @@ func updateAuthorWithBookCount(a *author) error {
 	return nil
 }
 
-func updateAuthorsWithBookCounts(authors []author) error {
+func (db *sqliteStore) updateAuthorsWithBookCounts(authors []author) error {
 	for i := range authors {
-		err := updateAuthorWithBookCount(&authors[i])
+		err := db.updateAuthorWithBookCount(&authors[i])
 		if err != nil {
 			return err
 		}
@@ -45,7 +87,7 @@ func updateAuthorsWithBookCounts(authors []author) error {
 	return nil
 }
 
-func AuthorsPerPage(n int) ([]author, int, error) {
+func (db *sqliteStore) AuthorsPerPage(n int) ([]author, int, error) {
 	var count int
 	err := db.Get(&count, "SELECT COUNT(*) FROM authors")
 	if err != nil {
@@ -68,7 +110,7 @@ func AuthorsPerPage(n int) ([]author, int, error) {
 		return nil, 0, err
 	}
 
-	err = updateAuthorsWithBookCounts(authors)
+	err = db.updateAuthorsWithBookCounts(authors)
 	if err != nil {
 		return nil, 0, err
 	}
@@ -76,7 +118,7 @@ func AuthorsPerPage(n int) ([]author, int, error) {
 	return authors, numPages, nil
 }
 
-func AuthorByID(id uint32) (*author, error) {
+func (db *sqliteStore) AuthorByID(id uint32) (*author, error) {
 	var au author
 	err := db.Get(&au, `SELECT id, first_name, middle_name, last_name, nickname
 				 FROM authors
@@ -88,3 +130,203 @@ func AuthorByID(id uint32) (*author, error) {
 
 	return &au, nil
 }
+
+func (db *sqliteStore) AuthorAliases(id uint32) ([]author, error) {
+	var aliases []author
+	err := db.Select(&aliases, `SELECT first_name, middle_name, last_name, nickname
+				      FROM author_aliases
+				     WHERE author_id = ?
+				  ORDER BY last_name, first_name, nickname
+				`, id)
+	return aliases, err
+}
+
+// MergeAuthors moves the books of the author from to the author into, and
+// records the name of the former as an alias of the latter, so that the books
+// indexed later are added to the author into as well.
+func (db *sqliteStore) MergeAuthors(into, from uint32) error {
+	tx, err := db.Beginx()
+	if err != nil {
+		return err
+	}
+
+	var a author
+	err = tx.Get(&a, "SELECT id, first_name, middle_name, last_name, nickname FROM authors WHERE id = ?", from)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	var id uint32
+	err = tx.Get(&id, "SELECT id FROM authors WHERE id = ?", into)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	// The books of both authors are indexed by the names of the author
+	// into, which is about to get a new alias.
+	var bookIDs []uint32
+	err = tx.Select(&bookIDs, `SELECT book_id FROM book_authors WHERE author_id IN (?1, ?2)
+				   UNION
+				   SELECT book_id FROM book_translators WHERE author_id IN (?1, ?2)`, into, from)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	for _, q := range []string{
+		"UPDATE OR IGNORE book_authors SET author_id = ?1 WHERE author_id = ?2",
+		"DELETE FROM book_authors WHERE author_id = ?2",
+		"UPDATE OR IGNORE book_translators SET author_id = ?1 WHERE author_id = ?2",
+		"DELETE FROM book_translators WHERE author_id = ?2",
+		"UPDATE author_aliases SET author_id = ?1 WHERE author_id = ?2",
+		"DELETE FROM authors WHERE id = ?2",
+	} {
+		_, err := tx.Exec(q, into, from)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	_, err = tx.Exec("INSERT OR REPLACE INTO author_aliases (norm, first_name, middle_name, last_name, nickname, author_id) VALUES (?, ?, ?, ?, ?, ?)",
+		authorKey(a), a.FirstName, a.MiddleName, a.LastName, a.Nickname, into)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+
+	return db.updateAuthorTrigrams(into, from, bookIDs)
+}
+
+// nameWords returns the normalized words of the name of the author.
+func nameWords(a author) []string {
+	var words []string
+	for _, s := range []string{a.FirstName, a.MiddleName, a.LastName, a.Nickname} {
+		words = append(words, strings.FieldsFunc(normalizeName(s), func(r rune) bool {
+			return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+		})...)
+	}
+	return words
+}
+
+// wordsMatch reports whether the words are the same, or one of them is the
+// initial of the other.
+func wordsMatch(a, b string) bool {
+	if a == b {
+		return true
+	}
+
+	ra, _ := utf8.DecodeRuneInString(a)
+	rb, _ := utf8.DecodeRuneInString(b)
+	return ra == rb && (utf8.RuneCountInString(a) == 1 || utf8.RuneCountInString(b) == 1)
+}
+
+// similarNames reports whether each word of the shorter name matches a word
+// of the longer one.
+func similarNames(x, y []string) bool {
+	if len(x) > len(y) {
+		x, y = y, x
+	}
+
+	used := make([]bool, len(y))
+	for _, w := range x {
+		found := false
+		for j, v := range y {
+			if !used[j] && wordsMatch(w, v) {
+				used[j] = true
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	return true
+}
+
+// mergeCandidates returns up to limit pairs of the authors who share a name
+// word and whose names are similar enough to be the same person, the pairs
+// with the most matching words first.
+func mergeCandidates(authors []author, limit int) []mergeCandidate {
+	words := make([][]string, len(authors))
+	buckets := make(map[string][]int)
+	for i, a := range authors {
+		words[i] = nameWords(a)
+		for _, w := range words[i] {
+			if utf8.RuneCountInString(w) < 2 {
+				continue
+			}
+			if b := buckets[w]; len(b) == 0 || b[len(b)-1] != i {
+				buckets[w] = append(b, i)
+			}
+		}
+	}
+
+	seen := make(map[[2]int]bool)
+	var candidates []mergeCandidate
+	for i := range authors {
+		for _, w := range words[i] {
+			b := buckets[w]
+			if len(b) > maxCandidateBucket {
+				continue
+			}
+
+			for _, j := range b {
+				if j <= i || seen[[2]int{i, j}] {
+					continue
+				}
+				seen[[2]int{i, j}] = true
+
+				if similarNames(words[i], words[j]) {
+					score := len(words[i])
+					if len(words[j]) < score {
+						score = len(words[j])
+					}
+					candidates = append(candidates, mergeCandidate{
+						A:     authors[i],
+						B:     authors[j],
+						Score: score,
+					})
+				}
+			}
+		}
+	}
+
+	sort.Stable(byMergeScore(candidates))
+	if len(candidates) > limit {
+		candidates = candidates[:limit]
+	}
+
+	return candidates
+}
+
+func (db *sqliteStore) MergeCandidates(limit int) ([]mergeCandidate, error) {
+	var authors []author
+	err := db.Select(&authors, "SELECT id, first_name, middle_name, last_name, nickname FROM authors ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+
+	candidates := mergeCandidates(authors, limit)
+	for i := range candidates {
+		err := db.updateAuthorWithBookCount(&candidates[i].A)
+		if err != nil {
+			return nil, err
+		}
+		err = db.updateAuthorWithBookCount(&candidates[i].B)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return candidates, nil
+}
@@ -0,0 +1,187 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestAuthorKey(t *testing.T) {
+	for _, tc := range []struct {
+		a, b  author
+		equal bool
+	}{
+		{
+			author{FirstName: "Лев", LastName: "Толстой"},
+			author{FirstName: " лев ", LastName: "ТОЛСТОЙ"},
+			true,
+		},
+		{
+			author{FirstName: "Пётр", LastName: "Алексеев"},
+			author{FirstName: "Петр", LastName: "Алексеев"},
+			true,
+		},
+		{
+			author{FirstName: "Анна", MiddleName: "Мария  Луиза", LastName: "Ф"},
+			author{FirstName: "Анна", MiddleName: "Мария Луиза", LastName: "Ф"},
+			true,
+		},
+		{
+			author{FirstName: "Лев", LastName: "Толстой"},
+			author{FirstName: "Толстой", LastName: "Лев"},
+			false,
+		},
+		{
+			author{FirstName: "Л.", LastName: "Толстой"},
+			author{FirstName: "Лев", LastName: "Толстой"},
+			false,
+		},
+		{
+			author{LastName: "Толстой"},
+			author{Nickname: "Толстой"},
+			false,
+		},
+	} {
+		ka, kb := authorKey(tc.a), authorKey(tc.b)
+		if equal := ka == kb; equal != tc.equal {
+			t.Errorf("authorKey(%+v) = %q, authorKey(%+v) = %q: want equal %v", tc.a, ka, tc.b, kb, tc.equal)
+		}
+	}
+}
+
+func TestMergeCandidates(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		a, b    author
+		similar bool
+		score   int
+	}{
+		{
+			name:    "initial",
+			a:       author{FirstName: "Лев", MiddleName: "Николаевич", LastName: "Толстой"},
+			b:       author{FirstName: "Л.", MiddleName: "Н.", LastName: "Толстой"},
+			similar: true,
+			score:   3,
+		},
+		{
+			name:    "missing middle name",
+			a:       author{FirstName: "Лев", MiddleName: "Николаевич", LastName: "Толстой"},
+			b:       author{FirstName: "Лев", LastName: "Толстой"},
+			similar: true,
+			score:   2,
+		},
+		{
+			name:    "reordered",
+			a:       author{FirstName: "Лев", LastName: "Толстой"},
+			b:       author{FirstName: "Толстой", LastName: "Лев"},
+			similar: true,
+			score:   2,
+		},
+		{
+			name:    "last name in the first name",
+			a:       author{FirstName: "Лев", LastName: "Толстой"},
+			b:       author{FirstName: "Толстой Лев"},
+			similar: true,
+			score:   2,
+		},
+		{
+			name:    "ё",
+			a:       author{FirstName: "Пётр", LastName: "Алексеев"},
+			b:       author{FirstName: "Петр", LastName: "Алексеев"},
+			similar: true,
+			score:   2,
+		},
+		{
+			name: "different initial",
+			a:    author{FirstName: "Лев", LastName: "Толстой"},
+			b:    author{FirstName: "А.", LastName: "Толстой"},
+		},
+		{
+			name: "different first name",
+			a:    author{FirstName: "Лев", LastName: "Толстой"},
+			b:    author{FirstName: "Алексей", LastName: "Толстой"},
+		},
+		{
+			name: "only initials shared",
+			a:    author{FirstName: "А.", LastName: "Б."},
+			b:    author{FirstName: "А", LastName: "Б"},
+		},
+	} {
+		tc.a.ID, tc.b.ID = 1, 2
+		candidates := mergeCandidates([]author{tc.a, tc.b}, 10)
+		if !tc.similar {
+			if len(candidates) != 0 {
+				t.Errorf("%s: want no candidates, got %+v", tc.name, candidates)
+			}
+			continue
+		}
+		if len(candidates) != 1 {
+			t.Errorf("%s: want one candidate, got %+v", tc.name, candidates)
+			continue
+		}
+		c := candidates[0]
+		if c.A.ID != 1 || c.B.ID != 2 || c.Score != tc.score {
+			t.Errorf("%s: want authors 1 and 2 with score %d, got %+v", tc.name, tc.score, c)
+		}
+	}
+}
+
+func TestMergeCandidatesOrder(t *testing.T) {
+	authors := []author{
+		{ID: 1, FirstName: "Лев", LastName: "Толстой"},
+		{ID: 2, FirstName: "Фёдор", MiddleName: "Михайлович", LastName: "Достоевский"},
+		{ID: 3, FirstName: "Л.", LastName: "Толстой"},
+		{ID: 4, FirstName: "Ф.", MiddleName: "М.", LastName: "Достоевский"},
+	}
+
+	candidates := mergeCandidates(authors, 10)
+	if len(candidates) != 2 || candidates[0].A.ID != 2 || candidates[1].A.ID != 1 {
+		t.Fatalf("want the pair with more matching words first, got %+v", candidates)
+	}
+
+	candidates = mergeCandidates(authors, 1)
+	if len(candidates) != 1 || candidates[0].A.ID != 2 {
+		t.Fatalf("want only the best pair, got %+v", candidates)
+	}
+}
+
+// bucketAuthors returns n authors sharing the last name, only the first two
+// of whom are similar.
+func bucketAuthors(n int) []author {
+	authors := []author{
+		{ID: 1, FirstName: "Иван", LastName: "Кузнецов"},
+		{ID: 2, FirstName: "И.", LastName: "Кузнецов"},
+	}
+	for i := len(authors); i < n; i++ {
+		authors = append(authors, author{
+			ID:        uint32(i + 1),
+			FirstName: "x" + strconv.Itoa(i),
+			LastName:  "Кузнецов",
+		})
+	}
+	return authors
+}
+
+func TestMergeCandidatesBucket(t *testing.T) {
+	candidates := mergeCandidates(bucketAuthors(maxCandidateBucket), 10)
+	if len(candidates) != 1 || candidates[0].A.ID != 1 || candidates[0].B.ID != 2 {
+		t.Errorf("%d authors sharing a name: want one candidate, got %+v", maxCandidateBucket, candidates)
+	}
+
+	candidates = mergeCandidates(bucketAuthors(maxCandidateBucket+1), 10)
+	if len(candidates) != 0 {
+		t.Errorf("%d authors sharing a name: want no candidates, got %+v", maxCandidateBucket+1, candidates)
+	}
+}
@@ -13,9 +13,13 @@
 
 package main
 
-import "sort"
+import (
+	"sort"
 
-func bookGenres(id uint32) ([]genre, error) {
+	"github.com/jmoiron/sqlx"
+)
+
+func (db *sqliteStore) bookGenres(id uint32) ([]genre, error) {
 	var ge []genre
 	err := db.Select(&ge, `SELECT id, name, desc
 				 FROM book_genres bg, genres g
@@ -26,7 +30,7 @@ func bookGenres(id uint32) ([]genre, error) {
 	return ge, err
 }
 
-func bookAuthors(id uint32) ([]author, error) {
+func (db *sqliteStore) bookAuthors(id uint32) ([]author, error) {
 	var au []author
 	err := db.Select(&au, `SELECT id, first_name, middle_name, last_name, nickname
 				 FROM book_authors ba, authors a
@@ -37,7 +41,7 @@ func bookAuthors(id uint32) ([]author, error) {
 	return au, err
 }
 
-func bookTranslators(id uint32) ([]author, error) {
+func (db *sqliteStore) bookTranslators(id uint32) ([]author, error) {
 	var tr []author
 	err := db.Select(&tr, `SELECT id, first_name, middle_name, last_name, nickname
 				 FROM book_translators bt, authors a
@@ -48,37 +52,37 @@ func bookTranslators(id uint32) ([]author, error) {
 	return tr, err
 }
 
-func bookSequences(id uint32) ([]sequence, error) {
+func (db *sqliteStore) bookSequences(id uint32) ([]sequence, error) {
 	var sq []sequence
-	err := db.Select(&sq, `SELECT id, name, number
+	err := db.Select(&sq, `SELECT id, name, kind, parent_id, number, position
 				 FROM book_sequences bs, sequences s
 				WHERE bs.sequence_id = s.id
 				  AND bs.book_id = ?
-			     ORDER BY name, number
+			     ORDER BY kind, name, position
 				`, id)
 	return sq, err
 }
 
-func (b *book) FetchRelations() error {
-	genres, err := bookGenres(b.ID)
+func (db *sqliteStore) fetchRelations(b *book) error {
+	genres, err := db.bookGenres(b.ID)
 	if err != nil {
 		return err
 	}
 	b.Genres = genres
 
-	authors, err := bookAuthors(b.ID)
+	authors, err := db.bookAuthors(b.ID)
 	if err != nil {
 		return err
 	}
 	b.Authors = authors
 
-	translators, err := bookTranslators(b.ID)
+	translators, err := db.bookTranslators(b.ID)
 	if err != nil {
 		return err
 	}
 	b.Translators = translators
 
-	sequences, err := bookSequences(b.ID)
+	sequences, err := db.bookSequences(b.ID)
 	if err != nil {
 		return err
 	}
@@ -87,9 +91,9 @@ func (b *book) FetchRelations() error {
 	return nil
 }
 
-func fetchBooksRelations(books []book) error {
+func (db *sqliteStore) fetchBooksRelations(books []book) error {
 	for i := range books {
-		err := books[i].FetchRelations()
+		err := db.fetchRelations(&books[i])
 		if err != nil {
 			return err
 		}
@@ -98,7 +102,7 @@ func fetchBooksRelations(books []book) error {
 	return nil
 }
 
-func BooksPerPage(n int) ([]book, int, error) {
+func (db *sqliteStore) BooksPerPage(n int) ([]book, int, error) {
 	var count int
 	err := db.Get(&count, "SELECT COUNT(*) FROM books")
 	if err != nil {
@@ -112,7 +116,7 @@ func BooksPerPage(n int) ([]book, int, error) {
 	}
 
 	var books []book
-	err = db.Select(&books, `SELECT id, title, lang, archive, filename, offset, compressed_size, uncompressed_size, crc32
+	err = db.Select(&books, `SELECT id, title, lang, archive, filename, offset, compressed_size, uncompressed_size, crc32, method, kind, lib_id, added, deleted, src_lang, date, keywords, encoding, raw_lang
 				   FROM books
 			       ORDER BY title
 				  LIMIT ?, ?
@@ -121,7 +125,7 @@ func BooksPerPage(n int) ([]book, int, error) {
 		return nil, 0, err
 	}
 
-	err = fetchBooksRelations(books)
+	err = db.fetchBooksRelations(books)
 	if err != nil {
 		return nil, 0, err
 	}
@@ -129,7 +133,7 @@ func BooksPerPage(n int) ([]book, int, error) {
 	return books, numPages, nil
 }
 
-func BooksByGenre(id uint32) ([]book, *genre, error) {
+func (db *sqliteStore) BooksByGenre(id uint32) ([]book, *genre, error) {
 	var g genre
 	err := db.Get(&g, "SELECT id, name, desc FROM genres WHERE id = ?", id)
 	if err != nil {
@@ -137,7 +141,7 @@ func BooksByGenre(id uint32) ([]book, *genre, error) {
 	}
 
 	var books []book
-	err = db.Select(&books, `SELECT id, title, lang, archive, filename, offset, compressed_size, uncompressed_size, crc32
+	err = db.Select(&books, `SELECT id, title, lang, archive, filename, offset, compressed_size, uncompressed_size, crc32, method, kind, lib_id, added, deleted, src_lang, date, keywords, encoding, raw_lang
 				   FROM books b, book_genres bg
 				  WHERE b.id = bg.book_id
 				    AND bg.genre_id = ?
@@ -147,7 +151,7 @@ func BooksByGenre(id uint32) ([]book, *genre, error) {
 		return nil, nil, err
 	}
 
-	err = fetchBooksRelations(books)
+	err = db.fetchBooksRelations(books)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -155,7 +159,7 @@ func BooksByGenre(id uint32) ([]book, *genre, error) {
 	return books, &g, nil
 }
 
-func BooksByAuthor(id uint32) ([]book, []book, *author, error) {
+func (db *sqliteStore) BooksByAuthor(id uint32) ([]book, []book, *author, error) {
 	var a author
 	err := db.Get(&a, `SELECT id, first_name, middle_name, last_name, nickname
 			     FROM authors
@@ -166,7 +170,7 @@ func BooksByAuthor(id uint32) ([]book, []book, *author, error) {
 	}
 
 	var books []book
-	err = db.Select(&books, `SELECT id, title, lang, archive, filename, offset, compressed_size, uncompressed_size, crc32
+	err = db.Select(&books, `SELECT id, title, lang, archive, filename, offset, compressed_size, uncompressed_size, crc32, method, kind, lib_id, added, deleted, src_lang, date, keywords, encoding, raw_lang
 				   FROM books b, book_authors ba
 				  WHERE b.id = ba.book_id
 				    AND ba.author_id = ?
@@ -176,13 +180,13 @@ func BooksByAuthor(id uint32) ([]book, []book, *author, error) {
 		return nil, nil, nil, err
 	}
 
-	err = fetchBooksRelations(books)
+	err = db.fetchBooksRelations(books)
 	if err != nil {
 		return nil, nil, nil, err
 	}
 
 	var translations []book
-	err = db.Select(&translations, `SELECT id, title, lang, archive, filename, offset, compressed_size, uncompressed_size, crc32
+	err = db.Select(&translations, `SELECT id, title, lang, archive, filename, offset, compressed_size, uncompressed_size, crc32, method, kind, lib_id, added, deleted, src_lang, date, keywords, encoding, raw_lang
 					  FROM books b, book_translators bt
 					 WHERE b.id = bt.book_id
 					   AND bt.author_id = ?
@@ -192,7 +196,7 @@ func BooksByAuthor(id uint32) ([]book, []book, *author, error) {
 		return nil, nil, nil, err
 	}
 
-	err = fetchBooksRelations(translations)
+	err = db.fetchBooksRelations(translations)
 	if err != nil {
 		return nil, nil, nil, err
 	}
@@ -204,29 +208,34 @@ type booksBySequence []book
 
 func (b booksBySequence) Len() int { return len(b) }
 func (b booksBySequence) Less(i, j int) bool {
-	return b[i].Sequences[0].Number < b[j].Sequences[0].Number
+	return b[i].Sequences[0].Position < b[j].Sequences[0].Position
 }
 func (b booksBySequence) Swap(i, j int) { b[i], b[j] = b[j], b[i] }
 
-func BooksBySequence(id uint32) ([]book, *sequence, error) {
+func (db *sqliteStore) BooksBySequence(id uint32) ([]book, *sequence, error) {
 	var seq sequence
-	err := db.Get(&seq, "SELECT id, name FROM sequences WHERE id = ?", id)
+	err := db.Get(&seq, "SELECT id, name, kind, parent_id FROM sequences WHERE id = ?", id)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	seq.Children, err = db.sequenceChildren(id)
 	if err != nil {
 		return nil, nil, err
 	}
 
 	var books []book
-	err = db.Select(&books, `SELECT id, title, lang, archive, filename, offset, compressed_size, uncompressed_size, crc32
+	err = db.Select(&books, `SELECT id, title, lang, archive, filename, offset, compressed_size, uncompressed_size, crc32, method, kind, lib_id, added, deleted, src_lang, date, keywords, encoding, raw_lang
 				   FROM books b, book_sequences bs
 				  WHERE b.id = bs.book_id
 				    AND bs.sequence_id = ?
-			       ORDER BY number, title
+			       ORDER BY position, title
 				`, id)
 	if err != nil {
 		return nil, nil, err
 	}
 
-	err = fetchBooksRelations(books)
+	err = db.fetchBooksRelations(books)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -240,14 +249,14 @@ func BooksBySequence(id uint32) ([]book, *sequence, error) {
 			}
 		}
 	}
-	sort.Sort(booksBySequence(books))
+	sort.Stable(booksBySequence(books))
 
 	return books, &seq, nil
 }
 
-func BookByID(id uint32) (*book, error) {
+func (db *sqliteStore) BookByID(id uint32) (*book, error) {
 	var b book
-	err := db.Get(&b, `SELECT id, title, lang, archive, filename, offset, compressed_size, uncompressed_size, crc32
+	err := db.Get(&b, `SELECT id, title, lang, archive, filename, offset, compressed_size, uncompressed_size, crc32, method, kind, lib_id, added, deleted, src_lang, date, keywords, encoding, raw_lang
 			     FROM books
 			    WHERE id = ?
 				`, id)
@@ -256,7 +265,7 @@ func BookByID(id uint32) (*book, error) {
 		return nil, err
 	}
 
-	err = b.FetchRelations()
+	err = db.fetchRelations(&b)
 	if err != nil {
 		return nil, err
 	}
@@ -264,16 +273,131 @@ func BookByID(id uint32) (*book, error) {
 	return &b, nil
 }
 
-func BookByIDWithAnnotation(id uint32) (*book, string, string, error) {
-	b, err := BookByID(id)
+// SetBookEncoding sets the encoding the book is read in; an empty encoding
+// means the one declared in the book. The description of the book is parsed
+// again in that encoding, and its title, authors, series and so on are
+// replaced, along with their trigrams, unless the book is described in the
+// INPX catalog. With -fulltext, its text is replaced too.
+func (db *sqliteStore) SetBookEncoding(id uint32, enc string) error {
+	b, err := db.BookByID(id)
+	if err != nil {
+		return err
+	}
+
+	desc := !inCatalog(b)
+	nb, err := rereadBook(*b, enc, desc)
 	if err != nil {
-		return nil, "", "", err
+		return err
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		return err
+	}
+
+	var ta trigramAdditions
+	err = db.replaceBook(tx, nb, desc, &ta)
+	if err != nil {
+		tx.Rollback()
+		return err
 	}
 
-	ann, cover, err := b.AnnotationAndCover()
+	removedAuthors, removedSequences, err := removeOrphans(tx)
 	if err != nil {
-		return nil, "", "", err
+		tx.Rollback()
+		return err
+	}
+
+	err = commit(tx)
+	if err != nil {
+		return err
+	}
+
+	var removedBooks []uint32
+	if desc {
+		removedBooks = []uint32{nb.ID}
+	}
+	db.removeTrigrams(removedBooks, removedAuthors, removedSequences)
+	db.addTrigrams(&ta)
+
+	return nil
+}
+
+// replaceBook updates the encoding of the book, and its text if it is given.
+// If desc is true, the description of the book is replaced too, and the
+// trigrams of the new one are added to ta.
+func (db *sqliteStore) replaceBook(tx *sqlx.Tx, b book, desc bool, ta *trigramAdditions) error {
+	_, err := tx.Exec("UPDATE books SET encoding = ? WHERE id = ?", b.Encoding, b.ID)
+	if err != nil {
+		return err
+	}
+
+	if b.Text != nil {
+		err = removeBookText(tx, b.ID)
+		if err != nil {
+			return err
+		}
+	}
+
+	if !desc {
+		return insertBookText(tx, b.ID, b.Text)
+	}
+
+	_, err = tx.Exec(`UPDATE books
+			     SET title = ?, lang = ?, raw_lang = ?, src_lang = ?, date = ?, keywords = ?
+			   WHERE id = ?`,
+		b.Title, b.Lang, b.RawLang, b.SrcLang, b.Date, b.Keywords, b.ID)
+	if err != nil {
+		return err
+	}
+
+	err = removeBookDesc(tx, b.ID)
+	if err != nil {
+		return err
+	}
+
+	return db.indexBookDesc(tx, b.ID, b, ta)
+}
+
+func (db *sqliteStore) bookPublishInfo(id uint32) (publishInfo, error) {
+	var pi publishInfo
+	err := db.Get(&pi, `SELECT publisher, city, year, isbn
+			      FROM publish_info
+			     WHERE book_id = ?
+				`, id)
+	if err == ErrNoRows {
+		err = nil
+	}
+	return pi, err
+}
+
+func (db *sqliteStore) bookDocumentInfo(id uint32) (documentInfo, error) {
+	var di documentInfo
+	err := db.Get(&di, `SELECT doc_id, version, program_used, date
+			      FROM document_info
+			     WHERE book_id = ?
+				`, id)
+	if err == ErrNoRows {
+		err = nil
+	}
+	return di, err
+}
+
+func (db *sqliteStore) BookDetailsByID(id uint32) (*book, error) {
+	b, err := db.BookByID(id)
+	if err != nil {
+		return nil, err
+	}
+
+	b.PublishInfo, err = db.bookPublishInfo(id)
+	if err != nil {
+		return nil, err
+	}
+
+	b.DocumentInfo, err = db.bookDocumentInfo(id)
+	if err != nil {
+		return nil, err
 	}
 
-	return b, ann, cover, nil
+	return b, nil
 }
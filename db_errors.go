@@ -0,0 +1,187 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"archive/zip"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// Indexing stages at which errors are reported.
+const (
+	stageOpen        = "open"
+	stageXML         = "xml"
+	stageNoTitle     = "no-title"
+	stageCompression = "compression"
+	stageMissing     = "missing"
+	stageText        = "text"
+	stageInsert      = "insert"
+)
+
+type indexError struct {
+	ID       uint32
+	Archive  string
+	Filename string
+	Stage    string
+	Error    string
+	Time     int64
+}
+
+type indexErrorGroup struct {
+	Stage   string
+	Archive string
+	Count   int
+}
+
+var (
+	pendingErrorsMu sync.Mutex
+	pendingErrors   []indexError
+)
+
+// descStage returns the stage for an error returned by ParseDesc.
+func descStage(err error) string {
+	if err == ErrNoTitle {
+		return stageNoTitle
+	}
+	return stageXML
+}
+
+// reportIndexError logs the error and queues it to be recorded by the
+// insert worker.
+func reportIndexError(archive, filename, stage string, err error) {
+	name := archive
+	if filename != "" && !isFB2(archive) {
+		name += "/" + filename
+	}
+	log.Printf("%s: %s: %v", name, stage, err)
+
+	pendingErrorsMu.Lock()
+	pendingErrors = append(pendingErrors, indexError{
+		Archive:  archive,
+		Filename: filename,
+		Stage:    stage,
+		Error:    err.Error(),
+		Time:     time.Now().Unix(),
+	})
+	pendingErrorsMu.Unlock()
+}
+
+func havePendingErrors() bool {
+	pendingErrorsMu.Lock()
+	defer pendingErrorsMu.Unlock()
+	return len(pendingErrors) > 0
+}
+
+// takePendingErrors returns the queued errors and empties the queue.
+func takePendingErrors() []indexError {
+	pendingErrorsMu.Lock()
+	defer pendingErrorsMu.Unlock()
+	errs := pendingErrors
+	pendingErrors = nil
+	return errs
+}
+
+// recordIndexErrors writes the queued errors to the database.
+func recordIndexErrors(tx *sqlx.Tx) error {
+	for _, e := range takePendingErrors() {
+		_, err := tx.Exec("INSERT INTO index_errors (archive, filename, stage, error, time) VALUES (?, ?, ?, ?, ?)",
+			e.Archive, e.Filename, e.Stage, e.Error, e.Time)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func clearIndexErrors(tx *sqlx.Tx, archive string) error {
+	_, err := tx.Exec("DELETE FROM index_errors WHERE archive = ?", archive)
+	return err
+}
+
+func (db *sqliteStore) IndexErrorGroups() ([]indexErrorGroup, error) {
+	var groups []indexErrorGroup
+	err := db.Select(&groups, `SELECT stage, archive, COUNT(*) AS count
+				     FROM index_errors
+				 GROUP BY stage, archive
+				 ORDER BY stage, archive
+				`)
+	return groups, err
+}
+
+func (db *sqliteStore) IndexErrors(stage, archive string) ([]indexError, error) {
+	var errs []indexError
+	err := db.Select(&errs, `SELECT id, archive, filename, stage, error, time
+				   FROM index_errors
+				  WHERE stage = ?
+				    AND archive = ?
+			       ORDER BY filename, id
+				`, stage, archive)
+	return errs, err
+}
+
+func (db *sqliteStore) IndexErrorByID(id uint32) (*indexError, error) {
+	var e indexError
+	err := db.Get(&e, `SELECT id, archive, filename, stage, error, time
+			     FROM index_errors
+			    WHERE id = ?
+				`, id)
+	if err != nil {
+		return nil, err
+	}
+
+	return &e, nil
+}
+
+// Open returns a reader of the file which has failed to be indexed. Entries
+// compressed with unsupported methods are returned as they are stored.
+func (e *indexError) Open() (io.ReadCloser, error) {
+	if isFB2(e.Archive) {
+		return os.Open(e.Archive)
+	}
+
+	r, err := zip.OpenReader(e.Archive)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, f := range r.File {
+		if f.Name != e.Filename {
+			continue
+		}
+
+		var rd io.Reader
+		if supportedMethod(f.Method) {
+			rd, err = f.Open()
+		} else {
+			rd, err = f.OpenRaw()
+		}
+		if err != nil {
+			r.Close()
+			return nil, err
+		}
+
+		return readCloser{rd, r}, nil
+	}
+
+	r.Close()
+
+	return nil, os.ErrNotExist
+}
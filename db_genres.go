@@ -13,7 +13,9 @@
 
 package main
 
-func updateGenreWithBookCount(g *genre) error {
+import "log"
+
+func (db *sqliteStore) updateGenreWithBookCount(g *genre) error {
 	var count int
 	err := db.Get(&count, `SELECT COUNT(book_id)
 				 FROM book_genres
@@ -28,9 +30,9 @@ func updateGenreWithBookCount(g *genre) error {
 	return nil
 }
 
-func updateGenresWithBookCounts(genres []genre) error {
+func (db *sqliteStore) updateGenresWithBookCounts(genres []genre) error {
 	for i := range genres {
-		err := updateGenreWithBookCount(&genres[i])
+		err := db.updateGenreWithBookCount(&genres[i])
 		if err != nil {
 			return err
 		}
@@ -39,7 +41,7 @@ func updateGenresWithBookCounts(genres []genre) error {
 	return nil
 }
 
-func Genres() ([]genre, error) {
+func (db *sqliteStore) Genres() ([]genre, error) {
 	var genres []genre
 	err := db.Select(&genres, `SELECT id, name, desc, meta
 				    FROM genres
@@ -48,10 +50,79 @@ func Genres() ([]genre, error) {
 		return nil, err
 	}
 
-	err = updateGenresWithBookCounts(genres)
+	err = db.updateGenresWithBookCounts(genres)
 	if err != nil {
 		return nil, err
 	}
 
 	return genres, nil
 }
+
+// syncGenres updates the genres from the genre list and moves the books from
+// the genres which have become aliases to their canonical genres.
+func (db *sqliteStore) syncGenres() error {
+	tx, err := db.Beginx()
+	if err != nil {
+		return err
+	}
+
+	// The genres are only written if they have changed, so that the
+	// change counter of the database, by which the saved trigram indexes
+	// are checked, stays the same. (INSERT OR IGNORE writes anyway.)
+	for name, g := range genres.Genres {
+		_, err := tx.Exec("INSERT INTO genres (name, desc, meta) SELECT ?1, '', '' WHERE NOT EXISTS (SELECT 1 FROM genres WHERE name = ?1)", name)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+
+		_, err = tx.Exec("UPDATE genres SET desc = ?1, meta = ?2 WHERE name = ?3 AND (desc IS NOT ?1 OR meta IS NOT ?2)",
+			localized(g.Desc), localized(genres.Meta[g.Meta]), name)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	for alias, name := range genres.Aliases {
+		var id uint32
+		err := tx.Get(&id, "SELECT id FROM genres WHERE name = ?", alias)
+		if err == ErrNoRows {
+			continue
+		}
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+
+		if name != "" {
+			_, err = tx.Exec(`UPDATE OR IGNORE book_genres
+					     SET genre_id = (SELECT id FROM genres WHERE name = ?)
+					   WHERE genre_id = ?
+					`, name, id)
+			if err != nil {
+				tx.Rollback()
+				return err
+			}
+		}
+
+		for _, q := range []string{
+			"DELETE FROM book_genres WHERE genre_id = ?",
+			"DELETE FROM genres WHERE id = ?",
+		} {
+			_, err := tx.Exec(q, id)
+			if err != nil {
+				tx.Rollback()
+				return err
+			}
+		}
+
+		if name == "" {
+			log.Printf("Genre %s removed", alias)
+		} else {
+			log.Printf("Genre %s merged into %s", alias, name)
+		}
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,61 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+type language struct {
+	Code      string
+	BookCount int
+}
+
+func (db *sqliteStore) Languages() ([]language, error) {
+	var languages []language
+	err := db.Select(&languages, `SELECT lang AS code, COUNT(*) AS bookcount
+					FROM books
+				       WHERE lang != ''
+				    GROUP BY lang
+				    ORDER BY bookcount DESC, lang`)
+	return languages, err
+}
+
+func (db *sqliteStore) BooksByLanguage(code string, n int) ([]book, int, error) {
+	var count int
+	err := db.Get(&count, "SELECT COUNT(*) FROM books WHERE lang = ?", code)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	numPages := (count + *booksPerPage - 1) / *booksPerPage
+	offset := (n - 1) * *booksPerPage
+	if offset >= count {
+		return nil, numPages, nil
+	}
+
+	var books []book
+	err = db.Select(&books, `SELECT id, title, lang, archive, filename, offset, compressed_size, uncompressed_size, crc32, method, kind, lib_id, added, deleted, src_lang, date, keywords, encoding, raw_lang
+				   FROM books
+				  WHERE lang = ?
+			       ORDER BY title
+				  LIMIT ?, ?
+				`, code, offset, *booksPerPage)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	err = db.fetchBooksRelations(books)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return books, numPages, nil
+}
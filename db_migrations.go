@@ -0,0 +1,465 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"archive/zip"
+	"database/sql"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+)
+
+type migration struct {
+	desc string
+	up   func(tx *sqlx.Tx) error
+}
+
+// migrations are the schema changes in the order they are applied. The
+// schema version of a database is the number of migrations applied to it.
+// Never change or reorder the existing migrations, append new ones.
+//
+// The databases made before the schema was versioned are at version 0, with
+// whatever tables they had, so the migrations up to "raw languages" check
+// what is already there.
+var migrations = []migration{
+	{"initial schema", execMigration(`
+			CREATE TABLE IF NOT EXISTS books (
+				id              INTEGER PRIMARY KEY AUTOINCREMENT,
+				title           TEXT,
+				lang            TEXT,
+				archive         TEXT,
+				filename        TEXT,
+				offset          INTEGER,
+				compressed_size INTEGER,
+				uncompressed_size INTEGER,
+				crc32           INTEGER,
+				UNIQUE (archive, filename)
+			);
+			CREATE TABLE IF NOT EXISTS genres (
+				id              INTEGER PRIMARY KEY AUTOINCREMENT,
+				name            TEXT,
+				desc            TEXT,
+				meta            TEXT,
+				UNIQUE (name)
+			);
+			CREATE TABLE IF NOT EXISTS authors (
+				id              INTEGER PRIMARY KEY AUTOINCREMENT,
+				first_name      TEXT,
+				middle_name     TEXT,
+				last_name       TEXT,
+				nickname        TEXT,
+				UNIQUE (first_name, middle_name, last_name, nickname)
+			);
+			CREATE TABLE IF NOT EXISTS sequences (
+				id              INTEGER PRIMARY KEY AUTOINCREMENT,
+				name            TEXT,
+				UNIQUE (name)
+			);
+			CREATE TABLE IF NOT EXISTS book_genres (
+				book_id         INTEGER,
+				genre_id        INTEGER,
+				PRIMARY KEY (book_id, genre_id)
+			);
+			CREATE TABLE IF NOT EXISTS book_authors (
+				book_id         INTEGER,
+				author_id       INTEGER,
+				PRIMARY KEY (book_id, author_id)
+			);
+			CREATE TABLE IF NOT EXISTS book_translators (
+				book_id         INTEGER,
+				author_id       INTEGER,
+				PRIMARY KEY (book_id, author_id)
+			);
+			CREATE TABLE IF NOT EXISTS book_sequences (
+				book_id         INTEGER,
+				sequence_id     INTEGER,
+				number          INTEGER,
+				PRIMARY KEY (book_id, sequence_id)
+			);
+
+			CREATE INDEX IF NOT EXISTS books_title_idx ON books (title);
+			CREATE INDEX IF NOT EXISTS book_genres_idx ON book_genres (genre_id);
+			CREATE INDEX IF NOT EXISTS book_authors_idx ON book_authors (author_id);
+			CREATE INDEX IF NOT EXISTS book_translators_idx ON book_translators (author_id);
+			CREATE INDEX IF NOT EXISTS book_sequences_idx ON book_sequences (sequence_id);
+			CREATE INDEX IF NOT EXISTS authors_idx ON authors (last_name, first_name, nickname);
+	`)},
+	{"archives and compression methods", migrateArchives},
+	{"INPX and FB2 metadata", migrateMetadata},
+	{"annotations and texts", migrateAnnotations},
+	{"index errors", execMigration(`
+			CREATE TABLE IF NOT EXISTS index_errors (
+				id              INTEGER PRIMARY KEY AUTOINCREMENT,
+				archive         TEXT,
+				filename        TEXT,
+				stage           TEXT,
+				error           TEXT,
+				time            INTEGER
+			);
+			CREATE INDEX IF NOT EXISTS index_errors_idx ON index_errors (archive);
+	`)},
+	{"book encodings", func(tx *sqlx.Tx) error {
+		return addColumn(tx, "books", "encoding", "TEXT DEFAULT ''")
+	}},
+	{"author aliases", migrateAuthorAliases},
+	{"sequence kinds", migrateSequenceKinds},
+	{"raw languages", migrateRawLanguages},
+	{"change counter", migrateChangeCounter},
+}
+
+func execMigration(query string) func(tx *sqlx.Tx) error {
+	return func(tx *sqlx.Tx) error {
+		_, err := tx.Exec(query)
+		return err
+	}
+}
+
+// hasColumn reports whether the table has the column.
+func hasColumn(tx *sqlx.Tx, table, column string) (bool, error) {
+	var n int
+	err := tx.Get(&n, "SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = ?", table, column)
+	return n > 0, err
+}
+
+// addColumn adds the column to the table unless it is already there.
+func addColumn(tx *sqlx.Tx, table, column, def string) error {
+	ok, err := hasColumn(tx, table, column)
+	if err != nil || ok {
+		return err
+	}
+
+	_, err = tx.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, def))
+	return err
+}
+
+// migrateArchives adds the archives indexed, and the compression methods and
+// kinds of the books. The books indexed before were all deflated ZIP entries.
+func migrateArchives(tx *sqlx.Tx) error {
+	err := addColumn(tx, "books", "method", "INTEGER")
+	if err != nil {
+		return err
+	}
+	err = addColumn(tx, "books", "kind", "INTEGER")
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("UPDATE books SET method = ? WHERE method IS NULL", zip.Deflate)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("UPDATE books SET kind = ? WHERE kind IS NULL", kindZIP)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`CREATE TABLE IF NOT EXISTS archives (
+				name            TEXT PRIMARY KEY,
+				size            INTEGER,
+				mtime           INTEGER
+			)`)
+	return err
+}
+
+func migrateMetadata(tx *sqlx.Tx) error {
+	for _, c := range []struct{ name, def string }{
+		{"lib_id", "TEXT DEFAULT ''"},
+		{"added", "TEXT DEFAULT ''"},
+		{"deleted", "INTEGER DEFAULT 0"},
+		{"src_lang", "TEXT DEFAULT ''"},
+		{"date", "TEXT DEFAULT ''"},
+		{"keywords", "TEXT DEFAULT ''"},
+	} {
+		err := addColumn(tx, "books", c.name, c.def)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err := tx.Exec(`CREATE TABLE IF NOT EXISTS publish_info (
+				book_id         INTEGER PRIMARY KEY,
+				publisher       TEXT,
+				city            TEXT,
+				year            TEXT,
+				isbn            TEXT
+			);
+			CREATE TABLE IF NOT EXISTS document_info (
+				book_id         INTEGER PRIMARY KEY,
+				doc_id          TEXT,
+				version         TEXT,
+				program_used    TEXT,
+				date            TEXT
+			)`)
+	return err
+}
+
+// migrateAnnotations adds the annotations and the texts of the books. They
+// are kept in FTS5 tables if SQLite is built with FTS5 (-tags sqlite_fts5),
+// and in plain tables otherwise, which are searched by substring.
+func migrateAnnotations(tx *sqlx.Tx) error {
+	var fts bool
+	err := tx.Get(&fts, "SELECT sqlite_compileoption_used('ENABLE_FTS5')")
+	if err != nil {
+		return err
+	}
+
+	if !fts {
+		_, err = tx.Exec(`CREATE TABLE IF NOT EXISTS book_annotations (
+				annotation      TEXT
+			);
+			CREATE TABLE IF NOT EXISTS book_texts (
+				section         INTEGER,
+				text            TEXT
+			)`)
+		return err
+	}
+
+	_, err = tx.Exec(`CREATE VIRTUAL TABLE IF NOT EXISTS book_annotations USING fts5 (
+				annotation,
+				tokenize = 'unicode61 remove_diacritics 2'
+			);
+			CREATE VIRTUAL TABLE IF NOT EXISTS book_texts USING fts5 (
+				section UNINDEXED,
+				text,
+				tokenize = 'unicode61 remove_diacritics 2'
+			)`)
+	return err
+}
+
+// hasFTS reports whether the annotations and the texts are in FTS5 tables.
+func hasFTS(db *sqlx.DB) (bool, error) {
+	var n int
+	err := db.Get(&n, `SELECT COUNT(*) FROM sqlite_master
+			    WHERE name = 'book_annotations' AND sql LIKE '%USING fts5%'`)
+	return n > 0, err
+}
+
+// migrateAuthorAliases adds the normalized names by which the authors are
+// matched, and the aliases left by merging authors.
+func migrateAuthorAliases(tx *sqlx.Tx) error {
+	err := addColumn(tx, "authors", "norm", "TEXT DEFAULT ''")
+	if err != nil {
+		return err
+	}
+
+	var authors []author
+	err = tx.Select(&authors, "SELECT id, first_name, middle_name, last_name, nickname FROM authors WHERE norm = ''")
+	if err != nil {
+		return err
+	}
+	for _, a := range authors {
+		_, err = tx.Exec("UPDATE authors SET norm = ? WHERE id = ?", authorKey(a), a.ID)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.Exec(`CREATE TABLE IF NOT EXISTS author_aliases (
+				norm            TEXT PRIMARY KEY,
+				first_name      TEXT,
+				middle_name     TEXT,
+				last_name       TEXT,
+				nickname        TEXT,
+				author_id       INTEGER
+			);
+			CREATE INDEX IF NOT EXISTS authors_norm_idx ON authors (norm);
+			CREATE INDEX IF NOT EXISTS author_aliases_idx ON author_aliases (author_id)`)
+	return err
+}
+
+// migrateSequenceKinds rebuilds the sequences, which are now unique by name
+// and kind, and the book sequences, whose numbers are now text ordered by
+// position. The publisher series kept in publish_info by older versions are
+// moved to the sequences.
+func migrateSequenceKinds(tx *sqlx.Tx) error {
+	ok, err := hasColumn(tx, "sequences", "kind")
+	if err != nil {
+		return err
+	}
+	if !ok {
+		_, err = tx.Exec(`CREATE TABLE sequences_new (
+				id              INTEGER PRIMARY KEY AUTOINCREMENT,
+				name            TEXT,
+				kind            INTEGER DEFAULT 0,
+				parent_id       INTEGER DEFAULT 0,
+				UNIQUE (name, kind)
+			);
+			INSERT INTO sequences_new (id, name) SELECT id, name FROM sequences;
+			DROP TABLE sequences;
+			ALTER TABLE sequences_new RENAME TO sequences`)
+		if err != nil {
+			return err
+		}
+	}
+
+	ok, err = hasColumn(tx, "book_sequences", "position")
+	if err != nil {
+		return err
+	}
+	if !ok {
+		_, err = tx.Exec(`CREATE TABLE book_sequences_new (
+				book_id         INTEGER,
+				sequence_id     INTEGER,
+				number          TEXT DEFAULT '',
+				position        REAL DEFAULT 0,
+				PRIMARY KEY (book_id, sequence_id)
+			);
+			INSERT INTO book_sequences_new (book_id, sequence_id, number, position)
+				SELECT book_id, sequence_id,
+				       CASE WHEN number > 0 THEN CAST(number AS TEXT) ELSE '' END,
+				       CASE WHEN number > 0 THEN number ELSE 0 END
+				FROM book_sequences;
+			DROP TABLE book_sequences;
+			ALTER TABLE book_sequences_new RENAME TO book_sequences`)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.Exec(`CREATE INDEX IF NOT EXISTS book_sequences_idx ON book_sequences (sequence_id);
+			CREATE INDEX IF NOT EXISTS sequences_parent_idx ON sequences (parent_id)`)
+	if err != nil {
+		return err
+	}
+
+	ok, err = hasColumn(tx, "publish_info", "sequence")
+	if err != nil || !ok {
+		return err
+	}
+
+	var rows []struct {
+		BookID uint32 `db:"book_id"`
+		Name   string `db:"sequence"`
+		Number string `db:"sequence_number"`
+	}
+	err = tx.Select(&rows, `SELECT book_id, sequence, COALESCE(sequence_number, '') AS sequence_number
+				FROM publish_info
+				WHERE sequence <> ''`)
+	if err != nil {
+		return err
+	}
+	for _, r := range rows {
+		_, err = tx.Exec("INSERT OR IGNORE INTO sequences (name, kind) VALUES (?, ?)", r.Name, seqPublisher)
+		if err != nil {
+			return err
+		}
+		var id uint32
+		err = tx.Get(&id, "SELECT id FROM sequences WHERE name = ? AND kind = ?", r.Name, seqPublisher)
+		if err != nil {
+			return err
+		}
+		number := strings.TrimSpace(r.Number)
+		_, err = tx.Exec("INSERT OR IGNORE INTO book_sequences (book_id, sequence_id, number, position) VALUES (?, ?, ?, ?)",
+			r.BookID, id, number, sequencePosition(number))
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.Exec("UPDATE publish_info SET sequence = '', sequence_number = ''")
+	return err
+}
+
+// migrateRawLanguages keeps the languages as they were given in the books.
+// The older versions only stored the valid ISO 639-1 codes, so they are
+// already normalized.
+func migrateRawLanguages(tx *sqlx.Tx) error {
+	err := addColumn(tx, "books", "raw_lang", "TEXT DEFAULT ''")
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("UPDATE books SET raw_lang = lang WHERE raw_lang = '' AND lang IS NOT NULL")
+	return err
+}
+
+// changeCounterTables are the tables the trigram indexes are made from. The
+// links between the books and their authors and sequences only change along
+// with the books or the authors.
+var changeCounterTables = []string{"books", "authors", "author_aliases", "sequences"}
+
+// migrateChangeCounter adds the counter of the changes to the tables the
+// trigram indexes are made from, which the saved indexes are checked
+// against. Unlike the change counter in the file header, it is kept up to
+// date in WAL mode too.
+func migrateChangeCounter(tx *sqlx.Tx) error {
+	_, err := tx.Exec(`CREATE TABLE IF NOT EXISTS change_counter (counter INTEGER NOT NULL);
+			INSERT INTO change_counter (counter) SELECT 0 WHERE NOT EXISTS (SELECT 1 FROM change_counter)`)
+	if err != nil {
+		return err
+	}
+
+	for _, table := range changeCounterTables {
+		for _, op := range []string{"INSERT", "UPDATE", "DELETE"} {
+			_, err := tx.Exec(fmt.Sprintf(`CREATE TRIGGER IF NOT EXISTS %[1]s_%[3]s_changes AFTER %[2]s ON %[1]s
+				BEGIN UPDATE change_counter SET counter = counter + 1; END`, table, op, strings.ToLower(op)))
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// migrate brings the database schema up to date. The pending migrations are
+// applied in a single transaction, so a failed migration leaves the database
+// as it was.
+func migrate(db *sqlx.DB) error {
+	_, err := db.Exec("CREATE TABLE IF NOT EXISTS schema_version (version INTEGER NOT NULL)")
+	if err != nil {
+		return err
+	}
+
+	var version int
+	err = db.Get(&version, "SELECT version FROM schema_version")
+	if err == sql.ErrNoRows {
+		_, err = db.Exec("INSERT INTO schema_version (version) VALUES (0)")
+	}
+	if err != nil {
+		return fmt.Errorf("schema version: %v", err)
+	}
+
+	if version > len(migrations) {
+		return fmt.Errorf("the database schema version %d is newer than this fb2index supports (%d); upgrade fb2index", version, len(migrations))
+	}
+	if version == len(migrations) {
+		return nil
+	}
+
+	log.Printf("Migrating the database schema from version %d to %d", version, len(migrations))
+
+	tx, err := db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for i := version; i < len(migrations); i++ {
+		err = migrations[i].up(tx)
+		if err != nil {
+			return fmt.Errorf("migration %d (%s) failed, the database is left at version %d: %v", i+1, migrations[i].desc, version, err)
+		}
+	}
+
+	_, err = tx.Exec("UPDATE schema_version SET version = ?", len(migrations))
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,267 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// openAtVersion returns a new database migrated to the given schema version,
+// and its path.
+func openAtVersion(t *testing.T, version int) (*sqlx.DB, string) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db, err := sqlx.Connect("sqlite3_fb2index", sqliteDSN(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	for _, m := range migrations[:version] {
+		if err := m.up(tx); err != nil {
+			t.Fatalf("%s: %v", m.desc, err)
+		}
+	}
+	_, err = tx.Exec("CREATE TABLE schema_version (version INTEGER NOT NULL); INSERT INTO schema_version (version) VALUES (?)", version)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	return db, path
+}
+
+func schemaVersion(t *testing.T, db *sqlx.DB) int {
+	var version int
+	if err := db.Get(&version, "SELECT version FROM schema_version"); err != nil {
+		t.Fatal(err)
+	}
+	return version
+}
+
+// checkSchema checks that the database has the latest schema.
+func checkSchema(t *testing.T, db *sqlx.DB) {
+	if version := schemaVersion(t, db); version != len(migrations) {
+		t.Errorf("want the schema version %d, got %d", len(migrations), version)
+	}
+
+	for _, query := range []string{
+		"SELECT id, title, lang, raw_lang, archive, filename, encoding FROM books",
+		"SELECT name, size, mtime FROM archives",
+		"SELECT * FROM publish_info",
+		"SELECT * FROM document_info",
+		"SELECT id, kind, parent_id FROM sequences",
+		"SELECT id, archive, filename, stage, error, time FROM index_errors",
+		"SELECT * FROM author_aliases",
+		"SELECT * FROM book_annotations",
+		"SELECT * FROM book_texts",
+		"SELECT counter FROM change_counter",
+	} {
+		rows, err := db.Query(query)
+		if err != nil {
+			t.Errorf("%s: %v", query, err)
+			continue
+		}
+		rows.Close()
+	}
+}
+
+func TestMigrateFresh(t *testing.T) {
+	db, err := openSQLite("file:TestMigrateFresh?mode=memory&cache=shared")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	checkSchema(t, db)
+
+	// Migrating an up to date database does nothing.
+	if err := migrate(db); err != nil {
+		t.Fatal(err)
+	}
+	checkSchema(t, db)
+}
+
+func TestMigrateFromVersion(t *testing.T) {
+	for version := 0; version < len(migrations); version++ {
+		t.Run(fmt.Sprint(version), func(t *testing.T) {
+			db, path := openAtVersion(t, version)
+			db.Close()
+
+			if version > 0 {
+				db, err := sqlx.Connect("sqlite3_fb2index", sqliteDSN(path))
+				if err != nil {
+					t.Fatal(err)
+				}
+				_, err = db.Exec("INSERT INTO books (title, lang, archive, filename) VALUES ('Книга', 'ru', 'lib/1.zip', '1.fb2')")
+				db.Close()
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			db, err := openSQLite(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+
+			checkSchema(t, db)
+
+			if version > 0 {
+				var b struct {
+					Title string
+					Lang  string
+				}
+				err = db.Get(&b, "SELECT title, lang FROM books WHERE archive = 'lib/1.zip'")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if b.Title != "Книга" || b.Lang != "ru" {
+					t.Errorf("want the book kept, got %+v", b)
+				}
+			}
+		})
+	}
+}
+
+func TestChangeCounter(t *testing.T) {
+	db, err := openSQLite("file:TestChangeCounter?mode=memory&cache=shared")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	counter := func() int64 {
+		var counter int64
+		if err := db.Get(&counter, "SELECT counter FROM change_counter"); err != nil {
+			t.Fatal(err)
+		}
+		return counter
+	}
+
+	prev := counter()
+	for _, query := range []string{
+		"INSERT INTO books (title) VALUES ('Книга')",
+		"UPDATE books SET title = 'Другая книга'",
+		"INSERT INTO authors (last_name) VALUES ('Толстой')",
+		"INSERT INTO author_aliases (author_id, last_name) VALUES (1, 'Толстого')",
+		"INSERT INTO sequences (name) VALUES ('Серия')",
+		"DELETE FROM sequences",
+		"DELETE FROM books",
+	} {
+		if _, err := db.Exec(query); err != nil {
+			t.Fatalf("%s: %v", query, err)
+		}
+		if c := counter(); c <= prev {
+			t.Errorf("%s: the change counter is not incremented", query)
+		} else {
+			prev = c
+		}
+	}
+
+	if _, err := db.Exec("INSERT INTO index_errors (archive) VALUES ('lib/1.zip')"); err != nil {
+		t.Fatal(err)
+	}
+	if c := counter(); c != prev {
+		t.Errorf("the change counter is incremented by an index error")
+	}
+}
+
+func TestMigrateUnversioned(t *testing.T) {
+	// A database made before the schema was versioned.
+	db, path := openAtVersion(t, 1)
+	_, err := db.Exec(`DROP TABLE schema_version;
+		INSERT INTO books (title, lang, archive, filename) VALUES ('Книга', 'ru', 'lib/1.zip', '1.fb2')`)
+	db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = openSQLite(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	checkSchema(t, db)
+
+	var count int
+	if err := db.Get(&count, "SELECT COUNT(*) FROM books WHERE raw_lang = 'ru'"); err != nil || count != 1 {
+		t.Errorf("want the book kept, got %d, %v", count, err)
+	}
+}
+
+func TestMigrateTooNew(t *testing.T) {
+	db, path := openAtVersion(t, len(migrations))
+	_, err := db.Exec("UPDATE schema_version SET version = ?", len(migrations)+1)
+	db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = openSQLite(path)
+	if err == nil || !strings.Contains(err.Error(), "newer") {
+		t.Fatalf("want the newer schema refused, got %v", err)
+	}
+
+	db, err = sqlx.Connect("sqlite3_fb2index", sqliteDSN(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if version := schemaVersion(t, db); version != len(migrations)+1 {
+		t.Errorf("want the schema version left at %d, got %d", len(migrations)+1, version)
+	}
+}
+
+func TestMigrateOnly(t *testing.T) {
+	if path := os.Getenv("FB2INDEX_TEST_DB"); path != "" {
+		os.Args = []string{"fb2index", "-migrate-only", "-db", path}
+		main()
+		return
+	}
+
+	db, path := openAtVersion(t, 1)
+	db.Close()
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestMigrateOnly$")
+	cmd.Env = append(os.Environ(), "FB2INDEX_TEST_DB="+path)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("%v\n%s", err, out)
+	}
+	if want := fmt.Sprintf("The database schema is at version %d", len(migrations)); !strings.Contains(string(out), want) {
+		t.Errorf("want %q in the output, got\n%s", want, out)
+	}
+
+	db, err = sqlx.Connect("sqlite3_fb2index", sqliteDSN(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	checkSchema(t, db)
+}
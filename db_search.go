@@ -13,56 +13,567 @@
 
 package main
 
-import "github.com/opennota/fb2index/trigram"
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"html/template"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
 
-var (
-	trgmAuthorIndex   = trigram.NewIndex()
-	trgmSequenceIndex = trigram.NewIndex()
-	trgmBookIndex     = trigram.NewIndex()
+	"github.com/opennota/fb2index/trigram"
 )
 
-func Search(query string) (authors []author, sequences []sequence, books []book, err error) {
-	trgm := trigram.Extract(query)
-	authorIDs := trgmAuthorIndex.QueryTrigrams(trgm)
-	sequenceIDs := trgmSequenceIndex.QueryTrigrams(trgm)
-	bookIDs := trgmBookIndex.QueryTrigrams(trgm)
+const (
+	maxAnnotationMatches = 50
+	maxTextMatches       = 50
+	// maxFilterMatches is the number of books found by a query with only
+	// the lang: and genre: filters.
+	maxFilterMatches = 500
+	// fewResults is the number of results below which the trigram queries
+	// are relaxed (see trigram.Index.QueryRelaxed).
+	fewResults = 5
+	// suggestCandidates is the number of the names and the titles closest
+	// to a word among which a correction is looked for.
+	suggestCandidates = 20
+)
+
+// annotationMatch is a book whose annotation matches the search query.
+type annotationMatch struct {
+	book
+	Snippet template.HTML
+}
+
+// ftsStem returns the word as it is looked for: longer words lose their
+// endings and are matched by prefix, which is a poor man's stemming good
+// enough to catch other word forms.
+func ftsStem(w string) (stem string, prefix bool) {
+	n := utf8.RuneCountInString(w)
+	if n < 4 {
+		return w, false
+	}
+	rr := []rune(w)
+	switch {
+	case n >= 6:
+		rr = rr[:n-2]
+	case n == 5:
+		rr = rr[:n-1]
+	}
+	return string(rr), true
+}
+
+// ftsWords returns the words of the query.
+func ftsWords(query string) []string {
+	return strings.FieldsFunc(query, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// ftsStems returns the stems of the words in the query (see ftsStem).
+func ftsStems(query string) []string {
+	words := ftsWords(query)
+	for i, w := range words {
+		words[i], _ = ftsStem(w)
+	}
+	return words
+}
+
+// ftsQuery makes an FTS5 query which matches the words in the query, joined
+// with the operator op.
+func ftsQuery(query, op string) string {
+	words := ftsWords(query)
+	for i, w := range words {
+		stem, prefix := ftsStem(w)
+		words[i] = `"` + stem + `"`
+		if prefix {
+			words[i] += "*"
+		}
+	}
+	return strings.Join(words, op)
+}
+
+// likeCondition makes the condition which stands in for the FTS5 query when
+// FTS5 is not available: the stems are looked for anywhere in the column,
+// and the conditions for each are joined with the operator op.
+func likeCondition(column string, stems []string, op string) (string, []interface{}) {
+	conds := make([]string, len(stems))
+	args := make([]interface{}, len(stems))
+	for i, s := range stems {
+		conds[i] = column + ` LIKE ? ESCAPE '\'`
+		args[i] = "%" + likeEscaper.Replace(s) + "%"
+	}
+	return "(" + strings.Join(conds, op) + ")", args
+}
+
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
+var snippetReplacer = strings.NewReplacer("\x01", "<mark>", "\x02", "</mark>")
+
+// ftsSnippet returns the snippet made by FTS5 as HTML.
+func ftsSnippet(s string) template.HTML {
+	return template.HTML(snippetReplacer.Replace(html.EscapeString(s)))
+}
+
+// textSnippet returns the text around the first occurrence of the query, or
+// "" if there is none.
+func textSnippet(text, query string) template.HTML {
+	lower, q := strings.ToLower(text), strings.ToLower(query)
+	i := strings.Index(lower, q)
+	if q == "" || i < 0 || len(lower) != len(text) {
+		return ""
+	}
+	j := i + len(q)
+
+	const context = 64
+	before, after := []rune(text[:i]), []rune(text[j:])
+	if len(before) > context {
+		before = before[len(before)-context:]
+	}
+	if len(after) > context {
+		after = after[:context]
+	}
+
+	return template.HTML(html.EscapeString(string(before)) +
+		"<mark>" + html.EscapeString(text[i:j]) + "</mark>" +
+		html.EscapeString(string(after)))
+}
+
+// likeSnippet returns the text around the first of the stems found in it,
+// or its start.
+func likeSnippet(text string, stems []string) template.HTML {
+	for _, s := range stems {
+		if snippet := textSnippet(text, s); snippet != "" {
+			return snippet
+		}
+	}
+
+	const context = 128
+	if rr := []rune(text); len(rr) > context {
+		text = string(rr[:context]) + "…"
+	}
+	return template.HTML(html.EscapeString(text))
+}
+
+func (db *sqliteStore) searchAnnotations(query string) ([]annotationMatch, error) {
+	var rows []struct {
+		ID      uint32
+		Snippet string
+	}
+	stems := ftsStems(query)
+	if len(stems) == 0 {
+		return nil, nil
+	}
+
+	var err error
+	if db.fts {
+		err = db.Select(&rows, `SELECT rowid AS id, snippet(book_annotations, 0, char(1), char(2), '…', 24) AS snippet
+					   FROM book_annotations
+					  WHERE book_annotations MATCH ?
+				       ORDER BY rank
+					  LIMIT ?
+					`, ftsQuery(query, " OR "), maxAnnotationMatches)
+	} else {
+		cond, args := likeCondition("annotation", stems, " OR ")
+		err = db.Select(&rows, `SELECT rowid AS id, annotation AS snippet
+					   FROM book_annotations
+					  WHERE `+cond+`
+					  LIMIT ?
+					`, append(args, maxAnnotationMatches)...)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	matches := make([]annotationMatch, 0, len(rows))
+	for _, r := range rows {
+		b, err := db.BookByID(r.ID)
+		if err != nil {
+			return nil, err
+		}
+
+		snippet := ftsSnippet(r.Snippet)
+		if !db.fts {
+			snippet = likeSnippet(r.Snippet, stems)
+		}
+		matches = append(matches, annotationMatch{
+			book:    *b,
+			Snippet: snippet,
+		})
+	}
+
+	return matches, nil
+}
+
+// textMatch is a passage of a book which matches the full-text query.
+type textMatch struct {
+	Book    *book
+	Anchor  string
+	Snippet template.HTML
+}
+
+func (db *sqliteStore) SearchText(query string) ([]textMatch, error) {
+	var rows []struct {
+		RowID   int64
+		Section int
+		Snippet string
+	}
+	stems := ftsStems(query)
+	if len(stems) == 0 {
+		return nil, nil
+	}
+
+	var err error
+	if db.fts {
+		err = db.Select(&rows, `SELECT rowid, section, snippet(book_texts, 1, char(1), char(2), '…', 32) AS snippet
+					   FROM book_texts
+					  WHERE book_texts MATCH ?
+				       ORDER BY rank
+					  LIMIT ?
+					`, ftsQuery(query, " AND "), maxTextMatches)
+	} else {
+		cond, args := likeCondition("text", stems, " AND ")
+		err = db.Select(&rows, `SELECT rowid, section, text AS snippet
+					   FROM book_texts
+					  WHERE `+cond+`
+					  LIMIT ?
+					`, append(args, maxTextMatches)...)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	books := make(map[uint32]*book)
+	matches := make([]textMatch, 0, len(rows))
+	for _, r := range rows {
+		id := uint32(r.RowID / maxTextRows)
+		b := books[id]
+		if b == nil {
+			b, err = db.BookByID(id)
+			if err != nil {
+				return nil, err
+			}
+			books[id] = b
+		}
+
+		var anchor string
+		if r.Section > 0 {
+			anchor = sectionAnchor(r.Section)
+		}
+
+		snippet := ftsSnippet(r.Snippet)
+		if !db.fts {
+			snippet = likeSnippet(r.Snippet, stems)
+		}
+		matches = append(matches, textMatch{
+			Book:    b,
+			Anchor:  anchor,
+			Snippet: snippet,
+		})
+	}
+
+	return matches, nil
+}
+
+// searchBooks returns the books which match all the terms of the query that
+// are not excluded, the best matches first, and whether there were any such
+// terms. The queries are relaxed if they find few books. The terms without a
+// field are looked for in all the fields of the book index; the phrases must
+// have all the trigrams of their words, which are found even in the names
+// indexed word by word, and are checked for by filter later.
+func (db *sqliteStore) searchBooks(q *searchQuery) ([]trigram.Result, bool) {
+	var results []trigram.Result
+	n := 0
+	for _, t := range q.terms {
+		if t.exclude {
+			continue
+		}
+
+		var fields []trigram.Field
+		if t.field != "" {
+			fields = append(fields, queryFields[t.field])
+		}
 
-	if len(authorIDs) > 0 {
-		authors = make([]author, 0, len(authorIDs))
+		var rr []trigram.Result
+		if t.phrase {
+			rr = db.trgmBookIndex.QueryAll(trigram.ExtractWords(foldText(t.text)), fields...)
+		} else {
+			rr = db.trgmBookIndex.QueryRelaxed(trigram.Extract(t.text), fewResults, fields...)
+		}
+
+		if n == 0 {
+			results = rr
+		} else {
+			results = intersectResults(results, rr)
+		}
+		n++
+	}
+
+	sort.Slice(results, func(i, j int) bool {
+		a, b := results[i], results[j]
+		return a.Score > b.Score || a.Score == b.Score && a.ID < b.ID
+	})
+
+	return results, n > 0
+}
+
+// intersectResults returns the results found in both a and b, with the sum
+// of their scores.
+func intersectResults(a, b []trigram.Result) []trigram.Result {
+	scores := make(map[uint32]float64, len(b))
+	for _, r := range b {
+		scores[r.ID] = r.Score
+	}
+
+	var results []trigram.Result
+	for _, r := range a {
+		if score, ok := scores[r.ID]; ok {
+			results = append(results, trigram.Result{ID: r.ID, Score: r.Score + score})
+		}
+	}
+	return results
+}
+
+// jsonIDs returns the IDs as a JSON array, to be passed to json_each.
+func jsonIDs(ids []uint32) (string, error) {
+	js, err := json.Marshal(ids)
+	return string(js), err
+}
+
+func placeholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?, ", n), ", ")
+}
+
+// filterBooks returns the books which pass the lang: and genre: filters of
+// the query: either those of the results, in the same order, or if there
+// are no results to filter, the first of all the books by title.
+func (db *sqliteStore) filterBooks(q *searchQuery, results []trigram.Result, searched bool) ([]uint32, error) {
+	var conds []string
+	var args []interface{}
+	in := func(not string, list []string, cond string) {
+		if len(list) == 0 {
+			return
+		}
+		conds = append(conds, not+fmt.Sprintf(cond, placeholders(len(list))))
+		for _, s := range list {
+			args = append(args, s)
+		}
+	}
+	const genreCond = `EXISTS (SELECT 1
+				     FROM book_genres bg
+				     JOIN genres g ON g.id = bg.genre_id
+				    WHERE bg.book_id = b.id
+				      AND g.name IN (%s))`
+	in("", q.langs, "b.lang IN (%s)")
+	in("NOT ", q.notLangs, "b.lang IN (%s)")
+	in("", q.genres, genreCond)
+	in("NOT ", q.notGenres, genreCond)
+
+	if !searched {
+		var ids []uint32
+		err := db.Select(&ids, "SELECT b.id FROM books b WHERE "+strings.Join(conds, " AND ")+" ORDER BY b.title LIMIT ?",
+			append(args, maxFilterMatches)...)
+		return ids, err
+	}
+
+	if len(results) == 0 {
+		return nil, nil
+	}
+	candidates := make([]uint32, len(results))
+	for i, r := range results {
+		candidates[i] = r.ID
+	}
+	js, err := jsonIDs(candidates)
+	if err != nil {
+		return nil, err
+	}
+
+	var passed []uint32
+	err = db.Select(&passed, "SELECT b.id FROM books b WHERE b.id IN (SELECT value FROM json_each(?)) AND "+strings.Join(conds, " AND "),
+		append([]interface{}{js}, args...)...)
+	if err != nil {
+		return nil, err
 	}
-	if len(sequenceIDs) > 0 {
-		sequences = make([]sequence, 0, len(sequenceIDs))
+
+	ok := make(map[uint32]bool, len(passed))
+	for _, id := range passed {
+		ok[id] = true
+	}
+	ids := candidates[:0]
+	for _, id := range candidates {
+		if ok[id] {
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+// Search looks for the authors, the series and the books matching the query
+// (see searchQuery), and the books with the words of the query in their
+// annotations. The authors, the series and the books closest to the query in
+// the edit distance come first, so that the exact matches are ahead of those
+// found by a relaxed query.
+func (db *sqliteStore) Search(query string) (authors []author, sequences []sequence, books []book, annotations []annotationMatch, err error) {
+	q := parseQuery(query)
+	text := q.text()
+	authorText, sequenceText := text, text
+	if text == "" {
+		authorText = q.fieldText("author", "translator")
+		sequenceText = q.fieldText("series")
+	}
+
+	db.trgmMu.RLock()
+	authorResults := db.trgmAuthorIndex.QueryRelaxed(trigram.Extract(authorText), fewResults)
+	sequenceResults := db.trgmSequenceIndex.QueryRelaxed(trigram.Extract(sequenceText), fewResults)
+	bookResults, searched := db.searchBooks(&q)
+	db.trgmMu.RUnlock()
+
+	var bookIDs []uint32
+	if q.hasFilters() {
+		bookIDs, err = db.filterBooks(&q, bookResults, searched)
+		if err != nil {
+			return nil, nil, nil, nil, err
+		}
+	} else {
+		for _, r := range bookResults {
+			bookIDs = append(bookIDs, r.ID)
+		}
+	}
+
+	if len(authorResults) > 0 {
+		authors = make([]author, 0, len(authorResults))
+	}
+	if len(sequenceResults) > 0 {
+		sequences = make([]sequence, 0, len(sequenceResults))
 	}
 	if len(bookIDs) > 0 {
 		books = make([]book, 0, len(bookIDs))
 	}
 
-	for _, id := range authorIDs {
-		a, err := AuthorByID(id)
+	// The ids of the rows removed since the trigram indexes were updated
+	// are skipped.
+	for _, r := range authorResults {
+		a, err := db.AuthorByID(r.ID)
+		if err == ErrNoRows {
+			continue
+		}
 		if err != nil {
-			return nil, nil, nil, err
+			return nil, nil, nil, nil, err
 		}
 
 		authors = append(authors, *a)
 	}
 
-	for _, id := range sequenceIDs {
-		s, err := SequenceByID(id)
+	for _, r := range sequenceResults {
+		s, err := db.SequenceByID(r.ID)
+		if err == ErrNoRows {
+			continue
+		}
 		if err != nil {
-			return nil, nil, nil, err
+			return nil, nil, nil, nil, err
 		}
 
 		sequences = append(sequences, *s)
 	}
 
 	for _, id := range bookIDs {
-		b, err := BookByID(id)
+		b, err := db.BookByID(id)
+		if err == ErrNoRows {
+			continue
+		}
 		if err != nil {
-			return nil, nil, nil, err
+			return nil, nil, nil, nil, err
 		}
 
-		books = append(books, *b)
+		if q.filter(b) {
+			books = append(books, *b)
+		}
+	}
+
+	d := make([]int, len(authors))
+	for i, a := range authors {
+		d[i] = trigram.WordsDistance(authorText, authorNames(a)...)
+	}
+	sort.Stable(byDistance{d, func(i, j int) { authors[i], authors[j] = authors[j], authors[i] }})
+
+	d = make([]int, len(sequences))
+	for i, s := range sequences {
+		d[i] = trigram.WordsDistance(sequenceText, s.Name)
+	}
+	sort.Stable(byDistance{d, func(i, j int) { sequences[i], sequences[j] = sequences[j], sequences[i] }})
+
+	d = make([]int, len(books))
+	for i := range books {
+		d[i] = q.distance(&books[i])
+	}
+	sort.Stable(byDistance{d, func(i, j int) { books[i], books[j] = books[j], books[i] }})
+
+	annotations, err = db.searchAnnotations(text)
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+
+	return authors, sequences, books, annotations, nil
+}
+
+// Suggest returns the query with its misspelled words replaced by the closest
+// words of the names of the authors and the series, or "" if there are none.
+// The words of the titles are not misspelled, but are not suggested either.
+// The candidates for all the words are looked up at once.
+func (db *sqliteStore) Suggest(query string) (string, error) {
+	var words []string
+	suggestion(query, func(w string) (string, error) {
+		if utf8.RuneCountInString(foldText(w)) >= minSuggestLen {
+			words = append(words, w)
+		}
+		return "", nil
+	})
+	if len(words) == 0 {
+		return "", nil
+	}
+
+	var authorIDs, sequenceIDs, bookIDs []uint32
+	add := func(ids []uint32, results []trigram.Result) []uint32 {
+		if len(results) > suggestCandidates {
+			results = results[:suggestCandidates]
+		}
+		for _, r := range results {
+			ids = append(ids, r.ID)
+		}
+		return ids
+	}
+	db.trgmMu.RLock()
+	for _, w := range words {
+		tt := trigram.Extract(w)
+		authorIDs = add(authorIDs, db.trgmAuthorIndex.QueryRelaxed(tt, 1))
+		sequenceIDs = add(sequenceIDs, db.trgmSequenceIndex.QueryRelaxed(tt, 1))
+		bookIDs = add(bookIDs, db.trgmBookIndex.QueryFields(tt, fieldTitle))
+	}
+	db.trgmMu.RUnlock()
+
+	var names, sequenceNames, titles []string
+	for _, s := range []struct {
+		dest  *[]string
+		query string
+		ids   []uint32
+	}{
+		{&names, "SELECT first_name || ' ' || middle_name || ' ' || last_name || ' ' || nickname FROM authors WHERE id IN (SELECT value FROM json_each(?))", authorIDs},
+		{&sequenceNames, "SELECT name FROM sequences WHERE id IN (SELECT value FROM json_each(?))", sequenceIDs},
+		{&titles, "SELECT title FROM books WHERE id IN (SELECT value FROM json_each(?))", bookIDs},
+	} {
+		js, err := jsonIDs(s.ids)
+		if err != nil {
+			return "", err
+		}
+		err = db.Select(s.dest, s.query, js)
+		if err != nil {
+			return "", err
+		}
 	}
 
-	return authors, sequences, books, nil
+	names = append(names, sequenceNames...)
+	return suggestion(query, func(w string) (string, error) {
+		return closestWord(w, names, titles), nil
+	})
 }
@@ -13,7 +13,7 @@
 
 package main
 
-func updateSequenceWithBookCount(s *sequence) error {
+func (db *sqliteStore) updateSequenceWithBookCount(s *sequence) error {
 	var count int
 	err := db.Get(&count, `SELECT COUNT(book_id)
 				 FROM book_sequences
@@ -28,9 +28,9 @@ func updateSequenceWithBookCount(s *sequence) error {
 	return nil
 }
 
-func updateSequencesWithBookCounts(sequences []sequence) error {
+func (db *sqliteStore) updateSequencesWithBookCounts(sequences []sequence) error {
 	for i := range sequences {
-		err := updateSequenceWithBookCount(&sequences[i])
+		err := db.updateSequenceWithBookCount(&sequences[i])
 		if err != nil {
 			return err
 		}
@@ -39,9 +39,30 @@ func updateSequencesWithBookCounts(sequences []sequence) error {
 	return nil
 }
 
-func SequencesPerPage(n int) ([]sequence, int, error) {
+func (db *sqliteStore) sequenceChildren(id uint32) ([]sequence, error) {
+	var children []sequence
+	err := db.Select(&children, `SELECT id, name, kind, parent_id
+				       FROM sequences
+				      WHERE parent_id = ?
+				   ORDER BY name
+				`, id)
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.updateSequencesWithBookCounts(children)
+	if err != nil {
+		return nil, err
+	}
+
+	return children, nil
+}
+
+// SequencesPerPage returns the top-level sequences of the given kind, along
+// with their children.
+func (db *sqliteStore) SequencesPerPage(kind, n int) ([]sequence, int, error) {
 	var count int
-	err := db.Get(&count, "SELECT COUNT(*) FROM sequences")
+	err := db.Get(&count, "SELECT COUNT(*) FROM sequences WHERE kind = ? AND parent_id = 0", kind)
 	if err != nil {
 		return nil, 0, err
 	}
@@ -53,29 +74,61 @@ func SequencesPerPage(n int) ([]sequence, int, error) {
 	}
 
 	var sequences []sequence
-	err = db.Select(&sequences, `SELECT id, name
+	err = db.Select(&sequences, `SELECT id, name, kind, parent_id
 				       FROM sequences
+				      WHERE kind = ?
+				        AND parent_id = 0
 				   ORDER BY name
 				      LIMIT ?, ?
-				`, offset, *sequencesPerPage)
+				`, kind, offset, *sequencesPerPage)
 	if err != nil {
 		return nil, 0, err
 	}
 
-	err = updateSequencesWithBookCounts(sequences)
+	err = db.updateSequencesWithBookCounts(sequences)
 	if err != nil {
 		return nil, 0, err
 	}
 
+	for i := range sequences {
+		sequences[i].Children, err = db.sequenceChildren(sequences[i].ID)
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+
 	return sequences, numPages, nil
 }
 
-func SequenceByID(id uint32) (*sequence, error) {
+func (db *sqliteStore) SequenceByID(id uint32) (*sequence, error) {
 	var s sequence
-	err := db.Get(&s, "SELECT id, name FROM sequences WHERE id = ?", id)
+	err := db.Get(&s, "SELECT id, name, kind, parent_id FROM sequences WHERE id = ?", id)
 	if err != nil {
 		return nil, err
 	}
 
 	return &s, nil
 }
+
+// SequenceAncestors returns the ancestors of the sequence, the outermost
+// first.
+func (db *sqliteStore) SequenceAncestors(s *sequence) ([]sequence, error) {
+	var ancestors []sequence
+	seen := map[uint32]bool{s.ID: true}
+	for id := s.ParentID; id != 0 && !seen[id]; {
+		seen[id] = true
+
+		p, err := db.SequenceByID(id)
+		if err == ErrNoRows {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		ancestors = append([]sequence{*p}, ancestors...)
+		id = p.ParentID
+	}
+
+	return ancestors, nil
+}
@@ -0,0 +1,155 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/opennota/fb2index/trigram"
+)
+
+func newTestSQLiteStore(t *testing.T) *sqliteStore {
+	db, err := newSQLiteStore(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if db.tx != nil {
+			db.tx.Rollback()
+		}
+		db.Close()
+	})
+	return db
+}
+
+func TestSearchUncommitted(t *testing.T) {
+	db := newTestSQLiteStore(t)
+
+	err := db.AddBook(book{
+		Archive:  "lib/1.zip",
+		Filename: "1.fb2",
+		fb2desc: fb2desc{
+			Title:     "Анна Каренина",
+			Authors:   []author{{FirstName: "Лев", LastName: "Толстой"}},
+			Sequences: []sequence{{Name: "Романы"}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The book is not found until it is committed.
+	for _, query := range []string{"Каренина", "Толстой", "Романы"} {
+		authors, sequences, books, _, err := db.Search(query)
+		if err != nil {
+			t.Fatalf("%s: %v", query, err)
+		}
+		if len(authors)+len(sequences)+len(books) != 0 {
+			t.Errorf("%s: want nothing found before the commit, got %v, %v, %v", query, authors, sequences, books)
+		}
+	}
+
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	authors, sequences, books, _, err := db.Search("Каренина")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(books) != 1 || books[0].Title != "Анна Каренина" {
+		t.Errorf("want the book found after the commit, got %v", books)
+	}
+	if authors, _, _, _, _ = db.Search("Толстой"); len(authors) != 1 {
+		t.Errorf("want the author found after the commit, got %v", authors)
+	}
+	if _, sequences, _, _, _ = db.Search("Романы"); len(sequences) != 1 {
+		t.Errorf("want the sequence found after the commit, got %v", sequences)
+	}
+}
+
+func TestSearchRemovedRows(t *testing.T) {
+	db := newTestSQLiteStore(t)
+
+	for _, title := range []string{"Анна Каренина", "Каренина и другие"} {
+		if err := db.AddBook(book{Archive: "lib/1.zip", Filename: title + ".fb2", fb2desc: fb2desc{Title: title}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A book removed behind the back of the trigram index.
+	if _, err := db.Exec("DELETE FROM books WHERE title = 'Анна Каренина'"); err != nil {
+		t.Fatal(err)
+	}
+
+	_, _, books, _, err := db.Search("Каренина")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(books) != 1 || books[0].Title != "Каренина и другие" {
+		t.Errorf("want only the book which is there, got %v", books)
+	}
+}
+
+func TestRemoveArchives(t *testing.T) {
+	db := newTestSQLiteStore(t)
+
+	for _, b := range []book{
+		{Archive: "lib/1.zip", Filename: "1.fb2", fb2desc: fb2desc{
+			Title:   "Анна Каренина",
+			Authors: []author{{FirstName: "Лев", LastName: "Толстой"}},
+		}},
+		{Archive: "lib/2.zip", Filename: "2.fb2", fb2desc: fb2desc{
+			Title:   "Каренина и другие",
+			Authors: []author{{FirstName: "Антон", LastName: "Чехов"}},
+		}},
+	} {
+		if err := db.AddBook(b); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.RecordArchives([]archive{{Name: "lib/1.zip"}, {Name: "lib/2.zip"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.RemoveArchives([]string{"lib/1.zip"}); err != nil {
+		t.Fatal(err)
+	}
+
+	_, _, books, _, err := db.Search("Каренина")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(books) != 1 || books[0].Title != "Каренина и другие" {
+		t.Errorf("want only the book of the archive left, got %v", books)
+	}
+	if rr := db.trgmAuthorIndex.QueryRelaxed(trigram.Extract("Толстой"), fewResults); len(rr) != 0 {
+		t.Errorf("want the orphaned author removed from the trigram index, got %v", rr)
+	}
+
+	recorded, err := db.recordedArchives()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := recorded["lib/1.zip"]; ok || len(recorded) != 1 {
+		t.Errorf("want the archive forgotten, got %v", recorded)
+	}
+}
@@ -0,0 +1,679 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/opennota/fb2index/trigram"
+)
+
+const (
+	// pairBatchSize is the number of rows a relation stream sends at once.
+	pairBatchSize = 4096
+	// progressInterval is the number of books between the progress logs.
+	progressInterval = 100000
+)
+
+// The fields of the book index.
+const (
+	fieldTitle trigram.Field = iota
+	fieldAuthor
+	fieldTranslator
+	fieldSequence
+	numBookFields
+)
+
+// bookFieldNames are the names of the fields in the -boost option.
+var bookFieldNames = [numBookFields]string{"title", "author", "translator", "series"}
+
+// bookBoosts are the weights of the fields of the book index.
+var bookBoosts = [numBookFields]float64{2, 1.5, 0.5, 1}
+
+// parseBoosts parses the -boost option: a comma-separated list of field=weight
+// pairs, the fields not given keeping their default weights.
+func parseBoosts(s string) error {
+	for _, fw := range strings.Split(s, ",") {
+		fw = strings.TrimSpace(fw)
+		if fw == "" {
+			continue
+		}
+
+		i := strings.IndexByte(fw, '=')
+		if i < 0 {
+			return fmt.Errorf("want field=weight: %q", fw)
+		}
+		name, weight := fw[:i], fw[i+1:]
+
+		f := -1
+		for j, n := range bookFieldNames {
+			if n == name {
+				f = j
+			}
+		}
+		if f < 0 {
+			return fmt.Errorf("unknown field: %q", name)
+		}
+
+		w, err := strconv.ParseFloat(weight, 64)
+		if err != nil || w < 0 {
+			return fmt.Errorf("invalid weight: %q", weight)
+		}
+		bookBoosts[f] = w
+	}
+
+	return nil
+}
+
+// parseFolds parses the -fold option: a comma-separated list of letter=string
+// rules which are added to the default folding rules of the trigram indexes
+// (see trigram.SetFolds), or with an empty string, removed from them.
+func parseFolds(s string) error {
+	if strings.TrimSpace(s) == "" {
+		return nil
+	}
+
+	folds := trigram.DefaultFolds()
+	for _, rule := range strings.Split(s, ",") {
+		rule = strings.TrimSpace(rule)
+		if rule == "" {
+			continue
+		}
+
+		i := strings.IndexByte(rule, '=')
+		if i < 0 {
+			return fmt.Errorf("want letter=string: %q", rule)
+		}
+		from, to := rule[:i], rule[i+1:]
+
+		r, size := utf8.DecodeRuneInString(from)
+		if size != len(from) || !unicode.IsLetter(r) {
+			return fmt.Errorf("not a letter: %q", from)
+		}
+		if to == "" {
+			delete(folds, unicode.ToLower(r))
+		} else {
+			folds[unicode.ToLower(r)] = to
+		}
+	}
+	trigram.SetFolds(folds)
+
+	return nil
+}
+
+// newBookIndex returns an empty book index with the boosts of its fields.
+func newBookIndex() *trigram.Index {
+	index := trigram.NewIndex()
+	for f, w := range bookBoosts {
+		index.SetBoost(trigram.Field(f), w)
+	}
+	return index
+}
+
+// bookFields are the trigrams of the fields of a book.
+type bookFields [numBookFields][]trigram.T
+
+// add adds the trigrams of the book to the index.
+func (bf *bookFields) add(index *trigram.Index, id uint32) {
+	for f, tt := range bf {
+		index.AddFieldTrigrams(id, trigram.Field(f), tt)
+	}
+}
+
+// trigramAdditions are the trigrams added to the indexes in a transaction.
+// They are only added once the transaction is committed, so that the indexes
+// never have the ids of rows which are not there for the other connections.
+type trigramAdditions struct {
+	authors   []idTrigrams
+	sequences []idTrigrams
+	books     []idFields
+}
+
+type idTrigrams struct {
+	id uint32
+	tt []trigram.T
+}
+
+type idFields struct {
+	id uint32
+	bf *bookFields
+}
+
+// addTrigrams adds the trigrams to the indexes.
+func (db *sqliteStore) addTrigrams(ta *trigramAdditions) {
+	db.trgmMu.Lock()
+	defer db.trgmMu.Unlock()
+
+	for _, a := range ta.authors {
+		db.trgmAuthorIndex.AddTrigrams(a.id, a.tt)
+	}
+	for _, s := range ta.sequences {
+		db.trgmSequenceIndex.AddTrigrams(s.id, s.tt)
+	}
+	for _, b := range ta.books {
+		b.bf.add(db.trgmBookIndex, b.id)
+	}
+}
+
+// initTrigramIndexes makes trigram indexes from the existing data. The
+// authors and the sequences are loaded in parallel, then the books are
+// streamed in id order along with their authors, translators and sequences.
+func (db *sqliteStore) initTrigramIndexes() {
+	start := time.Now()
+
+	var (
+		wg            sync.WaitGroup
+		authorIndex   *trigram.Index
+		sequenceIndex *trigram.Index
+		mAuthors      map[uint32][]trigram.T
+		mSequences    map[uint32][]trigram.T
+	)
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		authorIndex, mAuthors = db.authorTrigramIndex()
+	}()
+	go func() {
+		defer wg.Done()
+		sequenceIndex, mSequences = db.sequenceTrigramIndex()
+	}()
+	wg.Wait()
+
+	bookIndex := db.bookTrigramIndex(mAuthors, mSequences)
+
+	db.trgmMu.Lock()
+	db.trgmAuthorIndex = authorIndex
+	db.trgmSequenceIndex = sequenceIndex
+	db.trgmBookIndex = bookIndex
+	db.trgmMu.Unlock()
+
+	log.Printf("Made the trigram indexes in %v", time.Since(start))
+}
+
+// databasePath returns the file of the SQLite data source, or "" if the
+// database is in memory.
+func databasePath(dataSource string) string {
+	path := strings.TrimPrefix(dataSource, "file:")
+	if i := strings.IndexByte(path, '?'); i >= 0 {
+		if strings.Contains(path[i:], "mode=memory") {
+			return ""
+		}
+		path = path[:i]
+	}
+	if path == "" || path == ":memory:" {
+		return ""
+	}
+	return path
+}
+
+// changeCounter returns the counter of the changes to the tables the trigram
+// indexes are made from.
+func (db *sqliteStore) changeCounter() (int64, error) {
+	var counter int64
+	err := db.Get(&counter, "SELECT counter FROM change_counter")
+	return counter, err
+}
+
+// saveTrigramIndexes writes the change counter of the database followed by
+// the indexes to the file.
+func saveTrigramIndexes(path string, counter int64, indexes []*trigram.Index) error {
+	f, err := os.Create(path + ".tmp")
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(f)
+	binary.Write(w, binary.BigEndian, counter)
+	for _, idx := range indexes {
+		_, err = idx.WriteTo(w)
+		if err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(path + ".tmp")
+		return err
+	}
+
+	return os.Rename(path+".tmp", path)
+}
+
+// readTrigramIndexes reads the indexes saved by saveTrigramIndexes, provided
+// that they were saved with the given change counter.
+func readTrigramIndexes(path string, counter int64, indexes []*trigram.Index) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	var saved int64
+	err = binary.Read(r, binary.BigEndian, &saved)
+	if err != nil {
+		return err
+	}
+	if saved != counter {
+		return errors.New("out of date")
+	}
+
+	for _, idx := range indexes {
+		_, err = idx.ReadFrom(r)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// loadTrigramIndexes loads the trigram indexes saved next to the database
+// file, unless the database has been changed since. It reports whether the
+// indexes were loaded.
+func (db *sqliteStore) loadTrigramIndexes() bool {
+	if db.path == "" {
+		return false
+	}
+
+	start := time.Now()
+	path := db.path + ".trgm"
+
+	counter, err := db.changeCounter()
+	if err != nil {
+		log.Printf("Failed to read the database change counter: %v", err)
+		return false
+	}
+
+	authorIndex := trigram.NewIndex()
+	sequenceIndex := trigram.NewIndex()
+	bookIndex := newBookIndex()
+	err = readTrigramIndexes(path, counter, []*trigram.Index{authorIndex, sequenceIndex, bookIndex})
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Not using the trigram indexes in %s: %v", path, err)
+		}
+		return false
+	}
+
+	db.trgmMu.Lock()
+	db.trgmAuthorIndex = authorIndex
+	db.trgmSequenceIndex = sequenceIndex
+	db.trgmBookIndex = bookIndex
+	db.trgmMu.Unlock()
+	db.trgmSaved = counter
+
+	log.Printf("Loaded the trigram indexes in %v", time.Since(start))
+
+	return true
+}
+
+// saveTrigramIndexes saves the trigram indexes next to the database file,
+// unless they have been saved or loaded since the database last changed. It
+// is called once the indexer has flushed the books and before the database
+// can be changed otherwise, so that the indexes match the change counter.
+func (db *sqliteStore) saveTrigramIndexes() {
+	if db.path == "" {
+		return
+	}
+
+	counter, err := db.changeCounter()
+	if err != nil {
+		log.Printf("Failed to read the database change counter: %v", err)
+		return
+	}
+	if counter == db.trgmSaved {
+		return
+	}
+
+	start := time.Now()
+	db.trgmMu.RLock()
+	err = saveTrigramIndexes(db.path+".trgm", counter, []*trigram.Index{db.trgmAuthorIndex, db.trgmSequenceIndex, db.trgmBookIndex})
+	db.trgmMu.RUnlock()
+	if err != nil {
+		log.Printf("Failed to save the trigram indexes: %v", err)
+		return
+	}
+	db.trgmSaved = counter
+
+	log.Printf("Saved the trigram indexes in %v", time.Since(start))
+}
+
+// authorTrigramsByID returns the trigrams of the author's name and aliases.
+func authorTrigramsByID(q sqlx.Queryer, id uint32) ([]trigram.T, error) {
+	var names []author
+	err := sqlx.Select(q, &names, `SELECT first_name, middle_name, last_name, nickname FROM author_aliases WHERE author_id = ?1
+				       UNION ALL
+				       SELECT first_name, middle_name, last_name, nickname FROM authors WHERE id = ?1`, id)
+	if err != nil {
+		return nil, err
+	}
+
+	var tt []trigram.T
+	for _, a := range names {
+		tt = authorTrigrams(tt, a)
+	}
+	return tt, nil
+}
+
+// bookTrigrams returns the trigrams by which the book is indexed, the same
+// as bookTrigramIndex does.
+func bookTrigrams(q sqlx.Queryer, id uint32) (*bookFields, error) {
+	var title string
+	err := sqlx.Get(q, &title, "SELECT title FROM books WHERE id = ?", id)
+	if err != nil {
+		return nil, err
+	}
+	bf := new(bookFields)
+	bf[fieldTitle] = trigram.Extract(title)
+
+	for _, r := range []struct {
+		f     trigram.Field
+		query string
+	}{
+		{fieldAuthor, "SELECT author_id FROM book_authors WHERE book_id = ?"},
+		{fieldTranslator, "SELECT author_id FROM book_translators WHERE book_id = ?"},
+	} {
+		var authorIDs []uint32
+		err = sqlx.Select(q, &authorIDs, r.query, id)
+		if err != nil {
+			return nil, err
+		}
+		for _, authorID := range authorIDs {
+			tt, err := authorTrigramsByID(q, authorID)
+			if err != nil {
+				return nil, err
+			}
+			bf[r.f] = append(bf[r.f], tt...)
+		}
+	}
+
+	var names []string
+	err = sqlx.Select(q, &names, `SELECT s.name
+				      FROM sequences s
+				      JOIN book_sequences bs ON bs.sequence_id = s.id
+				     WHERE bs.book_id = ?`, id)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		bf[fieldSequence] = append(bf[fieldSequence], trigram.Extract(name)...)
+	}
+
+	return bf, nil
+}
+
+// updateAuthorTrigrams updates the trigram indexes after the author from has
+// been merged into the author into: the former is removed, the latter gets
+// the names of the former, and the books of both are indexed again.
+func (db *sqliteStore) updateAuthorTrigrams(into, from uint32, bookIDs []uint32) error {
+	tt, err := authorTrigramsByID(db, into)
+	if err != nil {
+		return err
+	}
+
+	books := make([]*bookFields, len(bookIDs))
+	for i, id := range bookIDs {
+		books[i], err = bookTrigrams(db, id)
+		if err != nil {
+			return err
+		}
+	}
+
+	db.trgmMu.Lock()
+	defer db.trgmMu.Unlock()
+
+	db.trgmAuthorIndex.Remove(from)
+	db.trgmAuthorIndex.Update(into, tt)
+
+	db.trgmBookIndex.Remove(bookIDs...)
+	for i, id := range bookIDs {
+		books[i].add(db.trgmBookIndex, id)
+	}
+
+	return nil
+}
+
+func authorTrigrams(tt []trigram.T, a author) []trigram.T {
+	tt = append(tt, trigram.Extract(a.FirstName)...)
+	tt = append(tt, trigram.Extract(a.MiddleName)...)
+	tt = append(tt, trigram.Extract(a.LastName)...)
+	tt = append(tt, trigram.Extract(a.Nickname)...)
+	return tt
+}
+
+// authorTrigramIndex returns the author index and the trigrams of each
+// author, including those of the author's aliases.
+func (db *sqliteStore) authorTrigramIndex() (*trigram.Index, map[uint32][]trigram.T) {
+	var aliases []struct {
+		author
+		AuthorID uint32 `db:"author_id"`
+	}
+	err := db.Select(&aliases, "SELECT first_name, middle_name, last_name, nickname, author_id FROM author_aliases")
+	if err != nil {
+		log.Fatal(err)
+	}
+	m := make(map[uint32][]trigram.T)
+	for _, a := range aliases {
+		m[a.AuthorID] = authorTrigrams(m[a.AuthorID], a.author)
+	}
+
+	rows, err := db.Queryx("SELECT id, first_name, middle_name, last_name, nickname FROM authors ORDER BY id")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer rows.Close()
+
+	index := trigram.NewIndex()
+	for rows.Next() {
+		var a author
+		err := rows.StructScan(&a)
+		if err != nil {
+			log.Fatal(err)
+		}
+		tt := authorTrigrams(m[a.ID], a)
+		m[a.ID] = tt
+		index.AddTrigrams(a.ID, tt)
+	}
+	if err := rows.Err(); err != nil {
+		log.Fatal(err)
+	}
+
+	return index, m
+}
+
+// sequenceTrigramIndex returns the sequence index and the trigrams of each
+// sequence.
+func (db *sqliteStore) sequenceTrigramIndex() (*trigram.Index, map[uint32][]trigram.T) {
+	rows, err := db.Query("SELECT id, name FROM sequences ORDER BY id")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer rows.Close()
+
+	index := trigram.NewIndex()
+	m := make(map[uint32][]trigram.T)
+	for rows.Next() {
+		var id uint32
+		var name string
+		err := rows.Scan(&id, &name)
+		if err != nil {
+			log.Fatal(err)
+		}
+		tt := trigram.Extract(name)
+		m[id] = tt
+		index.AddTrigrams(id, tt)
+	}
+	if err := rows.Err(); err != nil {
+		log.Fatal(err)
+	}
+
+	return index, m
+}
+
+// bookTrigramIndex returns the book index, in which the books are indexed by
+// their titles and the names of their authors, translators and sequences,
+// each in its own field.
+func (db *sqliteStore) bookTrigramIndex(mAuthors, mSequences map[uint32][]trigram.T) *trigram.Index {
+	var total int
+	err := db.Get(&total, "SELECT COUNT(*) FROM books")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	authors := db.streamPairs("SELECT book_id, author_id FROM book_authors ORDER BY book_id, author_id")
+	defer authors.drain()
+	translators := db.streamPairs("SELECT book_id, author_id FROM book_translators ORDER BY book_id, author_id")
+	defer translators.drain()
+	sequences := db.streamPairs("SELECT book_id, sequence_id FROM book_sequences ORDER BY book_id, sequence_id")
+	defer sequences.drain()
+
+	rows, err := db.Query("SELECT id, title FROM books ORDER BY id")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer rows.Close()
+
+	index := newBookIndex()
+	var refs []uint32
+	n := 0
+	for rows.Next() {
+		var id uint32
+		var title string
+		err := rows.Scan(&id, &title)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		index.AddFieldTrigrams(id, fieldTitle, trigram.Extract(title))
+		refs = authors.refs(id, refs)
+		for _, ref := range refs {
+			index.AddFieldTrigrams(id, fieldAuthor, mAuthors[ref])
+		}
+		refs = translators.refs(id, refs)
+		for _, ref := range refs {
+			index.AddFieldTrigrams(id, fieldTranslator, mAuthors[ref])
+		}
+		refs = sequences.refs(id, refs)
+		for _, ref := range refs {
+			index.AddFieldTrigrams(id, fieldSequence, mSequences[ref])
+		}
+
+		n++
+		if n%progressInterval == 0 {
+			log.Printf("Trigram index: %d of %d books", n, total)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		log.Fatal(err)
+	}
+
+	return index
+}
+
+type idPair struct {
+	id, ref uint32
+}
+
+// pairStream is a stream of pairs of ids ordered by the first id, read by a
+// query running in its own goroutine.
+type pairStream struct {
+	c     <-chan []idPair
+	batch []idPair
+}
+
+// streamPairs runs the query, which selects pairs of ids ordered by the
+// first id, and streams its rows.
+func (db *sqliteStore) streamPairs(query string) *pairStream {
+	c := make(chan []idPair, 4)
+	go func() {
+		defer close(c)
+
+		rows, err := db.Query(query)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer rows.Close()
+
+		batch := make([]idPair, 0, pairBatchSize)
+		for rows.Next() {
+			var p idPair
+			err := rows.Scan(&p.id, &p.ref)
+			if err != nil {
+				log.Fatal(err)
+			}
+			batch = append(batch, p)
+			if len(batch) == pairBatchSize {
+				c <- batch
+				batch = make([]idPair, 0, pairBatchSize)
+			}
+		}
+		if err := rows.Err(); err != nil {
+			log.Fatal(err)
+		}
+		if len(batch) > 0 {
+			c <- batch
+		}
+	}()
+
+	return &pairStream{c: c}
+}
+
+// refs returns the second ids of the pairs with the given first id, reusing
+// the refs slice. The pairs with lower first ids are skipped, so the ids must
+// be asked for in increasing order.
+func (s *pairStream) refs(id uint32, refs []uint32) []uint32 {
+	refs = refs[:0]
+	for {
+		if len(s.batch) == 0 {
+			batch, ok := <-s.c
+			if !ok {
+				return refs
+			}
+			s.batch = batch
+		}
+
+		p := s.batch[0]
+		if p.id > id {
+			return refs
+		}
+		if p.id == id {
+			refs = append(refs, p.ref)
+		}
+		s.batch = s.batch[1:]
+	}
+}
+
+// drain reads the rest of the stream so that its goroutine can finish.
+func (s *pairStream) drain() {
+	for range s.c {
+	}
+}
@@ -14,12 +14,15 @@
 package main
 
 import (
+	"archive/zip"
 	"fmt"
 	"html/template"
 	"io"
 	"log"
+	"mime"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"path"
 	"regexp"
@@ -30,8 +33,8 @@ import (
 var rImageName = regexp.MustCompile(`^(\d+)_(\d+)\.(?:jpg|jpeg|png|gif)$`)
 
 func logError(r *http.Request, err error) {
-	host, _, err := net.SplitHostPort(r.RemoteAddr)
-	if err != nil {
+	host, _, e := net.SplitHostPort(r.RemoteAddr)
+	if e != nil {
 		host = r.RemoteAddr
 	}
 	log.Println(err, "--", host, r.Method, r.URL, r.Referer(), r.UserAgent())
@@ -52,6 +55,25 @@ func executeTemplate(w http.ResponseWriter, name string, data interface{}) error
 	return tmpl.ExecuteTemplate(w, "base", data)
 }
 
+// sameOrigin reports whether the request comes from a page of this server,
+// as told by the Origin or, failing that, the Referer header. A request with
+// neither header is rejected, so that another site can't make the browser
+// change the library on the user's behalf.
+func sameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" || origin == "null" {
+		origin = r.Referer()
+	}
+	if origin == "" {
+		return false
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	return u.Host == r.Host
+}
+
 func intFormValue(r *http.Request, name string) int {
 	value, err := strconv.Atoi(r.FormValue(name))
 	if err != nil {
@@ -62,6 +84,7 @@ func intFormValue(r *http.Request, name string) int {
 }
 
 func intFormValueDefault(r *http.Request, name string, defaultValue int) int {
+	r.ParseForm()
 	vs := r.Form[name]
 	if len(vs) == 0 {
 		return defaultValue
@@ -88,15 +111,26 @@ func indexHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func bookDownload(w http.ResponseWriter, b *book) error {
-	r, err := b.Open()
+	var r io.ReadCloser
+	var err error
+	size := b.UncompressedSize
+	switch b.Method {
+	case zip.Store:
+		r, err = b.OpenRaw()
+	case zip.Deflate:
+		r, err = b.OpenRaw()
+		w.Header().Add("Content-Encoding", "deflate")
+		size = b.CompressedSize
+	default:
+		r, err = b.Open()
+	}
 	if err != nil {
 		return err
 	}
 	defer r.Close()
 
 	w.Header().Add("Content-Type", "application/fb2")
-	w.Header().Add("Content-Encoding", "deflate")
-	w.Header().Add("Content-Length", fmt.Sprint(b.CompressedSize))
+	w.Header().Add("Content-Length", fmt.Sprint(size))
 	w.Header().Add("Content-Disposition", fmt.Sprintf(`attachment; filename="%d.fb2"`, b.ID))
 	_, err = io.Copy(w, r)
 
@@ -107,7 +141,7 @@ func bookHandler(w http.ResponseWriter, r *http.Request) {
 	if id := ID(r); id > 0 {
 		switch r.FormValue("action") {
 		case "read":
-			b, err := BookByID(id)
+			b, err := store.BookByID(id)
 			if err == ErrNoRows {
 				http.NotFound(w, r)
 				return
@@ -134,8 +168,31 @@ func bookHandler(w http.ResponseWriter, r *http.Request) {
 				logError(r, err)
 				return
 			}
+		case "encoding":
+			if r.Method != "POST" {
+				http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+			if !sameOrigin(r) {
+				http.Error(w, "forbidden", http.StatusForbidden)
+				return
+			}
+
+			enc := r.FormValue("encoding")
+			if enc != "" && !knownEncoding(enc) {
+				http.Error(w, "unknown encoding", http.StatusBadRequest)
+				return
+			}
+
+			err := store.SetBookEncoding(id, enc)
+			if err != nil {
+				httpError(w, r, err)
+				return
+			}
+
+			http.Redirect(w, r, fmt.Sprintf("/b?id=%d", id), http.StatusSeeOther)
 		case "download":
-			b, err := BookByID(id)
+			b, err := store.BookByID(id)
 			if err == ErrNoRows {
 				http.NotFound(w, r)
 				return
@@ -170,7 +227,7 @@ func bookHandler(w http.ResponseWriter, r *http.Request) {
 				b,
 				template.HTML(ann),
 				cover,
-				iso639_1[b.Lang],
+				languageName(b.Lang),
 			})
 			if err != nil {
 				logError(r, err)
@@ -187,7 +244,7 @@ func bookHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	books, totalPages, err := BooksPerPage(page)
+	books, totalPages, err := store.BooksPerPage(page)
 	if err != nil {
 		httpError(w, r, err)
 		return
@@ -210,7 +267,7 @@ func bookHandler(w http.ResponseWriter, r *http.Request) {
 
 func authorHandler(w http.ResponseWriter, r *http.Request) {
 	if id := ID(r); id > 0 {
-		books, translations, au, err := BooksByAuthor(id)
+		books, translations, au, err := store.BooksByAuthor(id)
 		if err == ErrNoRows {
 			http.NotFound(w, r)
 			return
@@ -220,12 +277,20 @@ func authorHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
+		aliases, err := store.AuthorAliases(id)
+		if err != nil {
+			httpError(w, r, err)
+			return
+		}
+
 		err = executeTemplate(w, "author", struct {
 			Author       *author
+			Aliases      []author
 			Books        []book
 			Translations []book
 		}{
 			au,
+			aliases,
 			books,
 			translations,
 		})
@@ -243,7 +308,7 @@ func authorHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	authors, totalPages, err := AuthorsPerPage(page)
+	authors, totalPages, err := store.AuthorsPerPage(page)
 	if err != nil {
 		httpError(w, r, err)
 		return
@@ -264,9 +329,60 @@ func authorHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+func authorMergeHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		candidates, err := store.MergeCandidates(*authorsPerPage)
+		if err != nil {
+			httpError(w, r, err)
+			return
+		}
+
+		err = executeTemplate(w, "author_merge", struct {
+			Candidates []mergeCandidate
+		}{
+			candidates,
+		})
+		if err != nil {
+			logError(r, err)
+			return
+		}
+	case "POST":
+		if !sameOrigin(r) {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+
+		into := intFormValue(r, "into")
+		from := intFormValue(r, "from")
+		if r.FormValue("swap") != "" {
+			into, from = from, into
+		}
+		if into <= 0 || from <= 0 || into == from {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+
+		err := store.MergeAuthors(uint32(into), uint32(from))
+		if err == ErrNoRows {
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			httpError(w, r, err)
+			return
+		}
+
+		http.Redirect(w, r, "/a/merge", http.StatusSeeOther)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+}
+
 func sequenceHandler(w http.ResponseWriter, r *http.Request) {
 	if id := ID(r); id > 0 {
-		books, seq, err := BooksBySequence(id)
+		books, seq, err := store.BooksBySequence(id)
 		if err == ErrNoRows {
 			http.NotFound(w, r)
 			return
@@ -276,12 +392,22 @@ func sequenceHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
+		ancestors, err := store.SequenceAncestors(seq)
+		if err != nil {
+			httpError(w, r, err)
+			return
+		}
+
 		err = executeTemplate(w, "sequence", struct {
-			Sequence *sequence
-			Books    []book
+			Sequence  *sequence
+			Ancestors []sequence
+			Books     []book
+			Publisher bool
 		}{
 			seq,
+			ancestors,
 			books,
+			seq.Kind == seqPublisher,
 		})
 		if err != nil {
 			logError(r, err)
@@ -297,7 +423,12 @@ func sequenceHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	sequences, totalPages, err := SequencesPerPage(page)
+	kind := seqSeries
+	if r.URL.Path == "/ps" {
+		kind = seqPublisher
+	}
+
+	sequences, totalPages, err := store.SequencesPerPage(kind, page)
 	if err != nil {
 		httpError(w, r, err)
 		return
@@ -307,10 +438,12 @@ func sequenceHandler(w http.ResponseWriter, r *http.Request) {
 		Sequences  []sequence
 		PageNumber int
 		TotalPages int
+		Publisher  bool
 	}{
 		sequences,
 		page,
 		totalPages,
+		kind == seqPublisher,
 	})
 	if err != nil {
 		logError(r, err)
@@ -320,7 +453,7 @@ func sequenceHandler(w http.ResponseWriter, r *http.Request) {
 
 func genreHandler(w http.ResponseWriter, r *http.Request) {
 	if id := ID(r); id > 0 {
-		books, g, err := BooksByGenre(id)
+		books, g, err := store.BooksByGenre(id)
 		if err == ErrNoRows {
 			http.NotFound(w, r)
 			return
@@ -345,7 +478,7 @@ func genreHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	genres, err := Genres()
+	genres, err := store.Genres()
 	if err != nil {
 		httpError(w, r, err)
 		return
@@ -358,31 +491,133 @@ func genreHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+func languageHandler(w http.ResponseWriter, r *http.Request) {
+	if code := strings.TrimPrefix(r.URL.Path, "/l/"); code != r.URL.Path {
+		if normalizeLanguage(code) != code {
+			http.NotFound(w, r)
+			return
+		}
+
+		page := intFormValueDefault(r, "page", 1)
+		if page <= 0 {
+			http.NotFound(w, r)
+			return
+		}
+
+		books, totalPages, err := store.BooksByLanguage(code, page)
+		if err != nil {
+			httpError(w, r, err)
+			return
+		}
+
+		err = executeTemplate(w, "language", struct {
+			Code       string
+			Books      []book
+			PageNumber int
+			TotalPages int
+		}{
+			code,
+			books,
+			page,
+			totalPages,
+		})
+		if err != nil {
+			logError(r, err)
+			return
+		}
+
+		return
+	}
+
+	languages, err := store.Languages()
+	if err != nil {
+		httpError(w, r, err)
+		return
+	}
+
+	err = executeTemplate(w, "language_index", languages)
+	if err != nil {
+		logError(r, err)
+		return
+	}
+}
+
 func searchHandler(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
-	case "GET":
+	case "GET", "POST":
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// The suggestions are links, so a GET with a query searches too.
+	query := r.FormValue("query")
+	if r.Method == "GET" && query == "" {
 		err := executeTemplate(w, "search", nil)
+		if err != nil {
+			logError(r, err)
+		}
+		return
+	}
+
+	authors, sequences, books, annotations, err := store.Search(query)
+	if err != nil {
+		httpError(w, r, err)
+		return
+	}
+
+	// A correction is only suggested if little is found.
+	var suggestion string
+	if len(authors)+len(sequences)+len(books) < fewResults {
+		suggestion, err = store.Suggest(query)
+		if err != nil {
+			httpError(w, r, err)
+			return
+		}
+	}
+
+	err = executeTemplate(w, "search", struct {
+		Authors     []author
+		Sequences   []sequence
+		Books       []book
+		Annotations []annotationMatch
+		SearchQuery string
+		Suggestion  string
+	}{
+		authors,
+		sequences,
+		books,
+		annotations,
+		query,
+		suggestion,
+	})
+	if err != nil {
+		logError(r, err)
+		return
+	}
+}
+
+func textSearchHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		err := executeTemplate(w, "text_search", nil)
 		if err != nil {
 			logError(r, err)
 			return
 		}
 	case "POST":
 		query := r.FormValue("query")
-		authors, sequences, books, err := Search(query)
+		matches, err := store.SearchText(query)
 		if err != nil {
 			httpError(w, r, err)
 			return
 		}
 
-		err = executeTemplate(w, "search", struct {
-			Authors     []author
-			Sequences   []sequence
-			Books       []book
+		err = executeTemplate(w, "text_search", struct {
+			Matches     []textMatch
 			SearchQuery string
 		}{
-			authors,
-			sequences,
-			books,
+			matches,
 			query,
 		})
 		if err != nil {
@@ -395,6 +630,94 @@ func searchHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+type errorsPage struct {
+	Groups  []indexErrorGroup
+	Stage   string
+	Archive string
+	Errors  []indexError
+}
+
+func errorsHandler(w http.ResponseWriter, r *http.Request) {
+	if id := ID(r); id > 0 {
+		if r.FormValue("action") != "download" {
+			http.NotFound(w, r)
+			return
+		}
+
+		e, err := store.IndexErrorByID(id)
+		if err == ErrNoRows {
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			httpError(w, r, err)
+			return
+		}
+
+		rc, err := e.Open()
+		if os.IsNotExist(err) {
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			httpError(w, r, err)
+			return
+		}
+		defer rc.Close()
+
+		w.Header().Add("Content-Type", "application/octet-stream")
+		w.Header().Add("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{
+			"filename": path.Base(e.Filename),
+		}))
+		if _, err := io.Copy(w, rc); err != nil {
+			logError(r, err)
+			return
+		}
+
+		return
+	}
+
+	stage := r.FormValue("stage")
+	archive := r.FormValue("archive")
+	if stage != "" || archive != "" {
+		errs, err := store.IndexErrors(stage, archive)
+		if err != nil {
+			httpError(w, r, err)
+			return
+		}
+		if len(errs) == 0 {
+			http.NotFound(w, r)
+			return
+		}
+
+		err = executeTemplate(w, "errors", errorsPage{
+			Stage:   stage,
+			Archive: archive,
+			Errors:  errs,
+		})
+		if err != nil {
+			logError(r, err)
+			return
+		}
+
+		return
+	}
+
+	groups, err := store.IndexErrorGroups()
+	if err != nil {
+		httpError(w, r, err)
+		return
+	}
+
+	err = executeTemplate(w, "errors", errorsPage{
+		Groups: groups,
+	})
+	if err != nil {
+		logError(r, err)
+		return
+	}
+}
+
 func contentTypeByExt(name string) string {
 	switch strings.ToLower(path.Ext(name)) {
 	case ".jpg", ".jpeg":
@@ -443,7 +766,7 @@ func imageHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		b, err := BookByID(uint32(id))
+		b, err := store.BookByID(uint32(id))
 		if err == ErrNoRows {
 			http.NotFound(w, r)
 			return
@@ -504,8 +827,14 @@ func listenAndServe() {
 	http.HandleFunc("/b", bookHandler)
 	http.HandleFunc("/g", genreHandler)
 	http.HandleFunc("/a", authorHandler)
+	http.HandleFunc("/a/merge", authorMergeHandler)
 	http.HandleFunc("/s", sequenceHandler)
+	http.HandleFunc("/ps", sequenceHandler)
+	http.HandleFunc("/l", languageHandler)
+	http.HandleFunc("/l/", languageHandler)
 	http.HandleFunc("/search", searchHandler)
+	http.HandleFunc("/text", textSearchHandler)
+	http.HandleFunc("/errors", errorsHandler)
 	http.HandleFunc("/i/", imageHandler)
 	http.HandleFunc("/robots.txt", robotsHandler)
 	http.HandleFunc("/external.css", cssHandler)
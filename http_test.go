@@ -0,0 +1,289 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testFB2 = `<?xml version="1.0" encoding="utf-8"?>
+<FictionBook>
+<description>
+<title-info>
+<genre>prose_classic</genre>
+<author><first-name>%s</first-name><last-name>Толстой</last-name></author>
+<book-title>%s</book-title>
+<lang>ru</lang>
+</title-info>
+</description>
+<body><section><p>Текст</p></section></body>
+</FictionBook>`
+
+// setupMemStore replaces the store with an in-memory one holding the FB2
+// files written from the given first names and titles, and a file which
+// can't be parsed.
+func setupMemStore(t *testing.T, books ...[2]string) {
+	saved := store
+	m := newMemStore()
+	store = m
+	t.Cleanup(func() {
+		store = saved
+		takePendingErrors()
+	})
+
+	dir := t.TempDir()
+	results := make(chan book, len(books))
+	for i, b := range books {
+		name := filepath.Join(dir, fmt.Sprintf("%d.fb2", i+1))
+		err := os.WriteFile(name, []byte(fmt.Sprintf(testFB2, b[0], b[1])), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := indexFile(name, results); err != nil {
+			t.Fatal(err)
+		}
+		if err := m.AddBook(<-results); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	name := filepath.Join(dir, "сломанная книга.fb2")
+	if err := os.WriteFile(name, []byte("<FictionBook"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := indexFile(name, results); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Flush(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func serve(handler http.HandlerFunc, r *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	handler(w, r)
+	return w
+}
+
+func postForm(target string, form url.Values, origin string) *http.Request {
+	r := httptest.NewRequest("POST", target, strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if origin != "" {
+		r.Header.Set("Origin", origin)
+	}
+	return r
+}
+
+func TestBookHandler(t *testing.T) {
+	setupMemStore(t, [2]string{"Лев", "Война и мир"})
+
+	w := serve(bookHandler, httptest.NewRequest("GET", "/b?id=1", nil))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "Война и мир") {
+		t.Errorf("want the book page, got %d\n%s", w.Code, w.Body)
+	}
+
+	w = serve(bookHandler, httptest.NewRequest("GET", "/b?id=2", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("want 404 for an unknown book, got %d", w.Code)
+	}
+
+	w = serve(bookHandler, httptest.NewRequest("GET", "/b?id=1&action=download", nil))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "<book-title>Война и мир</book-title>") {
+		t.Errorf("want the book file, got %d\n%s", w.Code, w.Body)
+	}
+}
+
+func TestAuthorHandler(t *testing.T) {
+	setupMemStore(t, [2]string{"Лев", "Война и мир"}, [2]string{"Лев", "Анна Каренина"})
+
+	w := serve(authorHandler, httptest.NewRequest("GET", "/a?id=1", nil))
+	body := w.Body.String()
+	if w.Code != http.StatusOK || !strings.Contains(body, "Толстой") ||
+		!strings.Contains(body, "Война и мир") || !strings.Contains(body, "Анна Каренина") {
+		t.Errorf("want the author page listing both books, got %d\n%s", w.Code, body)
+	}
+}
+
+func TestSearchHandler(t *testing.T) {
+	setupMemStore(t, [2]string{"Лев", "Война и мир"}, [2]string{"Лев", "Анна Каренина"})
+
+	w := serve(searchHandler, httptest.NewRequest("GET", "/search?query="+url.QueryEscape("каренина"), nil))
+	body := w.Body.String()
+	if w.Code != http.StatusOK || !strings.Contains(body, "Анна Каренина") || strings.Contains(body, "Война и мир") {
+		t.Errorf("want only the matching book, got %d\n%s", w.Code, body)
+	}
+
+	w = serve(searchHandler, httptest.NewRequest("DELETE", "/search", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("want 405, got %d", w.Code)
+	}
+}
+
+func TestAuthorMergeHandler(t *testing.T) {
+	setupMemStore(t, [2]string{"Лев", "Война и мир"}, [2]string{"Л.", "Анна Каренина"})
+
+	w := serve(authorMergeHandler, httptest.NewRequest("GET", "/a/merge", nil))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "Л.") {
+		t.Errorf("want the merge candidates, got %d\n%s", w.Code, w.Body)
+	}
+
+	form := url.Values{"into": {"1"}, "from": {"2"}}
+	for _, origin := range []string{"", "http://example.org", "null"} {
+		w = serve(authorMergeHandler, postForm("/a/merge", form, origin))
+		if w.Code != http.StatusForbidden {
+			t.Errorf("Origin %q: want 403, got %d", origin, w.Code)
+		}
+	}
+	if _, err := store.AuthorByID(2); err != nil {
+		t.Fatalf("the author is merged by a cross-site request: %v", err)
+	}
+
+	w = serve(authorMergeHandler, postForm("/a/merge", url.Values{"into": {"1"}, "from": {"1"}}, "http://example.com"))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("want 400 merging an author into itself, got %d", w.Code)
+	}
+
+	w = serve(authorMergeHandler, postForm("/a/merge", form, "http://example.com"))
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("want 303, got %d\n%s", w.Code, w.Body)
+	}
+	if _, err := store.AuthorByID(2); err != ErrNoRows {
+		t.Errorf("want the author merged, got %v", err)
+	}
+	books, _, _, err := store.BooksByAuthor(1)
+	if err != nil || len(books) != 2 {
+		t.Errorf("want both books by the author, got %v, %v", books, err)
+	}
+
+	r := httptest.NewRequest("POST", "/a/merge", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.Header.Set("Referer", "http://example.com/a/merge")
+	w = serve(authorMergeHandler, r)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("want the Referer accepted and 404 for a merged author, got %d", w.Code)
+	}
+}
+
+func TestBookEncodingHandler(t *testing.T) {
+	setupMemStore(t, [2]string{"Лев", "Война и мир"})
+
+	target := "/b?id=1&action=encoding"
+	w := serve(bookHandler, postForm(target, url.Values{"encoding": {"koi8-r"}}, "http://example.org"))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("want 403 for a cross-site request, got %d", w.Code)
+	}
+
+	w = serve(bookHandler, postForm(target, url.Values{"encoding": {"latin1"}}, "http://example.com"))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("want 400 for an unknown encoding, got %d", w.Code)
+	}
+
+	w = serve(bookHandler, httptest.NewRequest("GET", target+"&encoding=koi8-r", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("want 405 for GET, got %d", w.Code)
+	}
+
+	b, err := store.BookByID(1)
+	if err != nil || b.Title != "Война и мир" {
+		t.Fatalf("want the book unchanged, got %+v, %v", b, err)
+	}
+
+	w = serve(bookHandler, postForm(target, url.Values{"encoding": {"koi8-r"}}, "http://example.com"))
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("want 303, got %d\n%s", w.Code, w.Body)
+	}
+	b, err = store.BookByID(1)
+	if err != nil || b.Encoding != "koi8-r" || b.Title == "Война и мир" {
+		t.Errorf("want the book re-read as KOI8-R, got %+v, %v", b, err)
+	}
+
+	w = serve(bookHandler, postForm(target, url.Values{"encoding": {""}}, "http://example.com"))
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("want 303, got %d\n%s", w.Code, w.Body)
+	}
+	b, err = store.BookByID(1)
+	if err != nil || b.Title != "Война и мир" {
+		t.Errorf("want the book title restored, got %+v, %v", b, err)
+	}
+}
+
+func TestErrorsHandler(t *testing.T) {
+	setupMemStore(t)
+
+	w := serve(errorsHandler, httptest.NewRequest("GET", "/errors", nil))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "сломанная книга.fb2") {
+		t.Errorf("want the error listed, got %d\n%s", w.Code, w.Body)
+	}
+
+	w = serve(errorsHandler, httptest.NewRequest("GET", "/errors?id=1&action=download", nil))
+	if w.Code != http.StatusOK || w.Body.String() != "<FictionBook" {
+		t.Fatalf("want the file, got %d\n%s", w.Code, w.Body)
+	}
+	_, params, err := mime.ParseMediaType(w.Header().Get("Content-Disposition"))
+	if err != nil || params["filename"] != "сломанная книга.fb2" {
+		t.Errorf("want the file name in Content-Disposition, got %q, %v", w.Header().Get("Content-Disposition"), err)
+	}
+
+	w = serve(errorsHandler, httptest.NewRequest("GET", "/errors?id=2&action=download", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("want 404 for an unknown error, got %d", w.Code)
+	}
+}
+
+// countingStore counts the calls of Suggest.
+type countingStore struct {
+	*memStore
+	suggestCalls int
+}
+
+func (s *countingStore) Suggest(query string) (string, error) {
+	s.suggestCalls++
+	return s.memStore.Suggest(query)
+}
+
+func TestSearchSuggestion(t *testing.T) {
+	var books [][2]string
+	for i := 0; i < fewResults; i++ {
+		books = append(books, [2]string{"Лев", fmt.Sprintf("Книга %d", i+1)})
+	}
+	setupMemStore(t, books...)
+	cs := &countingStore{memStore: store.(*memStore)}
+	store = cs
+
+	w := serve(searchHandler, httptest.NewRequest("GET", "/search?query="+url.QueryEscape("Толстуй"), nil))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "Возможно, вы имели в виду") ||
+		!strings.Contains(w.Body.String(), ">Толстой</a>") {
+		t.Errorf("want the correction suggested, got %d\n%s", w.Code, w.Body)
+	}
+	if cs.suggestCalls != 1 {
+		t.Errorf("want Suggest called once, got %d", cs.suggestCalls)
+	}
+
+	cs.suggestCalls = 0
+	w = serve(searchHandler, httptest.NewRequest("GET", "/search?query="+url.QueryEscape("книга"), nil))
+	if w.Code != http.StatusOK || strings.Contains(w.Body.String(), "Возможно, вы имели в виду") {
+		t.Errorf("want no correction, got %d\n%s", w.Code, w.Body)
+	}
+	if cs.suggestCalls != 0 {
+		t.Errorf("want Suggest not called when enough is found, got %d calls", cs.suggestCalls)
+	}
+}
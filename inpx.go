@@ -0,0 +1,391 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// defaultINPFields is the order of the fields in an .inp line, unless
+// overridden by structure.info.
+var defaultINPFields = []string{
+	"AUTHOR", "GENRE", "TITLE", "SERIES", "SERNO", "FILE", "SIZE", "LIBID",
+	"DEL", "EXT", "DATE", "LANG", "LIBRATE", "KEYWORDS",
+}
+
+// inpRecord is a book described in an INPX catalog.
+type inpRecord struct {
+	fb2desc
+	Filename string
+	LibID    string
+	Added    string
+	Deleted  bool
+}
+
+var (
+	// catalogMu guards the catalog, which is read again in watch mode
+	// while the HTTP handlers may look into it.
+	catalogMu sync.RWMutex
+
+	// catalog maps archive names to the books described in the INPX
+	// catalog.
+	catalog map[string][]inpRecord
+
+	// catalogFile is the INPX catalog file as it was when it was read.
+	catalogFile archive
+)
+
+var errNotInArchive = errors.New("not found in the archive")
+
+func parseINPFields(s string) []string {
+	var fields []string
+	for _, f := range strings.Split(strings.TrimSpace(s), ";") {
+		if f = strings.ToUpper(strings.TrimSpace(f)); f != "" {
+			fields = append(fields, f)
+		}
+	}
+	return fields
+}
+
+func parseINPAuthors(s string) []author {
+	var authors []author
+	for _, s := range strings.Split(s, ":") {
+		parts := strings.Split(s, ",")
+		for len(parts) < 3 {
+			parts = append(parts, "")
+		}
+		a := author{
+			LastName:   strings.TrimSpace(parts[0]),
+			FirstName:  strings.TrimSpace(parts[1]),
+			MiddleName: strings.TrimSpace(parts[2]),
+		}
+		if a != (author{}) {
+			authors = append(authors, a)
+		}
+	}
+	return authors
+}
+
+func parseINPGenres(s string) []genre {
+	var genres []genre
+	for _, g := range strings.Split(s, ":") {
+		g = normalizeGenre(strings.TrimSpace(g))
+		if validGenre(g) {
+			genres = append(genres, genre{
+				Name: g,
+			})
+		}
+	}
+	return genres
+}
+
+// parseINPLine parses a line of an .inp file. It returns the name of the
+// archive, if the line has one, and the book record.
+func parseINPLine(line string, fields []string) (string, *inpRecord, error) {
+	values := strings.Split(line, "\x04")
+
+	var rec inpRecord
+	var folder, file, ext, series, serno string
+	for i, f := range fields {
+		if i >= len(values) {
+			break
+		}
+		v := strings.TrimSpace(values[i])
+
+		switch f {
+		case "AUTHOR":
+			rec.Authors = parseINPAuthors(v)
+		case "GENRE":
+			rec.Genres = parseINPGenres(v)
+		case "TITLE":
+			rec.Title = v
+		case "SERIES":
+			series = v
+		case "SERNO":
+			serno = v
+		case "FILE":
+			file = v
+		case "EXT":
+			ext = v
+		case "LIBID":
+			rec.LibID = v
+		case "DEL":
+			rec.Deleted = v == "1"
+		case "DATE":
+			rec.Added = v
+		case "LANG":
+			rec.RawLang = v
+			rec.Lang = normalizeLanguage(v)
+		case "KEYWORDS":
+			rec.Keywords = v
+		case "FOLDER":
+			folder = v
+		}
+	}
+
+	if rec.Title == "" {
+		return "", nil, ErrNoTitle
+	}
+
+	if ext != "fb2" || !bookLanguageAllowed(rec.RawLang, rec.Lang) {
+		return "", nil, ErrSkip
+	}
+
+	if series != "" {
+		rec.Sequences = []sequence{{
+			Name:     series,
+			Number:   serno,
+			Position: sequencePosition(serno),
+		}}
+	}
+
+	rec.Filename = file + "." + ext
+
+	return folder, &rec, nil
+}
+
+// readINPX reads an INPX catalog. The archives are looked for in the
+// directory where the catalog resides.
+func readINPX(name string) (map[string][]inpRecord, error) {
+	r, err := zip.OpenReader(name)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	fields := defaultINPFields
+	for _, f := range r.File {
+		if !strings.EqualFold(f.Name, "structure.info") {
+			continue
+		}
+
+		rc, err := f.Open()
+		if err != nil {
+			return nil, err
+		}
+		data, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			return nil, err
+		}
+		fields = parseINPFields(string(data))
+	}
+
+	dir := filepath.Dir(name)
+	cat := make(map[string][]inpRecord)
+	for _, f := range r.File {
+		if path.Ext(f.Name) != ".inp" {
+			continue
+		}
+
+		rc, err := f.Open()
+		if err != nil {
+			return nil, err
+		}
+		err = readINP(rc, fields, dir, strings.TrimSuffix(f.Name, ".inp")+".zip", cat)
+		rc.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return cat, nil
+}
+
+// loadCatalog reads the INPX catalog, unless it has not changed since it was
+// last read. It returns the archives whose books are described differently
+// than in the catalog read before, and those which are no longer in it.
+func loadCatalog(name string) (changed, dropped []string, err error) {
+	fi, err := os.Stat(name)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	a := archive{
+		Name:    name,
+		Size:    fi.Size(),
+		ModTime: fi.ModTime().Unix(),
+	}
+	if a == catalogFile {
+		return nil, nil, nil
+	}
+
+	cat, err := readINPX(name)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	catalogMu.Lock()
+	defer catalogMu.Unlock()
+
+	if catalog != nil {
+		for name, records := range cat {
+			if !reflect.DeepEqual(records, catalog[name]) {
+				changed = append(changed, name)
+			}
+		}
+		for name := range catalog {
+			if _, ok := cat[name]; !ok {
+				dropped = append(dropped, name)
+			}
+		}
+		sort.Strings(changed)
+		sort.Strings(dropped)
+	}
+	catalog, catalogFile = cat, a
+
+	return changed, dropped, nil
+}
+
+// catalogArchives returns the archives of the INPX catalog.
+func catalogArchives() []string {
+	catalogMu.RLock()
+	defer catalogMu.RUnlock()
+
+	names := make([]string, 0, len(catalog))
+	for name := range catalog {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// catalogRecords returns the books of the archive described in the INPX
+// catalog, and whether the catalog has the archive.
+func catalogRecords(name string) ([]inpRecord, bool) {
+	catalogMu.RLock()
+	defer catalogMu.RUnlock()
+
+	records, ok := catalog[name]
+	return records, ok
+}
+
+// inCatalog reports whether the book is described in the INPX catalog.
+func inCatalog(b *book) bool {
+	records, _ := catalogRecords(b.Archive)
+	for _, r := range records {
+		if r.Filename == b.Filename {
+			return true
+		}
+	}
+	return false
+}
+
+func readINP(r io.Reader, fields []string, dir, archive string, cat map[string][]inpRecord) error {
+	s := bufio.NewScanner(r)
+	s.Buffer(nil, 1024*1024)
+	for s.Scan() {
+		line := strings.TrimRight(s.Text(), "\r")
+		if line == "" {
+			continue
+		}
+
+		folder, rec, err := parseINPLine(line, fields)
+		if err == ErrSkip {
+			continue
+		}
+		if err != nil {
+			log.Printf("%s: %s: %v", archive, line, err)
+			continue
+		}
+
+		name := archive
+		if folder != "" {
+			name = folder
+		}
+		name = filepath.Join(dir, name)
+		cat[name] = append(cat[name], *rec)
+	}
+
+	return s.Err()
+}
+
+// importArchive adds the books of an archive described in the INPX catalog,
+// skipping the entries which are already indexed. Only the central directory
+// of the archive is read.
+func importArchive(name string, records []inpRecord, indexed map[string]bool, results chan<- book) error {
+	r, err := zip.OpenReader(name)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	files := make(map[string]*zip.File, len(r.File))
+	for _, f := range r.File {
+		files[f.Name] = f
+	}
+
+	for _, rec := range records {
+		if indexed[rec.Filename] {
+			continue
+		}
+
+		f := files[rec.Filename]
+		if f == nil {
+			reportIndexError(name, rec.Filename, stageMissing, errNotInArchive)
+			continue
+		}
+
+		if !supportedMethod(f.Method) {
+			reportIndexError(name, f.Name, stageCompression, fmt.Errorf("%v %d", ErrUnsupportedMethod, f.Method))
+			continue
+		}
+
+		offset, err := f.DataOffset()
+		if err != nil {
+			reportIndexError(name, f.Name, stageOpen, err)
+			continue
+		}
+
+		var text []textSection
+		var enc string
+		if *fullText {
+			text, enc, err = extractText(f.Open, enc)
+			if err != nil {
+				reportIndexError(name, f.Name, stageText, err)
+			}
+		}
+
+		results <- book{
+			Archive:          name,
+			Filename:         f.Name,
+			fb2desc:          rec.fb2desc,
+			Offset:           offset,
+			CompressedSize:   int64(f.CompressedSize64),
+			UncompressedSize: int64(f.UncompressedSize64),
+			CRC32:            f.CRC32,
+			Method:           f.Method,
+			Encoding:         enc,
+			LibID:            rec.LibID,
+			Added:            rec.Added,
+			Deleted:          rec.Deleted,
+			Text:             text,
+		}
+	}
+
+	return nil
+}
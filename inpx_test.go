@@ -0,0 +1,281 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// inpLine joins the values of an .inp line.
+func inpLine(values ...string) string {
+	return strings.Join(values, "\x04")
+}
+
+func TestParseINPLine(t *testing.T) {
+	custom := parseINPFields(" author; title ;FILE;ext;folder;;LANG\n")
+	if want := []string{"AUTHOR", "TITLE", "FILE", "EXT", "FOLDER", "LANG"}; !reflect.DeepEqual(custom, want) {
+		t.Fatalf("parseINPFields: got %v, want %v", custom, want)
+	}
+
+	for _, tc := range []struct {
+		name   string
+		fields []string
+		line   string
+		folder string
+		rec    *inpRecord
+		err    error
+	}{
+		{
+			name:   "all fields",
+			fields: defaultINPFields,
+			line: inpLine("Толстой,Лев,Николаевич:Тургенев,Иван,:", "prose_classic:", "Война и мир", "Эпопея", "2",
+				"12345", "1024", "777", "1", "fb2", "2020-01-02", "rus", "4", "война, мир", ""),
+			rec: &inpRecord{
+				fb2desc: fb2desc{
+					Authors: []author{
+						{LastName: "Толстой", FirstName: "Лев", MiddleName: "Николаевич"},
+						{LastName: "Тургенев", FirstName: "Иван"},
+					},
+					Genres:    []genre{{Name: "prose_classic"}},
+					Sequences: []sequence{{Name: "Эпопея", Number: "2", Position: 2}},
+					Title:     "Война и мир",
+					Lang:      "ru",
+					RawLang:   "rus",
+					Keywords:  "война, мир",
+				},
+				Filename: "12345.fb2",
+				LibID:    "777",
+				Added:    "2020-01-02",
+				Deleted:  true,
+			},
+		},
+		{
+			name:   "empty language",
+			fields: defaultINPFields,
+			line:   inpLine("Иванов,,", "", "Книга", "", "", "1", "", "", "0", "fb2", "", "", ""),
+			rec: &inpRecord{
+				fb2desc: fb2desc{
+					Authors: []author{{LastName: "Иванов"}},
+					Title:   "Книга",
+				},
+				Filename: "1.fb2",
+			},
+		},
+		{
+			name:   "truncated line",
+			fields: defaultINPFields,
+			line:   inpLine("", "", " Книга ", "", "", "2", "", "", "", "fb2"),
+			rec: &inpRecord{
+				fb2desc:  fb2desc{Title: "Книга"},
+				Filename: "2.fb2",
+			},
+		},
+		{
+			name:   "folder",
+			fields: custom,
+			line:   inpLine("Иванов", "Книга", "3", "fb2", "fb2-000001-000100.zip", "en-US"),
+			folder: "fb2-000001-000100.zip",
+			rec: &inpRecord{
+				fb2desc: fb2desc{
+					Authors: []author{{LastName: "Иванов"}},
+					Title:   "Книга",
+					Lang:    "en",
+					RawLang: "en-US",
+				},
+				Filename: "3.fb2",
+			},
+		},
+		{
+			name:   "unknown language",
+			fields: custom,
+			line:   inpLine("Иванов", "Книга", "4", "fb2", "", "GRC"),
+			rec: &inpRecord{
+				fb2desc: fb2desc{
+					Authors: []author{{LastName: "Иванов"}},
+					Title:   "Книга",
+					Lang:    "grc",
+					RawLang: "GRC",
+				},
+				Filename: "4.fb2",
+			},
+		},
+		{
+			name:   "malformed language",
+			fields: custom,
+			line:   inpLine("Иванов", "Книга", "4", "fb2", "", "russian"),
+			err:    ErrSkip,
+		},
+		{
+			name:   "not fb2",
+			fields: custom,
+			line:   inpLine("Иванов", "Книга", "5", "pdf", "", "ru"),
+			err:    ErrSkip,
+		},
+		{
+			name:   "no title",
+			fields: custom,
+			line:   inpLine("Иванов", "", "6", "fb2", "", "ru"),
+			err:    ErrNoTitle,
+		},
+	} {
+		folder, rec, err := parseINPLine(tc.line, tc.fields)
+		if err != tc.err {
+			t.Errorf("%s: want error %v, got %v", tc.name, tc.err, err)
+			continue
+		}
+		if folder != tc.folder {
+			t.Errorf("%s: want folder %q, got %q", tc.name, tc.folder, folder)
+		}
+		if !reflect.DeepEqual(rec, tc.rec) {
+			t.Errorf("%s: want\n%+v\ngot\n%+v", tc.name, tc.rec, rec)
+		}
+	}
+}
+
+func TestParseINPLineLanguages(t *testing.T) {
+	defer func() {
+		allowedLanguages, excludedLanguages = nil, nil
+	}()
+
+	line := func(lang string) string {
+		return inpLine("", "", "Книга", "", "", "1", "", "", "", "fb2", "", lang)
+	}
+	for _, tc := range []struct {
+		languages string
+		lang      string
+		indexed   bool
+	}{
+		{"", "", true},
+		{"", "ru", true},
+		{"ru", "", false},
+		{"ru", "RU", true},
+		{"ru", "en", false},
+		{"!en", "", true},
+		{"!en", "eng", false},
+	} {
+		allowedLanguages, excludedLanguages = nil, nil
+		if err := parseLanguages(tc.languages); err != nil {
+			t.Fatal(err)
+		}
+
+		_, _, err := parseINPLine(line(tc.lang), defaultINPFields)
+		if indexed := err == nil; indexed != tc.indexed {
+			t.Errorf("-l %q, language %q: want indexed %v, got %v (%v)", tc.languages, tc.lang, tc.indexed, indexed, err)
+		}
+
+		// An FB2 file without a language follows the same rule.
+		if tc.lang == "" {
+			_, err := ParseDesc(strings.NewReader(`<?xml version="1.0" encoding="utf-8"?>
+<FictionBook><description><title-info><book-title>Книга</book-title></title-info></description></FictionBook>`), "")
+			if indexed := err == nil; indexed != tc.indexed {
+				t.Errorf("-l %q, FB2 without language: want indexed %v, got %v (%v)", tc.languages, tc.indexed, indexed, err)
+			}
+		}
+	}
+}
+
+func TestReadINP(t *testing.T) {
+	data := inpLine("", "", "Первая", "", "", "1", "", "", "", "fb2") + "\r\n" +
+		"\r\n" +
+		inpLine("", "", "Вторая", "", "", "2", "", "", "", "fb2") + "\n" +
+		inpLine("", "", "", "", "", "3", "", "", "", "fb2") + "\n"
+
+	cat := make(map[string][]inpRecord)
+	err := readINP(strings.NewReader(data), defaultINPFields, "lib", "fb2-01.zip", cat)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	records := cat[filepath.Join("lib", "fb2-01.zip")]
+	if len(cat) != 1 || len(records) != 2 {
+		t.Fatalf("want 2 records of lib/fb2-01.zip, got %v", cat)
+	}
+	if records[0].Title != "Первая" || records[1].Filename != "2.fb2" {
+		t.Errorf("got %+v", records)
+	}
+}
+
+func TestImportArchive(t *testing.T) {
+	defer takePendingErrors()
+
+	contents := map[string]string{
+		"1.fb2": strings.Repeat("<p>Первая книга</p>", 100),
+		"2.fb2": "<p>Вторая книга</p>",
+	}
+	name := filepath.Join(t.TempDir(), "fb2-01.zip")
+	f, err := os.Create(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zw := zip.NewWriter(f)
+	for _, fh := range []*zip.FileHeader{
+		{Name: "1.fb2", Method: zip.Deflate, Comment: "a comment"},
+		{Name: "2.fb2", Method: zip.Store, Extra: []byte{0xca, 0xfe, 2, 0, 0, 0}},
+	} {
+		w, err := zw.CreateHeader(fh)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.WriteString(w, contents[fh.Name])
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	records := []inpRecord{
+		{fb2desc: fb2desc{Title: "Первая"}, Filename: "1.fb2"},
+		{fb2desc: fb2desc{Title: "Вторая"}, Filename: "2.fb2"},
+		{fb2desc: fb2desc{Title: "Третья"}, Filename: "3.fb2"},
+	}
+	results := make(chan book, len(records))
+	err = importArchive(name, records, map[string]bool{"1.fb2": true}, results)
+	if err != nil {
+		t.Fatal(err)
+	}
+	close(results)
+
+	var books []book
+	for b := range results {
+		books = append(books, b)
+	}
+	if len(books) != 1 || books[0].Title != "Вторая" {
+		t.Fatalf("want only the book which is not indexed yet, got %+v", books)
+	}
+
+	// The data of a stored entry starts at its offset.
+	b := books[0]
+	data, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.Method != zip.Store || b.CompressedSize != int64(len(contents["2.fb2"])) {
+		t.Fatalf("got method %d, compressed size %d", b.Method, b.CompressedSize)
+	}
+	if got := data[b.Offset : b.Offset+b.CompressedSize]; !bytes.Equal(got, []byte(contents["2.fb2"])) {
+		t.Errorf("the data at the offset %d is %q", b.Offset, got)
+	}
+
+	errs := takePendingErrors()
+	if len(errs) != 1 || errs[0].Filename != "3.fb2" || errs[0].Stage != stageMissing {
+		t.Errorf("want the missing entry reported, got %+v", errs)
+	}
+}
@@ -0,0 +1,237 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// iso639_2 maps ISO 639-2 (both bibliographic and terminological) and
+// ISO 639-3 codes to ISO 639-1.
+var iso639_2 = map[string]string{
+	"abk": "ab",
+	"ave": "ae",
+	"afr": "af",
+	"amh": "am",
+	"ara": "ar", "arb": "ar",
+	"ava": "av",
+	"aym": "ay",
+	"aze": "az", "azj": "az", "azb": "az",
+	"bak": "ba",
+	"bel": "be",
+	"bul": "bg",
+	"bam": "bm",
+	"ben": "bn",
+	"bod": "bo", "tib": "bo",
+	"bre": "br",
+	"bos": "bs",
+	"cat": "ca",
+	"che": "ce",
+	"cos": "co",
+	"cre": "cr",
+	"ces": "cs", "cze": "cs",
+	"chu": "cu",
+	"chv": "cv",
+	"cym": "cy", "wel": "cy",
+	"dan": "da",
+	"deu": "de", "ger": "de",
+	"ewe": "ee",
+	"ell": "el", "gre": "el",
+	"eng": "en",
+	"epo": "eo",
+	"spa": "es",
+	"est": "et", "ekk": "et",
+	"eus": "eu", "baq": "eu",
+	"fas": "fa", "per": "fa", "pes": "fa",
+	"fin": "fi",
+	"fij": "fj",
+	"fao": "fo",
+	"fra": "fr", "fre": "fr",
+	"fry": "fy",
+	"gle": "ga",
+	"gla": "gd",
+	"grn": "gn",
+	"guj": "gu",
+	"glv": "gv",
+	"hau": "ha",
+	"heb": "he",
+	"hin": "hi",
+	"hrv": "hr",
+	"hat": "ht",
+	"hun": "hu",
+	"hye": "hy", "arm": "hy",
+	"her": "hz",
+	"ina": "ia",
+	"ind": "id",
+	"ile": "ie",
+	"ibo": "ig",
+	"ido": "io",
+	"isl": "is", "ice": "is",
+	"ita": "it",
+	"iku": "iu",
+	"jpn": "ja",
+	"jav": "jv",
+	"kat": "ka", "geo": "ka",
+	"kaz": "kk",
+	"kal": "kl",
+	"khm": "km",
+	"kan": "kn",
+	"kor": "ko",
+	"kau": "kr",
+	"kas": "ks",
+	"kur": "ku",
+	"kom": "kv",
+	"kir": "ky",
+	"lat": "la",
+	"ltz": "lb",
+	"lin": "ln",
+	"lao": "lo",
+	"lit": "lt",
+	"lav": "lv", "lvs": "lv",
+	"mlg": "mg",
+	"mri": "mi", "mao": "mi",
+	"mkd": "mk", "mac": "mk",
+	"mal": "ml",
+	"mon": "mn", "khk": "mn",
+	"mol": "mo",
+	"mar": "mr",
+	"msa": "ms", "may": "ms", "zsm": "ms",
+	"mlt": "mt",
+	"mya": "my", "bur": "my",
+	"nau": "na",
+	"nep": "ne", "npi": "ne",
+	"nld": "nl", "dut": "nl",
+	"nor": "no", "nob": "no", "nno": "no",
+	"nav": "nv",
+	"ori": "or", "ory": "or",
+	"oss": "os",
+	"pan": "pa",
+	"pol": "pl",
+	"por": "pt",
+	"que": "qu",
+	"roh": "rm",
+	"run": "rn",
+	"ron": "ro", "rum": "ro",
+	"rus": "ru",
+	"san": "sa",
+	"srd": "sc",
+	"sag": "sg",
+	"slk": "sk", "slo": "sk",
+	"slv": "sl",
+	"som": "so",
+	"sqi": "sq", "alb": "sq", "als": "sq",
+	"srp": "sr",
+	"swe": "sv",
+	"swa": "sw", "swh": "sw",
+	"tel": "te",
+	"tgk": "tg",
+	"tha": "th",
+	"tir": "ti",
+	"tuk": "tk",
+	"tur": "tr",
+	"tat": "tt",
+	"uig": "ug",
+	"ukr": "uk",
+	"urd": "ur",
+	"uzb": "uz", "uzn": "uz",
+	"vie": "vi",
+	"wln": "wa",
+	"wol": "wo",
+	"yid": "yi", "ydd": "yi",
+	"yor": "yo",
+	"zho": "zh", "chi": "zh", "cmn": "zh",
+	"zul": "zu",
+}
+
+var (
+	allowedLanguages  map[string]bool
+	excludedLanguages map[string]bool
+)
+
+// normalizeLanguage returns the ISO 639-1 code for a language tag such as
+// "RU", "rus", "ru-RU" or "en_US". A well-formed code of an unknown language
+// is returned lowercased and without the region, and "" is returned for
+// anything else.
+func normalizeLanguage(lang string) string {
+	lang = strings.ToLower(strings.TrimSpace(lang))
+	if i := strings.IndexAny(lang, "-_"); i >= 0 {
+		lang = lang[:i]
+	}
+
+	if len(lang) < 2 || len(lang) > 3 || strings.Trim(lang, "abcdefghijklmnopqrstuvwxyz") != "" {
+		return ""
+	}
+	if code := iso639_2[lang]; code != "" {
+		return code
+	}
+	return lang
+}
+
+// languageName returns the name of the language given by its code, or the
+// code itself if the language is unknown.
+func languageName(code string) string {
+	if lang := iso639_1[code]; lang != "" {
+		return lang
+	}
+	return code
+}
+
+// parseLanguages parses the -l option: a comma-separated list of languages
+// to index, those prefixed with "!" being excluded instead.
+func parseLanguages(s string) error {
+	for _, l := range strings.Split(s, ",") {
+		l = strings.TrimSpace(l)
+		if l == "" {
+			continue
+		}
+
+		m := &allowedLanguages
+		if strings.HasPrefix(l, "!") {
+			m = &excludedLanguages
+			l = l[1:]
+		}
+
+		code := normalizeLanguage(l)
+		if code == "" {
+			return fmt.Errorf("unknown language: %q", l)
+		}
+
+		if *m == nil {
+			*m = make(map[string]bool)
+		}
+		(*m)[code] = true
+	}
+
+	return nil
+}
+
+// languageAllowed reports whether the books in the language, given as
+// normalized by normalizeLanguage, are to be indexed.
+func languageAllowed(lang string) bool {
+	if lang == "" || excludedLanguages[lang] {
+		return false
+	}
+	return len(allowedLanguages) == 0 || allowedLanguages[lang]
+}
+
+// bookLanguageAllowed reports whether a book is to be indexed, given its
+// language as written in the file or the catalog, and its ISO 639-1 code. A
+// book without a language is indexed unless -l names the languages to index.
+func bookLanguageAllowed(raw, code string) bool {
+	if strings.TrimSpace(raw) == "" {
+		return len(allowedLanguages) == 0
+	}
+	return languageAllowed(code)
+}
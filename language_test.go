@@ -0,0 +1,133 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestNormalizeLanguage(t *testing.T) {
+	for _, tc := range []struct {
+		lang, want string
+	}{
+		{"ru", "ru"},
+		{"RU", "ru"},
+		{" en ", "en"},
+		{"rus", "ru"},
+		{"Eng", "en"},
+		{"ger", "de"},
+		{"deu", "de"},
+		{"chi", "zh"},
+		{"cmn", "zh"},
+		{"nob", "no"},
+		{"ru-RU", "ru"},
+		{"en_US", "en"},
+		{"zho-Hans-CN", "zh"},
+		{"", ""},
+		{"-", ""},
+		{"xx", "xx"},
+		{"xxx", "xxx"},
+		{"GRC-GR", "grc"},
+		{"russian", ""},
+		{"r", ""},
+		{"r1", ""},
+	} {
+		if got := normalizeLanguage(tc.lang); got != tc.want {
+			t.Errorf("normalizeLanguage(%q) = %q, want %q", tc.lang, got, tc.want)
+		}
+	}
+}
+
+func TestParseLanguages(t *testing.T) {
+	defer func() {
+		allowedLanguages, excludedLanguages = nil, nil
+	}()
+
+	for _, tc := range []struct {
+		s                 string
+		allowed, excluded map[string]bool
+		err               bool
+	}{
+		{s: ""},
+		{s: " , "},
+		{
+			s:       "ru,eng, uk-UA",
+			allowed: map[string]bool{"ru": true, "en": true, "uk": true},
+		},
+		{
+			s:        "!en,!deu",
+			excluded: map[string]bool{"en": true, "de": true},
+		},
+		{
+			s:        "ru,!rus, !ENG",
+			allowed:  map[string]bool{"ru": true},
+			excluded: map[string]bool{"ru": true, "en": true},
+		},
+		{
+			s:       "ru,grc",
+			allowed: map[string]bool{"ru": true, "grc": true},
+		},
+		{s: "ru,russian", err: true},
+		{s: "!", err: true},
+		{s: "!!ru", err: true},
+	} {
+		allowedLanguages, excludedLanguages = nil, nil
+		err := parseLanguages(tc.s)
+		if tc.err {
+			if err == nil {
+				t.Errorf("parseLanguages(%q): want an error", tc.s)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseLanguages(%q): %v", tc.s, err)
+			continue
+		}
+		if !reflect.DeepEqual(allowedLanguages, tc.allowed) || !reflect.DeepEqual(excludedLanguages, tc.excluded) {
+			t.Errorf("parseLanguages(%q): got allowed %v, excluded %v, want %v, %v",
+				tc.s, allowedLanguages, excludedLanguages, tc.allowed, tc.excluded)
+		}
+	}
+}
+
+func TestLanguageAllowed(t *testing.T) {
+	defer func() {
+		allowedLanguages, excludedLanguages = nil, nil
+	}()
+
+	for _, tc := range []struct {
+		languages string
+		lang      string
+		allowed   bool
+	}{
+		{"", "ru", true},
+		{"", "", false},
+		{"ru,en", "en", true},
+		{"ru,en", "de", false},
+		{"!en", "ru", true},
+		{"!en", "en", false},
+		{"ru,!ru", "ru", false},
+		{"", "grc", true},
+		{"!grc", "grc", false},
+	} {
+		allowedLanguages, excludedLanguages = nil, nil
+		if err := parseLanguages(tc.languages); err != nil {
+			t.Fatal(err)
+		}
+		if got := languageAllowed(tc.lang); got != tc.allowed {
+			t.Errorf("-l %q: languageAllowed(%q) = %v, want %v", tc.languages, tc.lang, got, tc.allowed)
+		}
+	}
+}
@@ -19,26 +19,28 @@ import (
 	"os"
 	"path/filepath"
 	"runtime"
-	"strings"
 	"time"
 )
 
 var (
-	dataSource = flag.String("db", "file::memory:?cache=shared", "SQLite database")
-	addr       = flag.String("http", "127.0.0.1:8080", "HTTP service address")
-	recursive  = flag.Bool("r", false, "Recursively search for .zip files")
-	parallel   = flag.Int("j", runtime.NumCPU(), "Number of parallel jobs")
-	languages  = flag.String("l", "", "Comma-separated languages (default: all)")
+	dataSource  = flag.String("db", "file::memory:?cache=shared", "SQLite database")
+	addr        = flag.String("http", "127.0.0.1:8080", "HTTP service address")
+	recursive   = flag.Bool("r", false, "Recursively search for .zip and .fb2 files")
+	parallel    = flag.Int("j", runtime.NumCPU(), "Number of parallel jobs")
+	languages   = flag.String("l", "", "Comma-separated languages, !lang to exclude one (default: all)")
+	inpxPath    = flag.String("inpx", "", "Import books from INPX catalog")
+	fullText    = flag.Bool("fulltext", false, "Index the texts of the books for full-text search")
+	genresPath  = flag.String("genres", "", "Load the genre list from JSON file (default: built-in)")
+	genreLang   = flag.String("genre-lang", "ru", "Language of the genre descriptions")
+	migrateOnly = flag.Bool("migrate-only", false, "Migrate the database schema and exit")
+	boosts      = flag.String("boost", "", "Comma-separated weights of the book fields in search (default: title=2,author=1.5,translator=0.5,series=1)")
+	folds       = flag.String("fold", "", "Comma-separated letter=string folding rules for search, letter= to remove one")
 
 	booksPerPage     = flag.Int("bpp", 50, "Books per page")
 	authorsPerPage   = flag.Int("app", 50, "Authors per page")
 	sequencesPerPage = flag.Int("spp", 50, "Sequences per page")
 
 	cssPath = flag.String("css", "", "Use CSS file")
-
-	allowedLanguages []string
-
-	indexed int
 )
 
 func isRegular(fi os.FileInfo) bool {
@@ -51,7 +53,7 @@ func walker(index func(string)) filepath.WalkFunc {
 			return nil
 		}
 
-		if !strings.HasSuffix(path, ".zip") {
+		if !isZIP(path) && !isFB2(path) {
 			return nil
 		}
 
@@ -61,30 +63,14 @@ func walker(index func(string)) filepath.WalkFunc {
 	}
 }
 
-func main() {
-	log.SetFlags(0)
-	flag.Parse()
-	if *languages != "" {
-		allowedLanguages = strings.Split(*languages, ",")
-	}
-
-	initDB()
-	ch, done := startInsertWorker()
-
-	index := func(name string) {
-		start := time.Now()
-		err := indexZIP(name, ch)
-		if err != nil {
-			log.Printf("%s: open: %v", name, err)
-		} else {
-			log.Printf("Indexed %s in %v\n", name, time.Since(start))
-			indexed++
-		}
+// findArchives returns the archives and FB2 files found in paths.
+func findArchives(paths []string) []string {
+	var names []string
+	add := func(name string) {
+		names = append(names, name)
 	}
 
-	start := time.Now()
-
-	for _, path := range flag.Args() {
+	for _, path := range paths {
 		if *recursive {
 			fi, err := os.Stat(path)
 			if err != nil {
@@ -93,21 +79,138 @@ func main() {
 			}
 
 			if fi.IsDir() {
-				filepath.Walk(path, walker(index))
+				filepath.Walk(path, walker(add))
 				continue
 			}
 		}
 
-		if !strings.HasSuffix(path, ".zip") {
-			log.Printf("%s: not a .zip file", path)
+		if !isZIP(path) && !isFB2(path) {
+			log.Printf("%s: not a .zip or .fb2 file", path)
 			continue
 		}
 
-		index(path)
+		add(path)
+	}
+
+	return names
+}
+
+// indexArchives indexes the pending archives, skipping the already indexed
+// entries, and records the archives once their books are committed. An
+// archive some of whose books could not be added is not recorded, so that it
+// is indexed again on the next scan. It returns the number of archives
+// indexed.
+func indexArchives(pending []archive, indexedEntries map[string]map[string]bool, books chan<- book, flush chan<- chan flushResult) int {
+	var archives []archive
+	for _, a := range pending {
+		start := time.Now()
+		var err error
+		if records, ok := catalogRecords(a.Name); ok {
+			err = importArchive(a.Name, records, indexedEntries[a.Name], books)
+		} else if isFB2(a.Name) {
+			err = indexFile(a.Name, books)
+		} else {
+			err = indexZIP(a.Name, indexedEntries[a.Name], books)
+		}
+		if err != nil {
+			reportIndexError(a.Name, "", stageOpen, err)
+		} else {
+			log.Printf("Indexed %s in %v\n", a.Name, time.Since(start))
+			archives = append(archives, a)
+		}
+	}
+
+	reply := make(chan flushResult)
+	flush <- reply
+	res := <-reply
+	if res.err != nil {
+		return 0
+	}
+
+	indexed := archives[:0]
+	for _, a := range archives {
+		if res.failed[a.Name] {
+			log.Printf("%s: some books were not added, the archive will be indexed again", a.Name)
+			continue
+		}
+		indexed = append(indexed, a)
 	}
+	archives = indexed
 
-	close(ch)
-	<-done
+	err := store.RecordArchives(archives)
+	if err != nil {
+		log.Printf("Failed to record archives: %v", err)
+	}
+
+	return len(archives)
+}
+
+func main() {
+	log.SetFlags(0)
+	flag.Parse()
+	err := parseLanguages(*languages)
+	if err != nil {
+		log.Fatalf("-l: %v", err)
+	}
+
+	err = parseBoosts(*boosts)
+	if err != nil {
+		log.Fatalf("-boost: %v", err)
+	}
+
+	err = parseFolds(*folds)
+	if err != nil {
+		log.Fatalf("-fold: %v", err)
+	}
+
+	err = loadGenres()
+	if err != nil {
+		log.Fatalf("genres: %v", err)
+	}
+
+	if *migrateOnly {
+		conn, err := openSQLite(*dataSource)
+		if err != nil {
+			log.Fatal(err)
+		}
+		conn.Close()
+		log.Printf("The database schema is at version %d", len(migrations))
+		return
+	}
+
+	db, err := newSQLiteStore(*dataSource)
+	if err != nil {
+		log.Fatal(err)
+	}
+	store = db
+
+	start := time.Now()
+
+	names := findArchives(flag.Args())
+	if *inpxPath != "" {
+		_, _, err := loadCatalog(*inpxPath)
+		if err != nil {
+			log.Fatalf("%s: %v", *inpxPath, err)
+		}
+		names = append(names, catalogArchives()...)
+	}
+
+	pending, indexedEntries, err := store.ScanArchives(names)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	ch, flush, done := startInsertWorker()
+
+	indexed := indexArchives(pending, indexedEntries, ch, flush)
+	db.saveTrigramIndexes()
+
+	if *watch {
+		go watchArchives(flag.Args(), ch, flush)
+	} else {
+		close(ch)
+		<-done
+	}
 
 	log.Printf("Indexed %d file(s) in %v", indexed, time.Since(start))
 	log.Printf("Server listening on %s", *addr)
@@ -0,0 +1,423 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/opennota/fb2index/trigram"
+)
+
+// searchQuery is a parsed search query, such as
+//
+//	Иванов author:"Пётр Иванов" -series:Полдень lang:en -genre:sf_space
+//
+// The words and quoted phrases are matched against the titles, the names
+// of the authors and translators and the names of the series of the books,
+// or only one of them if prefixed with title:, author:, translator: or
+// series:. The lang: and genre: filters keep only the books in one of the
+// languages and one of the genres given. A term or a filter prefixed with
+// "-" excludes the books which match it instead.
+type searchQuery struct {
+	terms     []queryTerm
+	langs     []string
+	genres    []string
+	notLangs  []string
+	notGenres []string
+}
+
+// queryTerm is a word or a phrase of a search query. The unquoted words
+// without a field, which are matched together, are kept as one term.
+type queryTerm struct {
+	field   string // "title", "author", etc., or "" for any
+	text    string
+	phrase  bool
+	exclude bool
+}
+
+// queryFields are the fields a term can be restricted to, with the fields of
+// the book index they are looked up in.
+var queryFields = map[string]trigram.Field{
+	"title":      fieldTitle,
+	"author":     fieldAuthor,
+	"translator": fieldTranslator,
+	"series":     fieldSequence,
+}
+
+// queryTokens splits the query into tokens at whitespace outside of quotes.
+func queryTokens(s string) []string {
+	var tokens []string
+	var b strings.Builder
+	quoted := false
+	for _, r := range s {
+		switch {
+		case r == '"':
+			quoted = !quoted
+			b.WriteRune(r)
+		case unicode.IsSpace(r) && !quoted:
+			if b.Len() > 0 {
+				tokens = append(tokens, b.String())
+				b.Reset()
+			}
+		default:
+			b.WriteRune(r)
+		}
+	}
+	if b.Len() > 0 {
+		tokens = append(tokens, b.String())
+	}
+	return tokens
+}
+
+// parseQuery parses a search query. Anything which is not valid syntax,
+// such as an unknown field, is taken as words to look for.
+func parseQuery(s string) searchQuery {
+	var q searchQuery
+	var words []string
+
+	tokens := queryTokens(s)
+	for i := 0; i < len(tokens); i++ {
+		tok := tokens[i]
+
+		exclude := false
+		if len(tok) > 1 && tok[0] == '-' {
+			exclude = true
+			tok = tok[1:]
+		}
+
+		field := ""
+		if j := strings.IndexByte(tok, ':'); j > 0 {
+			name := strings.ToLower(tok[:j])
+			if _, ok := queryFields[name]; ok || name == "lang" || name == "genre" {
+				field = name
+				tok = tok[j+1:]
+				// "author: Толстой"
+				if tok == "" && i+1 < len(tokens) {
+					i++
+					tok = tokens[i]
+				}
+			}
+		}
+
+		phrase := false
+		if strings.HasPrefix(tok, `"`) {
+			phrase = true
+			tok = strings.Trim(tok, `"`)
+		}
+		if strings.TrimSpace(tok) == "" {
+			continue
+		}
+
+		switch field {
+		case "lang":
+			lang := normalizeLanguage(tok)
+			if lang == "" {
+				lang = strings.ToLower(tok)
+			}
+			if exclude {
+				q.notLangs = append(q.notLangs, lang)
+			} else {
+				q.langs = append(q.langs, lang)
+			}
+			continue
+		case "genre":
+			genre := normalizeGenre(tok)
+			if exclude {
+				q.notGenres = append(q.notGenres, genre)
+			} else {
+				q.genres = append(q.genres, genre)
+			}
+			continue
+		}
+
+		if foldText(tok) == "" {
+			continue
+		}
+
+		if field == "" && !phrase && !exclude {
+			words = append(words, tok)
+			continue
+		}
+		q.terms = append(q.terms, queryTerm{
+			field:   field,
+			text:    tok,
+			phrase:  phrase,
+			exclude: exclude,
+		})
+	}
+
+	if len(words) > 0 {
+		q.terms = append([]queryTerm{{text: strings.Join(words, " ")}}, q.terms...)
+	}
+
+	return q
+}
+
+// text returns the words and phrases of the terms without a field, to be
+// looked for in the annotations and elsewhere.
+func (q *searchQuery) text() string {
+	var ss []string
+	for _, t := range q.terms {
+		if t.field == "" && !t.exclude {
+			ss = append(ss, t.text)
+		}
+	}
+	return strings.Join(ss, " ")
+}
+
+// fieldText returns the words and phrases of the terms in any of the fields.
+func (q *searchQuery) fieldText(fields ...string) string {
+	var ss []string
+	for _, t := range q.terms {
+		for _, f := range fields {
+			if t.field == f && !t.exclude {
+				ss = append(ss, t.text)
+			}
+		}
+	}
+	return strings.Join(ss, " ")
+}
+
+// hasFilters reports whether the query has any lang: or genre: filters.
+func (q *searchQuery) hasFilters() bool {
+	return len(q.langs)+len(q.genres)+len(q.notLangs)+len(q.notGenres) > 0
+}
+
+// foldText folds s like the trigram index does (see trigram.Fold) and keeps
+// only its words, separated by single spaces, so that a phrase can be looked
+// for in a string.
+func foldText(s string) string {
+	return strings.Join(strings.FieldsFunc(trigram.Fold(s), func(r rune) bool { return !isWordRune(r) }), " ")
+}
+
+// shadowText is foldText of the shadow form of s (see trigram.Translit).
+func shadowText(s string) string {
+	return foldText(trigram.Translit(s))
+}
+
+// containsText reports whether the phrase is in s as whole words, as is or
+// in the shadow form.
+func containsText(s, phrase string) bool {
+	return strings.Contains(" "+foldText(s)+" ", " "+foldText(phrase)+" ") ||
+		strings.Contains(" "+shadowText(s)+" ", " "+shadowText(phrase)+" ")
+}
+
+// authorNames returns the name of the author as "first middle last" and
+// "last first middle", along with the nickname.
+func authorNames(a author) []string {
+	return []string{
+		a.FirstName + " " + a.MiddleName + " " + a.LastName,
+		a.LastName + " " + a.FirstName + " " + a.MiddleName,
+		a.Nickname,
+	}
+}
+
+// fieldStrings returns the strings of the book in the field of a term.
+func fieldStrings(b *book, field string) []string {
+	var ss []string
+	if field == "" || field == "title" {
+		ss = append(ss, b.Title)
+	}
+	if field == "" || field == "author" {
+		for _, a := range b.Authors {
+			ss = append(ss, authorNames(a)...)
+		}
+	}
+	if field == "" || field == "translator" {
+		for _, a := range b.Translators {
+			ss = append(ss, authorNames(a)...)
+		}
+	}
+	if field == "" || field == "series" {
+		for _, s := range b.Sequences {
+			ss = append(ss, s.Name)
+		}
+	}
+	return ss
+}
+
+// matches reports whether the book has the phrase of the term in its field.
+// The words of a term which is not a phrase can be anywhere in the field.
+// The shadow forms of the words match too.
+func (t *queryTerm) matches(b *book) bool {
+	ss := fieldStrings(b, t.field)
+	if t.phrase {
+		for _, s := range ss {
+			if containsText(s, t.text) {
+				return true
+			}
+		}
+		return false
+	}
+
+	all := strings.Join(ss, " ")
+	folded, shadow := foldText(all), shadowText(all)
+	for _, w := range strings.Fields(t.text) {
+		if !strings.Contains(folded, foldText(w)) && !strings.Contains(shadow, shadowText(w)) {
+			return false
+		}
+	}
+	return true
+}
+
+// filter reports whether the book passes the checks which the trigram index
+// cannot do: its phrases are there, and its excluded terms are not.
+func (q *searchQuery) filter(b *book) bool {
+	for i := range q.terms {
+		t := &q.terms[i]
+		if t.exclude {
+			if t.matches(b) {
+				return false
+			}
+		} else if t.phrase && !t.matches(b) {
+			return false
+		}
+	}
+	return true
+}
+
+// distance returns how far the book is from the terms of the query which are
+// not excluded, in the edit distance of their words (see
+// trigram.WordsDistance) from the closest words of their fields.
+func (q *searchQuery) distance(b *book) int {
+	d := 0
+	for _, t := range q.terms {
+		if !t.exclude {
+			d += trigram.WordsDistance(t.text, fieldStrings(b, t.field)...)
+		}
+	}
+	return d
+}
+
+// byDistance sorts anything by the distances of its items from the query,
+// swap swapping the items themselves. Sorted stably, the items at the same
+// distance stay in the order of their scores.
+type byDistance struct {
+	d    []int
+	swap func(i, j int)
+}
+
+func (s byDistance) Len() int           { return len(s.d) }
+func (s byDistance) Less(i, j int) bool { return s.d[i] < s.d[j] }
+func (s byDistance) Swap(i, j int) {
+	s.d[i], s.d[j] = s.d[j], s.d[i]
+	s.swap(i, j)
+}
+
+// minSuggestLen is the length of the shortest word which is corrected.
+const minSuggestLen = 4
+
+// maxTypos returns the greatest distance from the misspelled word of the
+// words suggested for it.
+func maxTypos(w string) int {
+	if utf8.RuneCountInString(w) <= 5 {
+		return 1
+	}
+	return 2
+}
+
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// closestWord returns the word of the names closest to the misspelled word w,
+// or "" if there is none close enough, or if w is one of the words of the
+// names or of the other strings known.
+func closestWord(w string, names, known []string) string {
+	fw := foldText(w)
+	if utf8.RuneCountInString(fw) < minSuggestLen {
+		return ""
+	}
+	for _, s := range known {
+		for _, k := range strings.Fields(foldText(s)) {
+			if k == fw {
+				return ""
+			}
+		}
+	}
+
+	best, dist := "", maxTypos(fw)+1
+	for _, s := range names {
+		for _, n := range strings.FieldsFunc(s, func(r rune) bool { return !isWordRune(r) }) {
+			if foldText(n) == fw {
+				return ""
+			}
+			if d := trigram.WordDistance(w, n); d < dist {
+				best, dist = n, d
+			}
+		}
+	}
+	return best
+}
+
+// suggestion returns the query with the words for which fix returns another
+// word replaced, or "" if there are none. The field names and the lang: and
+// genre: filters are left as they are.
+func suggestion(query string, fix func(w string) (string, error)) (string, error) {
+	tokens := queryTokens(query)
+	changed := false
+	for i, tok := range tokens {
+		start := 0
+		if len(tok) > 1 && tok[0] == '-' {
+			start = 1
+		}
+		if j := strings.IndexByte(tok[start:], ':'); j > 0 {
+			name := strings.ToLower(tok[start : start+j])
+			if name == "lang" || name == "genre" {
+				continue
+			}
+			if _, ok := queryFields[name]; ok {
+				start += j + 1
+			}
+		}
+
+		var b strings.Builder
+		b.WriteString(tok[:start])
+		rest := tok[start:]
+		for rest != "" {
+			j := strings.IndexFunc(rest, isWordRune)
+			if j < 0 {
+				b.WriteString(rest)
+				break
+			}
+			b.WriteString(rest[:j])
+			rest = rest[j:]
+
+			j = strings.IndexFunc(rest, func(r rune) bool { return !isWordRune(r) })
+			if j < 0 {
+				j = len(rest)
+			}
+			w := rest[:j]
+			rest = rest[j:]
+
+			fixed, err := fix(w)
+			if err != nil {
+				return "", err
+			}
+			if fixed != "" {
+				w = fixed
+				changed = true
+			}
+			b.WriteString(w)
+		}
+		tokens[i] = b.String()
+	}
+
+	if !changed {
+		return "", nil
+	}
+	return strings.Join(tokens, " "), nil
+}
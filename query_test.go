@@ -0,0 +1,153 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestQueryTokens(t *testing.T) {
+	for _, tc := range []struct {
+		s    string
+		want []string
+	}{
+		{"", nil},
+		{"  \t ", nil},
+		{"лев  толстой", []string{"лев", "толстой"}},
+		{`author:"Лев Толстой" мир`, []string{`author:"Лев Толстой"`, "мир"}},
+		{`"война  и мир"`, []string{`"война  и мир"`}},
+		{`"война и мир`, []string{`"война и мир`}},
+		{`а"б в"г`, []string{`а"б в"г`}},
+	} {
+		if got := queryTokens(tc.s); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("queryTokens(%q) = %q, want %q", tc.s, got, tc.want)
+		}
+	}
+}
+
+func TestParseQuery(t *testing.T) {
+	for _, tc := range []struct {
+		s    string
+		want searchQuery
+	}{
+		{"", searchQuery{}},
+		{
+			"война и мир",
+			searchQuery{terms: []queryTerm{{text: "война и мир"}}},
+		},
+		{
+			`Иванов author:"Пётр Иванов" -series:Полдень lang:en -genre:sf_space`,
+			searchQuery{
+				terms: []queryTerm{
+					{text: "Иванов"},
+					{field: "author", text: "Пётр Иванов", phrase: true},
+					{field: "series", text: "Полдень", exclude: true},
+				},
+				langs:     []string{"en"},
+				notGenres: []string{"sf_space"},
+			},
+		},
+		{
+			// The words without a field are kept together, ahead of the
+			// other terms.
+			"title:мир война -толстой лев",
+			searchQuery{terms: []queryTerm{
+				{text: "война лев"},
+				{field: "title", text: "мир"},
+				{text: "толстой", exclude: true},
+			}},
+		},
+		{
+			`"война и мир" TITLE:Анна Translator:  Пастернак`,
+			searchQuery{terms: []queryTerm{
+				{text: "война и мир", phrase: true},
+				{field: "title", text: "Анна"},
+				{field: "translator", text: "Пастернак"},
+			}},
+		},
+		{
+			"lang:rus lang:EN-us -lang:xx genre:sf",
+			searchQuery{
+				langs:    []string{"ru", "en"},
+				notLangs: []string{"xx"},
+				genres:   []string{"sf"},
+			},
+		},
+		{
+			// An unknown field is a word.
+			"foo:bar http://example.com",
+			searchQuery{terms: []queryTerm{{text: "foo:bar http://example.com"}}},
+		},
+		{
+			// An unclosed quote makes a phrase of the rest.
+			`author:"Лев Толстой`,
+			searchQuery{terms: []queryTerm{{field: "author", text: "Лев Толстой", phrase: true}}},
+		},
+		{
+			// The terms without words are dropped.
+			`- "" -title:"" series:!!! author:`,
+			searchQuery{},
+		},
+		{"lang:", searchQuery{}},
+		{
+			"author: Толстой",
+			searchQuery{terms: []queryTerm{{field: "author", text: "Толстой"}}},
+		},
+		{
+			":мир -:война",
+			searchQuery{terms: []queryTerm{
+				{text: ":мир"},
+				{text: ":война", exclude: true},
+			}},
+		},
+	} {
+		if got := parseQuery(tc.s); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("parseQuery(%q):\ngot  %+v\nwant %+v", tc.s, got, tc.want)
+		}
+	}
+}
+
+func TestQueryFilter(t *testing.T) {
+	b := &book{
+		fb2desc: fb2desc{
+			Title:     "Война и мир",
+			Authors:   []author{{FirstName: "Лев", LastName: "Толстой"}},
+			Sequences: []sequence{{Name: "Эпопея"}},
+		},
+	}
+
+	for _, tc := range []struct {
+		s    string
+		want bool
+	}{
+		{"война", true},
+		{`"война и мир"`, true},
+		{`"мир и война"`, false},
+		{`title:"война и мир"`, true},
+		{`author:"война и мир"`, false},
+		{`author:"Толстой Лев"`, true},
+		{`author:"лев толстой"`, true},
+		{"-author:толстой", false},
+		{"-author:тургенев", true},
+		{"-series:эпопея", false},
+		{"-title:voina", false},
+		{"война -мир", false},
+	} {
+		q := parseQuery(tc.s)
+		if got := q.filter(b); got != tc.want {
+			t.Errorf("%q: filter = %v, want %v", tc.s, got, tc.want)
+		}
+	}
+}
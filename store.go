@@ -0,0 +1,90 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import "database/sql"
+
+// ErrNoRows is returned by the lookups of a store when there is no such
+// book, author, etc.
+var ErrNoRows = sql.ErrNoRows
+
+// Store keeps the library. The HTTP handlers and the indexer only use the
+// store, never the database directly.
+type Store interface {
+	// Books. The paged lookups also return the total number of pages.
+	BooksPerPage(n int) ([]book, int, error)
+	BooksByGenre(id uint32) ([]book, *genre, error)
+	BooksByAuthor(id uint32) ([]book, []book, *author, error)
+	BooksBySequence(id uint32) ([]book, *sequence, error)
+	BooksByLanguage(code string, n int) ([]book, int, error)
+	BookByID(id uint32) (*book, error)
+	// BookDetailsByID is BookByID with the publish and document info.
+	BookDetailsByID(id uint32) (*book, error)
+	SetBookEncoding(id uint32, enc string) error
+
+	Genres() ([]genre, error)
+	Languages() ([]language, error)
+
+	AuthorsPerPage(n int) ([]author, int, error)
+	AuthorByID(id uint32) (*author, error)
+	AuthorAliases(id uint32) ([]author, error)
+	MergeAuthors(into, from uint32) error
+	MergeCandidates(limit int) ([]mergeCandidate, error)
+
+	SequencesPerPage(kind, n int) ([]sequence, int, error)
+	SequenceByID(id uint32) (*sequence, error)
+	SequenceAncestors(s *sequence) ([]sequence, error)
+
+	Search(query string) ([]author, []sequence, []book, []annotationMatch, error)
+	SearchText(query string) ([]textMatch, error)
+	// Suggest returns the query with its misspelled words corrected, or ""
+	// if there are none.
+	Suggest(query string) (string, error)
+
+	IndexErrorGroups() ([]indexErrorGroup, error)
+	IndexErrors(stage, archive string) ([]indexError, error)
+	IndexErrorByID(id uint32) (*indexError, error)
+
+	// ScanArchives compares the given archives with the recorded ones, and
+	// returns those to be indexed along with their already indexed entries.
+	ScanArchives(names []string) ([]archive, map[string]map[string]bool, error)
+	// RecordArchives records the archives as indexed.
+	RecordArchives(archives []archive) error
+	// RemoveArchives removes the books of the archives and forgets that the
+	// archives were indexed, so that they are indexed anew even if they have
+	// not changed.
+	RemoveArchives(names []string) error
+	// AddBook adds the book. The books are not guaranteed to be visible
+	// until Flush is called. AddBook and Flush are only called by the
+	// insert worker.
+	AddBook(b book) error
+	// Flush commits the added books and the queued index errors.
+	Flush() error
+}
+
+var store Store
+
+func BookByIDWithAnnotation(id uint32) (*book, string, string, error) {
+	b, err := store.BookDetailsByID(id)
+	if err != nil {
+		return nil, "", "", err
+	}
+
+	ann, cover, err := b.AnnotationAndCover()
+	if err != nil {
+		return nil, "", "", err
+	}
+
+	return b, ann, cover, nil
+}
@@ -0,0 +1,1096 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/opennota/fb2index/trigram"
+)
+
+// memStore is a Store kept in memory, for tests. Searches match substrings
+// instead of trigrams and words.
+type memStore struct {
+	mu sync.RWMutex
+
+	// The last IDs given to the books, genres, etc.
+	lastBook, lastGenre, lastAuthor, lastSequence, lastError uint32
+
+	books     map[uint32]*book
+	genres    map[uint32]*genre
+	authors   map[uint32]*author
+	aliases   map[string]memAlias
+	sequences map[uint32]*sequence
+	archives  map[string]archive
+	errors    []indexError
+}
+
+var _ Store = (*memStore)(nil)
+
+// memAlias is a name of an author merged into another one.
+type memAlias struct {
+	author
+	AuthorID uint32
+}
+
+func newMemStore() *memStore {
+	m := &memStore{
+		books:     make(map[uint32]*book),
+		genres:    make(map[uint32]*genre),
+		authors:   make(map[uint32]*author),
+		aliases:   make(map[string]memAlias),
+		sequences: make(map[uint32]*sequence),
+		archives:  make(map[string]archive),
+	}
+
+	for name, g := range genres.Genres {
+		id := nextID(&m.lastGenre)
+		m.genres[id] = &genre{
+			ID:   id,
+			Name: name,
+			Desc: localized(g.Desc),
+			Meta: localized(genres.Meta[g.Meta]),
+		}
+	}
+
+	return m
+}
+
+func nextID(last *uint32) uint32 {
+	*last++
+	return *last
+}
+
+// page returns the n-th page of the items, given their number, and the total
+// number of pages.
+func page(count, perPage, n int) (from, to, numPages int) {
+	numPages = (count + perPage - 1) / perPage
+	from = (n - 1) * perPage
+	if from > count {
+		from = count
+	}
+	to = from + perPage
+	if to > count {
+		to = count
+	}
+	return from, to, numPages
+}
+
+func authorLess(a, b author) bool {
+	if a.LastName != b.LastName {
+		return a.LastName < b.LastName
+	}
+	if a.FirstName != b.FirstName {
+		return a.FirstName < b.FirstName
+	}
+	return a.Nickname < b.Nickname
+}
+
+func (m *memStore) relatedAuthors(ids []author) []author {
+	authors := make([]author, 0, len(ids))
+	for _, a := range ids {
+		if au := m.authors[a.ID]; au != nil {
+			authors = append(authors, *au)
+		}
+	}
+	sort.SliceStable(authors, func(i, j int) bool {
+		return authorLess(authors[i], authors[j])
+	})
+	return authors
+}
+
+// get returns a copy of the book with its relations, as the lookups of the
+// SQLite store do.
+func (m *memStore) get(b *book) book {
+	r := *b
+	r.Annotation = ""
+	r.PublishInfo = publishInfo{}
+	r.DocumentInfo = documentInfo{}
+	r.Text = nil
+
+	r.Genres = make([]genre, 0, len(b.Genres))
+	for _, g := range b.Genres {
+		ge := *m.genres[g.ID]
+		ge.BookCount = 0
+		r.Genres = append(r.Genres, ge)
+	}
+	sort.SliceStable(r.Genres, func(i, j int) bool {
+		return r.Genres[i].Desc < r.Genres[j].Desc
+	})
+
+	r.Authors = m.relatedAuthors(b.Authors)
+	r.Translators = m.relatedAuthors(b.Translators)
+
+	r.Sequences = make([]sequence, 0, len(b.Sequences))
+	for _, s := range b.Sequences {
+		seq := *m.sequences[s.ID]
+		seq.Children = nil
+		seq.Number = s.Number
+		seq.Position = s.Position
+		r.Sequences = append(r.Sequences, seq)
+	}
+	sort.SliceStable(r.Sequences, func(i, j int) bool {
+		si, sj := r.Sequences[i], r.Sequences[j]
+		if si.Kind != sj.Kind {
+			return si.Kind < sj.Kind
+		}
+		if si.Name != sj.Name {
+			return si.Name < sj.Name
+		}
+		return si.Position < sj.Position
+	})
+
+	return r
+}
+
+// booksWhere returns the books for which f returns true, sorted by title.
+func (m *memStore) booksWhere(f func(b *book) bool) []book {
+	var books []book
+	for _, b := range m.books {
+		if f(b) {
+			books = append(books, m.get(b))
+		}
+	}
+	sort.Slice(books, func(i, j int) bool {
+		if books[i].Title != books[j].Title {
+			return books[i].Title < books[j].Title
+		}
+		return books[i].ID < books[j].ID
+	})
+	return books
+}
+
+func hasAuthor(authors []author, id uint32) bool {
+	for _, a := range authors {
+		if a.ID == id {
+			return true
+		}
+	}
+	return false
+}
+
+func hasSequence(sequences []sequence, id uint32) bool {
+	for _, s := range sequences {
+		if s.ID == id {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *memStore) BooksPerPage(n int) ([]book, int, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	books := m.booksWhere(func(*book) bool { return true })
+	from, to, numPages := page(len(books), *booksPerPage, n)
+	return books[from:to], numPages, nil
+}
+
+func (m *memStore) BooksByGenre(id uint32) ([]book, *genre, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	g := m.genres[id]
+	if g == nil {
+		return nil, nil, ErrNoRows
+	}
+
+	books := m.booksWhere(func(b *book) bool {
+		for _, g := range b.Genres {
+			if g.ID == id {
+				return true
+			}
+		}
+		return false
+	})
+
+	ge := *g
+	ge.BookCount = 0
+	return books, &ge, nil
+}
+
+func (m *memStore) BooksByAuthor(id uint32) ([]book, []book, *author, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	a := m.authors[id]
+	if a == nil {
+		return nil, nil, nil, ErrNoRows
+	}
+
+	books := m.booksWhere(func(b *book) bool { return hasAuthor(b.Authors, id) })
+	translations := m.booksWhere(func(b *book) bool { return hasAuthor(b.Translators, id) })
+
+	au := *a
+	return books, translations, &au, nil
+}
+
+func (m *memStore) BooksBySequence(id uint32) ([]book, *sequence, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	s := m.sequences[id]
+	if s == nil {
+		return nil, nil, ErrNoRows
+	}
+
+	seq := *s
+	seq.Children = m.sequenceChildren(id)
+
+	books := m.booksWhere(func(b *book) bool { return hasSequence(b.Sequences, id) })
+	for i := range books {
+		sequences := books[i].Sequences
+		for j := 1; j < len(sequences); j++ {
+			if sequences[j].ID == id {
+				sequences[0], sequences[j] = sequences[j], sequences[0]
+				break
+			}
+		}
+	}
+	sort.Stable(booksBySequence(books))
+
+	return books, &seq, nil
+}
+
+func (m *memStore) BooksByLanguage(code string, n int) ([]book, int, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	books := m.booksWhere(func(b *book) bool { return b.Lang == code })
+	from, to, numPages := page(len(books), *booksPerPage, n)
+	return books[from:to], numPages, nil
+}
+
+func (m *memStore) BookByID(id uint32) (*book, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	b := m.books[id]
+	if b == nil {
+		return nil, ErrNoRows
+	}
+
+	r := m.get(b)
+	return &r, nil
+}
+
+func (m *memStore) BookDetailsByID(id uint32) (*book, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	b := m.books[id]
+	if b == nil {
+		return nil, ErrNoRows
+	}
+
+	r := m.get(b)
+	r.PublishInfo = b.PublishInfo
+	r.DocumentInfo = b.DocumentInfo
+	return &r, nil
+}
+
+func (m *memStore) SetBookEncoding(id uint32, enc string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	b := m.books[id]
+	if b == nil {
+		return ErrNoRows
+	}
+
+	desc := !inCatalog(b)
+	nb, err := rereadBook(*b, enc, desc)
+	if err != nil {
+		return err
+	}
+	if !desc {
+		b.Encoding = nb.Encoding
+		if nb.Text != nil {
+			b.Text = nb.Text
+		}
+		return nil
+	}
+
+	if nb.Text == nil {
+		nb.Text = b.Text
+	}
+	m.link(&nb)
+	m.books[id] = &nb
+	m.removeOrphans()
+
+	return nil
+}
+
+func (m *memStore) Genres() ([]genre, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	counts := make(map[uint32]int)
+	for _, b := range m.books {
+		for _, g := range b.Genres {
+			counts[g.ID]++
+		}
+	}
+
+	list := make([]genre, 0, len(m.genres))
+	for _, g := range m.genres {
+		ge := *g
+		ge.BookCount = counts[g.ID]
+		list = append(list, ge)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		gi, gj := list[i], list[j]
+		if gi.Meta != gj.Meta {
+			return gi.Meta < gj.Meta
+		}
+		if gi.Desc != gj.Desc {
+			return gi.Desc < gj.Desc
+		}
+		return gi.Name < gj.Name
+	})
+
+	return list, nil
+}
+
+func (m *memStore) Languages() ([]language, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	counts := make(map[string]int)
+	for _, b := range m.books {
+		if b.Lang != "" {
+			counts[b.Lang]++
+		}
+	}
+
+	languages := make([]language, 0, len(counts))
+	for code, n := range counts {
+		languages = append(languages, language{Code: code, BookCount: n})
+	}
+	sort.Slice(languages, func(i, j int) bool {
+		li, lj := languages[i], languages[j]
+		if li.BookCount != lj.BookCount {
+			return li.BookCount > lj.BookCount
+		}
+		return li.Code < lj.Code
+	})
+
+	return languages, nil
+}
+
+func (m *memStore) authorBookCount(id uint32) int {
+	n := 0
+	for _, b := range m.books {
+		if hasAuthor(b.Authors, id) || hasAuthor(b.Translators, id) {
+			n++
+		}
+	}
+	return n
+}
+
+// sortedAuthors returns the authors sorted by name.
+func (m *memStore) sortedAuthors() []author {
+	authors := make([]author, 0, len(m.authors))
+	for _, a := range m.authors {
+		authors = append(authors, *a)
+	}
+	sort.Slice(authors, func(i, j int) bool {
+		return authors[i].ID < authors[j].ID
+	})
+	sort.SliceStable(authors, func(i, j int) bool {
+		return authorLess(authors[i], authors[j])
+	})
+	return authors
+}
+
+func (m *memStore) AuthorsPerPage(n int) ([]author, int, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	authors := m.sortedAuthors()
+	from, to, numPages := page(len(authors), *authorsPerPage, n)
+	authors = authors[from:to]
+	for i := range authors {
+		authors[i].BookCount = m.authorBookCount(authors[i].ID)
+	}
+
+	return authors, numPages, nil
+}
+
+func (m *memStore) AuthorByID(id uint32) (*author, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	a := m.authors[id]
+	if a == nil {
+		return nil, ErrNoRows
+	}
+
+	au := *a
+	return &au, nil
+}
+
+func (m *memStore) AuthorAliases(id uint32) ([]author, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var aliases []author
+	for _, a := range m.aliases {
+		if a.AuthorID == id {
+			aliases = append(aliases, a.author)
+		}
+	}
+	sort.Slice(aliases, func(i, j int) bool {
+		return authorLess(aliases[i], aliases[j])
+	})
+
+	return aliases, nil
+}
+
+// replaceAuthor replaces the author from with the author into in the list.
+func replaceAuthor(authors []author, into, from uint32) []author {
+	if !hasAuthor(authors, from) {
+		return authors
+	}
+
+	result := make([]author, 0, len(authors))
+	for _, a := range authors {
+		if a.ID == from {
+			if hasAuthor(authors, into) {
+				continue
+			}
+			a.ID = into
+		}
+		result = append(result, a)
+	}
+	return result
+}
+
+func (m *memStore) MergeAuthors(into, from uint32) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	a := m.authors[from]
+	if a == nil || m.authors[into] == nil {
+		return ErrNoRows
+	}
+
+	for _, b := range m.books {
+		b.Authors = replaceAuthor(b.Authors, into, from)
+		b.Translators = replaceAuthor(b.Translators, into, from)
+	}
+
+	for key, alias := range m.aliases {
+		if alias.AuthorID == from {
+			alias.AuthorID = into
+			m.aliases[key] = alias
+		}
+	}
+	m.aliases[authorKey(*a)] = memAlias{
+		author:   author{FirstName: a.FirstName, MiddleName: a.MiddleName, LastName: a.LastName, Nickname: a.Nickname},
+		AuthorID: into,
+	}
+
+	delete(m.authors, from)
+
+	return nil
+}
+
+func (m *memStore) MergeCandidates(limit int) ([]mergeCandidate, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	authors := make([]author, 0, len(m.authors))
+	for _, a := range m.authors {
+		authors = append(authors, *a)
+	}
+	sort.Slice(authors, func(i, j int) bool {
+		return authors[i].ID < authors[j].ID
+	})
+
+	candidates := mergeCandidates(authors, limit)
+	for i := range candidates {
+		candidates[i].A.BookCount = m.authorBookCount(candidates[i].A.ID)
+		candidates[i].B.BookCount = m.authorBookCount(candidates[i].B.ID)
+	}
+
+	return candidates, nil
+}
+
+func (m *memStore) sequenceBookCount(id uint32) int {
+	n := 0
+	for _, b := range m.books {
+		if hasSequence(b.Sequences, id) {
+			n++
+		}
+	}
+	return n
+}
+
+// sequencesWhere returns the sequences for which f returns true, sorted by
+// name, with their book counts.
+func (m *memStore) sequencesWhere(f func(s *sequence) bool) []sequence {
+	var sequences []sequence
+	for _, s := range m.sequences {
+		if f(s) {
+			seq := *s
+			seq.BookCount = m.sequenceBookCount(s.ID)
+			sequences = append(sequences, seq)
+		}
+	}
+	sort.Slice(sequences, func(i, j int) bool {
+		if sequences[i].Name != sequences[j].Name {
+			return sequences[i].Name < sequences[j].Name
+		}
+		return sequences[i].ID < sequences[j].ID
+	})
+	return sequences
+}
+
+func (m *memStore) sequenceChildren(id uint32) []sequence {
+	return m.sequencesWhere(func(s *sequence) bool { return s.ParentID == id })
+}
+
+func (m *memStore) SequencesPerPage(kind, n int) ([]sequence, int, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	sequences := m.sequencesWhere(func(s *sequence) bool {
+		return s.Kind == kind && s.ParentID == 0
+	})
+	from, to, numPages := page(len(sequences), *sequencesPerPage, n)
+	sequences = sequences[from:to]
+	for i := range sequences {
+		sequences[i].Children = m.sequenceChildren(sequences[i].ID)
+	}
+
+	return sequences, numPages, nil
+}
+
+func (m *memStore) SequenceByID(id uint32) (*sequence, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	s := m.sequences[id]
+	if s == nil {
+		return nil, ErrNoRows
+	}
+
+	seq := *s
+	return &seq, nil
+}
+
+func (m *memStore) SequenceAncestors(s *sequence) ([]sequence, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var ancestors []sequence
+	seen := map[uint32]bool{s.ID: true}
+	for id := s.ParentID; id != 0 && !seen[id]; {
+		seen[id] = true
+		p := m.sequences[id]
+		if p == nil {
+			break
+		}
+		ancestors = append([]sequence{*p}, ancestors...)
+		id = p.ParentID
+	}
+
+	return ancestors, nil
+}
+
+func containsFold(s, substr string) bool {
+	return strings.Contains(strings.ToLower(s), strings.ToLower(substr))
+}
+
+// containsName is containsFold which also ignores the diacritics and finds
+// the names written in another script, comparing the folded strings (see
+// trigram.Fold) and their shadow forms (see trigram.Translit).
+func containsName(s, substr string) bool {
+	return strings.Contains(trigram.Fold(s), trigram.Fold(substr)) ||
+		strings.Contains(trigram.Translit(s), trigram.Translit(substr))
+}
+
+func (m *memStore) Search(query string) ([]author, []sequence, []book, []annotationMatch, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	q := parseQuery(query)
+	text := q.text()
+	authorText, sequenceText := text, text
+	if text == "" {
+		authorText = q.fieldText("author", "translator")
+		sequenceText = q.fieldText("series")
+	}
+
+	var authors []author
+	if authorText != "" {
+		for _, a := range m.sortedAuthors() {
+			if containsName(strings.Join([]string{a.FirstName, a.MiddleName, a.LastName, a.Nickname}, " "), authorText) {
+				authors = append(authors, a)
+			}
+		}
+	}
+
+	var sequences []sequence
+	if sequenceText != "" {
+		sequences = m.sequencesWhere(func(s *sequence) bool { return containsName(s.Name, sequenceText) })
+		for i := range sequences {
+			sequences[i].BookCount = 0
+		}
+	}
+
+	// Books are also found by the names of their authors and sequences,
+	// each term being a substring of one of the strings of its field.
+	var books []book
+	searched := false
+	for _, t := range q.terms {
+		searched = searched || !t.exclude
+	}
+	if searched || q.hasFilters() {
+		books = m.booksWhere(func(b *book) bool {
+			full := m.get(b)
+			for _, t := range q.terms {
+				if t.exclude || t.phrase {
+					continue
+				}
+				found := false
+				for _, s := range fieldStrings(&full, t.field) {
+					if containsName(s, t.text) {
+						found = true
+						break
+					}
+				}
+				if !found {
+					return false
+				}
+			}
+			return memFilters(&q, &full) && q.filter(&full)
+		})
+	}
+
+	var annotations []annotationMatch
+	if text != "" {
+		for _, b := range m.booksWhere(func(b *book) bool { return containsFold(b.Annotation, text) }) {
+			if len(annotations) == maxAnnotationMatches {
+				break
+			}
+			annotations = append(annotations, annotationMatch{
+				book:    b,
+				Snippet: textSnippet(m.books[b.ID].Annotation, text),
+			})
+		}
+	}
+
+	return authors, sequences, books, annotations, nil
+}
+
+// Suggest looks for the corrections among all the names, the words of the
+// titles being known but not suggested, as in the SQLite store.
+func (m *memStore) Suggest(query string) (string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var names, titles []string
+	for _, a := range m.sortedAuthors() {
+		names = append(names, strings.Join([]string{a.FirstName, a.MiddleName, a.LastName, a.Nickname}, " "))
+	}
+	for _, s := range m.sequencesWhere(func(*sequence) bool { return true }) {
+		names = append(names, s.Name)
+	}
+	for _, b := range m.booksWhere(func(*book) bool { return true }) {
+		titles = append(titles, b.Title)
+	}
+
+	return suggestion(query, func(w string) (string, error) {
+		return closestWord(w, names, titles), nil
+	})
+}
+
+// memFilters reports whether the book passes the lang: and genre: filters of
+// the query.
+func memFilters(q *searchQuery, b *book) bool {
+	has := func(list []string, s string) bool {
+		for _, v := range list {
+			if v == s {
+				return true
+			}
+		}
+		return false
+	}
+	hasGenre := func(list []string) bool {
+		for _, g := range b.Genres {
+			if has(list, g.Name) {
+				return true
+			}
+		}
+		return false
+	}
+
+	if len(q.langs) > 0 && !has(q.langs, b.Lang) || has(q.notLangs, b.Lang) {
+		return false
+	}
+	if len(q.genres) > 0 && !hasGenre(q.genres) || hasGenre(q.notGenres) {
+		return false
+	}
+	return true
+}
+
+func (m *memStore) SearchText(query string) ([]textMatch, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	query = strings.TrimSpace(query)
+	if query == "" {
+		return nil, nil
+	}
+
+	var matches []textMatch
+	for _, b := range m.booksWhere(func(*book) bool { return true }) {
+		for _, t := range m.books[b.ID].Text {
+			if len(matches) == maxTextMatches {
+				return matches, nil
+			}
+
+			snippet := textSnippet(t.Text, query)
+			if snippet == "" {
+				continue
+			}
+
+			var anchor string
+			if t.Section > 0 {
+				anchor = sectionAnchor(t.Section)
+			}
+
+			bk := b
+			matches = append(matches, textMatch{
+				Book:    &bk,
+				Anchor:  anchor,
+				Snippet: snippet,
+			})
+		}
+	}
+
+	return matches, nil
+}
+
+func (m *memStore) IndexErrorGroups() ([]indexErrorGroup, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	counts := make(map[indexErrorGroup]int)
+	for _, e := range m.errors {
+		counts[indexErrorGroup{Stage: e.Stage, Archive: e.Archive}]++
+	}
+
+	groups := make([]indexErrorGroup, 0, len(counts))
+	for g, n := range counts {
+		g.Count = n
+		groups = append(groups, g)
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		if groups[i].Stage != groups[j].Stage {
+			return groups[i].Stage < groups[j].Stage
+		}
+		return groups[i].Archive < groups[j].Archive
+	})
+
+	return groups, nil
+}
+
+func (m *memStore) IndexErrors(stage, archive string) ([]indexError, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var errs []indexError
+	for _, e := range m.errors {
+		if e.Stage == stage && e.Archive == archive {
+			errs = append(errs, e)
+		}
+	}
+	sort.SliceStable(errs, func(i, j int) bool {
+		return errs[i].Filename < errs[j].Filename
+	})
+
+	return errs, nil
+}
+
+func (m *memStore) IndexErrorByID(id uint32) (*indexError, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	for _, e := range m.errors {
+		if e.ID == id {
+			return &e, nil
+		}
+	}
+
+	return nil, ErrNoRows
+}
+
+// removeArchive removes the books and the errors of the archive.
+func (m *memStore) removeArchive(name string) {
+	for id, b := range m.books {
+		if b.Archive == name {
+			delete(m.books, id)
+		}
+	}
+
+	errs := m.errors[:0]
+	for _, e := range m.errors {
+		if e.Archive != name {
+			errs = append(errs, e)
+		}
+	}
+	m.errors = errs
+}
+
+func (m *memStore) removeOrphans() {
+	used := make(map[uint32]bool)
+	for _, b := range m.books {
+		for _, a := range b.Authors {
+			used[a.ID] = true
+		}
+		for _, a := range b.Translators {
+			used[a.ID] = true
+		}
+		for _, s := range b.Sequences {
+			used[s.ID] = true
+		}
+	}
+
+	for id := range m.authors {
+		if !used[id] {
+			delete(m.authors, id)
+		}
+	}
+	for key, a := range m.aliases {
+		if m.authors[a.AuthorID] == nil {
+			delete(m.aliases, key)
+		}
+	}
+	for id := range m.sequences {
+		if !used[id] {
+			delete(m.sequences, id)
+		}
+	}
+	for _, s := range m.sequences {
+		if m.sequences[s.ParentID] == nil {
+			s.ParentID = 0
+		}
+	}
+}
+
+// ScanArchives works as the SQLite one does, except that the books of a
+// changed archive are all removed, and so are indexed anew.
+func (m *memStore) ScanArchives(names []string) ([]archive, map[string]map[string]bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	seen := make(map[string]bool, len(names))
+	var pending []archive
+	for _, name := range names {
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+
+		fi, err := os.Stat(name)
+		if err != nil {
+			continue
+		}
+
+		a := archive{
+			Name:    name,
+			Size:    fi.Size(),
+			ModTime: fi.ModTime().Unix(),
+		}
+		if r, ok := m.archives[name]; ok && r == a {
+			continue
+		}
+
+		m.removeArchive(name)
+		pending = append(pending, a)
+	}
+
+	for name := range m.archives {
+		if seen[name] {
+			continue
+		}
+
+		if _, err := os.Stat(name); os.IsNotExist(err) {
+			m.removeArchive(name)
+			delete(m.archives, name)
+		}
+	}
+
+	m.removeOrphans()
+
+	return pending, make(map[string]map[string]bool), nil
+}
+
+func (m *memStore) RecordArchives(archives []archive) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, a := range archives {
+		m.archives[a.Name] = a
+	}
+
+	return nil
+}
+
+func (m *memStore) RemoveArchives(names []string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, name := range names {
+		m.removeArchive(name)
+		delete(m.archives, name)
+	}
+	m.removeOrphans()
+
+	return nil
+}
+
+func (m *memStore) genreID(name string) uint32 {
+	for id, g := range m.genres {
+		if g.Name == name {
+			return id
+		}
+	}
+
+	id := nextID(&m.lastGenre)
+	m.genres[id] = &genre{ID: id, Name: name}
+	return id
+}
+
+func (m *memStore) authorID(a author) uint32 {
+	key := authorKey(a)
+	if alias, ok := m.aliases[key]; ok {
+		return alias.AuthorID
+	}
+
+	var id uint32
+	for _, au := range m.authors {
+		if (id == 0 || au.ID < id) && authorKey(*au) == key {
+			id = au.ID
+		}
+	}
+	if id != 0 {
+		return id
+	}
+
+	id = nextID(&m.lastAuthor)
+	m.authors[id] = &author{
+		ID:         id,
+		FirstName:  a.FirstName,
+		MiddleName: a.MiddleName,
+		LastName:   a.LastName,
+		Nickname:   a.Nickname,
+	}
+	return id
+}
+
+func (m *memStore) sequenceID(name string, kind int, parentID uint32) uint32 {
+	for id, s := range m.sequences {
+		if s.Name == name && s.Kind == kind {
+			if s.ParentID == 0 && parentID != id {
+				s.ParentID = parentID
+			}
+			return id
+		}
+	}
+
+	id := nextID(&m.lastSequence)
+	m.sequences[id] = &sequence{ID: id, Name: name, Kind: kind, ParentID: parentID}
+	return id
+}
+
+// authorIDs returns the authors, reduced to their IDs, without duplicates.
+func (m *memStore) authorIDs(authors []author) []author {
+	var ids []author
+	for _, a := range authors {
+		id := m.authorID(a)
+		if !hasAuthor(ids, id) {
+			ids = append(ids, author{ID: id})
+		}
+	}
+	return ids
+}
+
+func (m *memStore) AddBook(b book) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	b.ID = nextID(&m.lastBook)
+	m.link(&b)
+	m.books[b.ID] = &b
+
+	return nil
+}
+
+// link replaces the genres, the authors and the sequences of the book with
+// references to those in the store, adding the new ones.
+func (m *memStore) link(b *book) {
+	var gs []genre
+	seen := make(map[uint32]bool, len(b.Genres))
+	for _, g := range b.Genres {
+		id := m.genreID(g.Name)
+		if !seen[id] {
+			seen[id] = true
+			gs = append(gs, genre{ID: id})
+		}
+	}
+	b.Genres = gs
+
+	b.Authors = m.authorIDs(b.Authors)
+	b.Translators = m.authorIDs(b.Translators)
+
+	type seqKey struct {
+		name string
+		kind int
+	}
+	seqIDs := make(map[seqKey]uint32, len(b.Sequences))
+	var ss []sequence
+	for _, s := range b.Sequences {
+		var parentID uint32
+		if s.Parent != "" {
+			parentID = seqIDs[seqKey{s.Parent, s.Kind}]
+		}
+
+		id := m.sequenceID(s.Name, s.Kind, parentID)
+		seqIDs[seqKey{s.Name, s.Kind}] = id
+		if !hasSequence(ss, id) {
+			ss = append(ss, sequence{ID: id, Number: s.Number, Position: s.Position})
+		}
+	}
+	b.Sequences = ss
+}
+
+func (m *memStore) Flush() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, e := range takePendingErrors() {
+		e.ID = nextID(&m.lastError)
+		m.errors = append(m.errors, e)
+	}
+
+	return nil
+}
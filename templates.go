@@ -16,6 +16,7 @@ package main
 import (
 	"fmt"
 	"html/template"
+	"time"
 )
 
 var (
@@ -26,15 +27,30 @@ var (
 		"genre_index":    genreIndexTmpl,
 		"author_index":   authorIndexTmpl,
 		"sequence_index": sequenceIndexTmpl,
+		"language_index": languageIndexTmpl,
+		"language":       languageTmpl,
 		"book":           bookTmpl,
 		"book_read":      bookReadTmpl,
 		"genre":          genreTmpl,
 		"author":         authorTmpl,
 		"sequence":       sequenceTmpl,
 		"search":         searchTmpl,
+		"text_search":    textSearchTmpl,
+		"author_merge":   authorMergeTmpl,
+		"errors":         errorsTmpl,
 	}
 )
 
+var stageNames = map[string]string{
+	stageOpen:        "Ошибка чтения",
+	stageXML:         "Ошибка XML",
+	stageNoTitle:     "Нет названия",
+	stageCompression: "Неподдерживаемое сжатие",
+	stageMissing:     "Нет в архиве",
+	stageText:        "Ошибка извлечения текста",
+	stageInsert:      "Ошибка записи в базу",
+}
+
 var funcs = template.FuncMap{
 	"inc": func(n int) int { return n + 1 },
 	"dec": func(n int) int { return n - 1 },
@@ -44,6 +60,34 @@ var funcs = template.FuncMap{
 		}
 		return genres[index-1].Meta
 	},
+	"fulltext":  func() bool { return *fullText },
+	"encodings": func() []string { return encodings },
+	"series": func(sequences []sequence) []sequence {
+		return sequencesOfKind(sequences, seqSeries)
+	},
+	"publisherSeries": func(sequences []sequence) []sequence {
+		return sequencesOfKind(sequences, seqPublisher)
+	},
+	"withoutSequence": func(b book, id uint32) book {
+		var sequences []sequence
+		for _, s := range b.Sequences {
+			if s.ID != id {
+				sequences = append(sequences, s)
+			}
+		}
+		b.Sequences = sequences
+		return b
+	},
+	"language": languageName,
+	"stage": func(stage string) string {
+		if s := stageNames[stage]; s != "" {
+			return s
+		}
+		return stage
+	},
+	"unixtime": func(t int64) string {
+		return time.Unix(t, 0).Format("2006-01-02 15:04:05")
+	},
 	"hrsize": func(size int64) string {
 		switch {
 		case size > 1073741824:
@@ -58,15 +102,25 @@ var funcs = template.FuncMap{
 	},
 }
 
+func sequencesOfKind(sequences []sequence, kind int) []sequence {
+	var result []sequence
+	for _, s := range sequences {
+		if s.Kind == kind {
+			result = append(result, s)
+		}
+	}
+	return result
+}
+
 func mustParse(data ...string) *template.Template {
 	var root *template.Template
-	for _, s := range data {
+	for i, s := range data {
 		var t *template.Template
 		if root == nil {
 			root = template.New("")
 			t = root
 		} else {
-			t = root.New("")
+			t = root.New(fmt.Sprint(i))
 		}
 		_, err := t.Funcs(funcs).Parse(s)
 		if err != nil {
@@ -78,7 +132,7 @@ func mustParse(data ...string) *template.Template {
 
 func init() {
 	for name, source := range templateSources {
-		if name == "book_index" || name == "author_index" || name == "sequence_index" {
+		if name == "book_index" || name == "author_index" || name == "sequence_index" || name == "language" {
 			templates[name] = mustParse(source, pager, base)
 		} else {
 			templates[name] = mustParse(source, base)
@@ -113,17 +167,30 @@ var base = `
       background-color: #ddd;
     }
     .book-lang,
+    .book-src-lang,
+    .book-date,
+    .book-keywords,
+    .book-publish-info,
+    .book-document-info,
     .book-genres,
     .book-authors,
     .book-translators,
-    .book-sequences {
+    .book-sequences,
+    .sequence-ancestors,
+    .sequence-children {
+      font-size: small;
+      color: #aaa;
+    }
+    .author-aliases {
       font-size: small;
       color: #aaa;
     }
+    .author-alias:not(:last-child):after,
     .book-genre:not(:last-child):after,
     .book-author:not(:last-child):after,
     .book-translator:not(:last-child):after,
-    .book-sequence:not(:last-child):after {
+    .book-sequence:not(:last-child):after,
+    .sequence-child:not(:last-child):after {
       content: ",";
     }
     .text-pages {
@@ -136,6 +203,7 @@ var base = `
     .author:nth-child(even) {
       background-color: #ddd;
     }
+    .language:nth-child(even),
     .sequence:nth-child(even) {
       background-color: #ddd;
     }
@@ -153,7 +221,10 @@ var base = `
       <a class="top-nav-link" href="/g">Жанры</a>
       <a class="top-nav-link" href="/a">Авторы</a>
       <a class="top-nav-link" href="/s">Серии</a>
+      <a class="top-nav-link" href="/l">Языки</a>
       <a class="top-nav-link" href="/search">Поиск</a>
+      {{ if fulltext }}<a class="top-nav-link" href="/text">Поиск по текстам</a>{{ end }}
+      <a class="top-nav-link" href="/errors">Ошибки</a>
     </nav>
     <h1>{{ template "title" . }}</h1>
   </header>
@@ -209,10 +280,20 @@ var base = `
   {{ end }}
 {{ end }}
 {{ define "book_sequences" }}
-  {{ if .Sequences }}
+  {{ with series .Sequences }}
+    <div class="book-sequences">
+      <span class="text-series">Сери{{ if gt (len .) 1 }}и{{ else }}я{{ end }}:</span>
+        {{ range . }}
+          <span class="book-sequence">
+            <a class="sequence-link" href="/s?id={{ .ID }}">{{ .Name }}</a>{{ if .Number }}-{{ .Number }}{{ end }}
+          </span>
+        {{ end }}
+    </div>
+  {{ end }}
+  {{ with publisherSeries .Sequences }}
     <div class="book-sequences">
-      <span class="text-series">Сери{{ if gt (len .Sequences) 1 }}и{{ else }}я{{ end }}:</span>
-        {{ range .Sequences }}
+      <span class="text-series">Издательск{{ if gt (len .) 1 }}ие серии{{ else }}ая серия{{ end }}:</span>
+        {{ range . }}
           <span class="book-sequence">
             <a class="sequence-link" href="/s?id={{ .ID }}">{{ .Name }}</a>{{ if .Number }}-{{ .Number }}{{ end }}
           </span>
@@ -220,6 +301,7 @@ var base = `
     </div>
   {{ end }}
 {{ end }}
+{{ define "author_name" }}{{ .FirstName }} {{ .MiddleName }} {{ .LastName }}{{ if .Nickname }}{{ if or .FirstName .LastName }} (aka {{ .Nickname }}){{ else }}{{ .Nickname }}{{ end }}{{ end }}{{ end }}
 {{ define "book_count" }}
   <div class="num-books">
     <span class="text-num-books">Книг:</span>
@@ -237,19 +319,19 @@ var pager = `
     {{ $NextPage := inc .PageNumber }}
     <span class="text-pages">Страницы:</span>
     {{ if gt $PrevPage 1 }}
-      <a class="first-page-link" href="/{{ template "prefix" }}">{{ if gt (dec $PrevPage) 1 }}Первая{{ else }}1{{ end }}</a>
+      <a class="first-page-link" href="/{{ template "prefix" . }}">{{ if gt (dec $PrevPage) 1 }}Первая{{ else }}1{{ end }}</a>
     {{ end }}
     {{ if gt (dec $PrevPage) 1 }}...{{ end }}
     {{ if ge $PrevPage 1 }}
-      <a class="prev-page-link" href="/{{ template "prefix" }}?page={{ $PrevPage }}">{{ $PrevPage }}</a>
+      <a class="prev-page-link" href="/{{ template "prefix" . }}?page={{ $PrevPage }}">{{ $PrevPage }}</a>
     {{ end }}
     <span class="current-page-number">{{ .PageNumber }}</span>
     {{ if le $NextPage .TotalPages }}
-      <a class="next-page-link" href="/{{ template "prefix" }}?page={{ $NextPage }}">{{ $NextPage }}</a>
+      <a class="next-page-link" href="/{{ template "prefix" . }}?page={{ $NextPage }}">{{ $NextPage }}</a>
     {{ end }}
     {{ if lt (inc $NextPage) .TotalPages }}...{{ end }}
     {{ if lt $NextPage .TotalPages }}
-    <a class="last-page-link" href="/{{ template "prefix" }}?page={{ .TotalPages }}">{{ if lt (inc $NextPage) .TotalPages }}Последняя{{ else }}{{ .TotalPages }}{{ end }}</a>
+    <a class="last-page-link" href="/{{ template "prefix" . }}?page={{ .TotalPages }}">{{ if lt (inc $NextPage) .TotalPages }}Последняя{{ else }}{{ .TotalPages }}{{ end }}</a>
     {{ end }}
   {{ end }}
 {{ end }}
@@ -299,6 +381,9 @@ var authorIndexTmpl = `
 {{ define "prefix" }}a{{ end }}
 {{ define "title"  }}Авторы{{ end }}
 {{ define "main" }}
+  <div class="merge-link">
+    <a href="/a/merge">Возможные дубликаты</a>
+  </div>
   {{ range .Authors }}
     <div class="author">
       <div class="author-name">
@@ -318,9 +403,16 @@ var authorIndexTmpl = `
 `
 
 var sequenceIndexTmpl = `
-{{ define "prefix" }}s{{ end }}
-{{ define "title" }}Серии{{ end }}
+{{ define "prefix" }}{{ if .Publisher }}ps{{ else }}s{{ end }}{{ end }}
+{{ define "title" }}{{ if .Publisher }}Издательские серии{{ else }}Серии{{ end }}{{ end }}
 {{ define "main" }}
+  <div class="sequence-kinds">
+    {{ if .Publisher }}
+      <a href="/s">Серии</a>
+    {{ else }}
+      <a href="/ps">Издательские серии</a>
+    {{ end }}
+  </div>
   {{ range .Sequences }}
     <div class="sequence">
       <div class="sequence-name">
@@ -329,6 +421,48 @@ var sequenceIndexTmpl = `
         </a>
       </div>
       {{ template "book_count" . }}
+      {{ with .Children }}
+        <div class="sequence-children">
+          {{ range . }}
+            <span class="sequence-child">
+              <a class="sequence-link" href="/s?id={{ .ID }}">{{ .Name }}</a>
+            </span>
+          {{ end }}
+        </div>
+      {{ end }}
+    </div>
+  {{ end }}
+{{ end }}
+`
+
+var languageIndexTmpl = `
+{{ define "title" }}Языки{{ end }}
+{{ define "main" }}
+  {{ range . }}
+    <div class="language">
+      <div class="language-name">
+        <a class="language-link" href="/l/{{ .Code }}">{{ language .Code }}</a>
+        (<span class="language-code">{{ .Code }}</span>)
+      </div>
+      {{ template "book_count" . }}
+    </div>
+  {{ end }}
+{{ end }}
+`
+
+var languageTmpl = `
+{{ define "prefix" }}l/{{ .Code }}{{ end }}
+{{ define "title" }}Языки / {{ language .Code }}{{ end }}
+{{ define "main" }}
+  {{ range .Books }}
+    <div class="book">
+      <div class="book-title">
+        <a class="book-link" href="/b?id={{ .ID }}">{{ .Title }}</a>
+      </div>
+      {{ template "book_genres" . }}
+      {{ template "book_authors" . }}
+      {{ template "book_translators" . }}
+      {{ template "book_sequences" . }}
     </div>
   {{ end }}
 {{ end }}
@@ -370,6 +504,14 @@ var authorTmpl = `
   Авторы / {{ .Author.FirstName }} {{ .Author.MiddleName }} {{ .Author.LastName }}
 {{ end }}
 {{ define "main" }}
+  {{ if .Aliases }}
+    <div class="author-aliases">
+      <span class="text-aliases">Также:</span>
+      {{ range .Aliases }}
+        <span class="author-alias">{{ template "author_name" . }}</span>
+      {{ end }}
+    </div>
+  {{ end }}
   <div class="author-books">
     {{ range .Books }}
       <div class="book">
@@ -428,9 +570,26 @@ var authorTmpl = `
 
 var sequenceTmpl = `
 {{ define "title" }}
-  Серии / {{ .Sequence.Name }}
+  {{ if .Publisher }}Издательские серии{{ else }}Серии{{ end }} / {{ .Sequence.Name }}
 {{ end }}
 {{ define "main" }}
+  {{ if .Ancestors }}
+    <div class="sequence-ancestors">
+      <span class="text-ancestors">Входит в:</span>
+      {{ range $i, $s := .Ancestors }}{{ if $i }} / {{ end }}<a class="sequence-link" href="/s?id={{ .ID }}">{{ .Name }}</a>{{ end }}
+    </div>
+  {{ end }}
+  {{ with .Sequence.Children }}
+    <div class="sequence-children">
+      <span class="text-children">Подсерии:</span>
+      {{ range . }}
+        <span class="sequence-child">
+          <a class="sequence-link" href="/s?id={{ .ID }}">{{ .Name }}</a>
+          ({{ .BookCount }})
+        </span>
+      {{ end }}
+    </div>
+  {{ end }}
   {{ range .Books }}
     <div class="book">
       <div class="book-title">
@@ -444,18 +603,7 @@ var sequenceTmpl = `
       {{ template "book_genres" . }}
       {{ template "book_authors" . }}
       {{ template "book_translators" . }}
-      {{ if gt (len .Sequences) 1 }}
-        <div class="book-sequences">
-          <span class="text-series">Сери{{ if gt (len .Sequences) 2 }}и{{ else }}я{{ end }}:</span>
-            {{ range .Sequences }}
-              {{ if ne .ID ($.Sequence.ID) }}
-                <span class="book-sequence">
-                  <a class="sequence-link" href="/s?id={{ .ID }}">{{ .Name }}</a>{{ if .Number }}-{{ .Number }}{{ end }}
-                </span>
-              {{ end }}
-            {{ end }}
-        </div>
-      {{ end }}
+      {{ template "book_sequences" (withoutSequence . $.Sequence.ID) }}
     </div>
   {{ end }}
 {{ end }}
@@ -469,6 +617,11 @@ var bookTmpl = `
   .buttons {
     float: right;
   }
+  .book-encoding {
+    clear: both;
+    font-size: small;
+    color: #aaa;
+  }
   .annotation > img {
     max-width: 250px;
     max-height: 300px;
@@ -480,16 +633,71 @@ var bookTmpl = `
   <div class="book-lang">
     <span class="book-lang-text">Язык:</span>
     {{ if .Language }}
-      <a href="#">{{ .Language }}</a>
+      <a href="/l/{{ .Book.Lang }}">{{ .Language }}</a>
     {{ else }}
       {{ .Book.Lang }}
     {{ end }}
+    {{ if and .Book.RawLang (ne .Book.RawLang .Book.Lang) }}
+      (<span class="book-raw-lang">{{ .Book.RawLang }}</span>)
+    {{ end }}
   </div>
+  {{ if .Book.Added }}
+    <div class="book-added">
+      <span class="book-added-text">Добавлена:</span>
+      {{ .Book.Added }}
+    </div>
+  {{ end }}
+  {{ if .Book.Deleted }}
+    <div class="book-deleted">Удалена из библиотеки</div>
+  {{ end }}
   {{ with .Book }}
+    {{ if .SrcLang }}
+      <div class="book-src-lang">
+        <span class="book-src-lang-text">Язык оригинала:</span>
+        {{ language .SrcLang }}
+      </div>
+    {{ end }}
     {{ template "book_genres" . }}
     {{ template "book_authors" . }}
     {{ template "book_translators" . }}
     {{ template "book_sequences" . }}
+    {{ if .Date }}
+      <div class="book-date">
+        <span class="book-date-text">Дата:</span>
+        {{ .Date }}
+      </div>
+    {{ end }}
+    {{ if .Keywords }}
+      <div class="book-keywords">
+        <span class="book-keywords-text">Ключевые слова:</span>
+        {{ .Keywords }}
+      </div>
+    {{ end }}
+    {{ with .PublishInfo }}
+      {{ if or .Publisher .City .Year .ISBN }}
+        <div class="book-publish-info">
+          <span class="book-publish-info-text">Издание:</span>
+          {{ .Publisher }}{{ if .City }}{{ if .Publisher }},{{ end }} {{ .City }}{{ end }}{{ if .Year }}{{ if or .Publisher .City }},{{ end }} {{ .Year }}{{ end }}
+          {{ if .ISBN }}
+            <div class="book-isbn">
+              <span class="book-isbn-text">ISBN:</span>
+              {{ .ISBN }}
+            </div>
+          {{ end }}
+        </div>
+      {{ end }}
+    {{ end }}
+    {{ with .DocumentInfo }}
+      {{ if or .ID .Version .ProgramUsed .Date }}
+        <div class="book-document-info">
+          <span class="book-document-info-text">Документ:</span>
+          {{ if .ID }}<span class="document-id">{{ .ID }}</span>{{ end }}
+          {{ if .Version }}<span class="document-version">версия {{ .Version }}</span>{{ end }}
+          {{ if .Date }}<span class="document-date">от {{ .Date }}</span>{{ end }}
+          {{ if .ProgramUsed }}<span class="document-program">({{ .ProgramUsed }})</span>{{ end }}
+        </div>
+      {{ end }}
+    {{ end }}
   {{ end }}
   <div class="buttons">
     <a class="read-button" href="/b?id={{ .Book.ID }}&action=read">
@@ -502,6 +710,16 @@ var bookTmpl = `
     <img class="book-cover" src="/i/{{ if .Cover }}{{ .Cover }}{{ else }}no-cover.png{{ end }}">
     {{ .Ann }}
   </div>
+  <form class="book-encoding" method="POST" action="/b?id={{ .Book.ID }}&action=encoding">
+    <span class="book-encoding-text">Кодировка:</span>
+    <select name="encoding">
+      <option value="">как указано в файле</option>
+      {{ range encodings }}
+        <option{{ if eq . $.Book.Encoding }} selected{{ end }}>{{ . }}</option>
+      {{ end }}
+    </select>
+    <button type="submit">Сохранить</button>
+  </form>
 {{ end }}
 `
 
@@ -565,6 +783,16 @@ var bookReadTmpl = `
 
 var searchTmpl = `
 {{ define "title" }}Поиск{{ end }}
+{{ define "styles" }}
+  .search-help {
+    margin-top: 5px;
+    font-size: smaller;
+    color: #666;
+  }
+  .search-suggestion {
+    margin-bottom: 10px;
+  }
+{{ end }}
 {{ define "main" }}
   <div class="search-form">
     <form method="POST" action="/search">
@@ -573,10 +801,23 @@ var searchTmpl = `
         <button type="submit">Искать</button>
       </div>
     </form>
+    {{ if not .SearchQuery }}
+      <div class="search-help">
+        Искать только в названии, авторах, переводчиках или сериях: <code>title:</code>, <code>author:</code>, <code>translator:</code>, <code>series:</code>.
+        Фраза целиком: <code>"пикник на обочине"</code>.
+        Язык и жанр: <code>lang:en</code>, <code>genre:sf_space</code>.
+        Исключить: <code>-series:полдень</code>, <code>-lang:ru</code>.
+      </div>
+    {{ end }}
   </div>
   {{ if .SearchQuery }}
     <div class="search-results">
-      {{ if not (or .Authors .Sequences .Books) }}Ничего не найдено.{{ end }}
+      {{ if .Suggestion }}
+        <div class="search-suggestion">
+          Возможно, вы имели в виду: <a href="/search?query={{ .Suggestion }}">{{ .Suggestion }}</a>
+        </div>
+      {{ end }}
+      {{ if not (or .Authors .Sequences .Books .Annotations) }}Ничего не найдено.{{ end }}
       {{ if .Authors }}
         <h2>Найденные авторы</h2>
         <div class="search-results-authors">
@@ -614,7 +855,136 @@ var searchTmpl = `
           {{ end }}
         </div>
       {{ end }}
+      {{ if .Annotations }}
+        <h2>Найдено в аннотациях</h2>
+        <div class="search-results-annotations">
+          {{ range .Annotations }}
+            <div class="book">
+              <div class="book-title">
+                <a class="book-link" href="/b?id={{ .ID }}">{{ .Title }}</a>
+              </div>
+              {{ template "book_authors" . }}
+              <div class="annotation-snippet">{{ .Snippet }}</div>
+            </div>
+          {{ end }}
+        </div>
+      {{ end }}
+    </div>
+  {{ end }}
+{{ end }}
+`
+
+var textSearchTmpl = `
+{{ define "title" }}Поиск по текстам{{ end }}
+{{ define "styles" }}
+  .text-snippet {
+    margin: 5px 0 15px 20px;
+  }
+{{ end }}
+{{ define "main" }}
+  <div class="search-form">
+    <form method="POST" action="/text">
+      <div>
+        <input type="text" name="query" value="{{ .SearchQuery }}">
+        <button type="submit">Искать</button>
+      </div>
+    </form>
+  </div>
+  {{ if .SearchQuery }}
+    <div class="search-results">
+      {{ if not .Matches }}Ничего не найдено.{{ end }}
+      {{ range .Matches }}
+        <div class="text-match">
+          <div class="book-title">
+            <a class="book-link" href="/b?id={{ .Book.ID }}">{{ .Book.Title }}</a>
+          </div>
+          {{ template "book_authors" .Book }}
+          <div class="text-snippet">
+            {{ .Snippet }}
+            <a class="read-link" href="/b?id={{ .Book.ID }}&action=read{{ if .Anchor }}#{{ .Anchor }}{{ end }}">(читать)</a>
+          </div>
+        </div>
+      {{ end }}
+    </div>
+  {{ end }}
+{{ end }}
+`
+
+var errorsTmpl = `
+{{ define "title" }}Ошибки индексирования{{ end }}
+{{ define "styles" }}
+  .index-error {
+    margin-bottom: 10px;
+  }
+  .error-text,
+  .error-time {
+    font-size: small;
+    color: #aaa;
+  }
+{{ end }}
+{{ define "main" }}
+  {{ if .Errors }}
+    <div class="error-group">
+      <h2>{{ stage .Stage }}</h2>
+      <div class="error-archive">{{ .Archive }}</div>
     </div>
+    {{ range .Errors }}
+      <div class="index-error">
+        <div class="error-filename">
+          {{ if .Filename }}{{ .Filename }}{{ else }}{{ .Archive }}{{ end }}
+          {{ if and .Filename (ne .Stage "missing") }}<a class="download-link" href="/errors?id={{ .ID }}&action=download">(скачать)</a>{{ end }}
+        </div>
+        <div class="error-text">{{ .Error }}</div>
+        <div class="error-time">{{ unixtime .Time }}</div>
+      </div>
+    {{ end }}
+  {{ else }}
+    {{ if not .Groups }}Ошибок нет.{{ end }}
+    {{ range $i, $g := .Groups }}
+      {{ if or (eq $i 0) (ne .Stage (index $.Groups (dec $i)).Stage) }}
+        <h2>{{ stage .Stage }}</h2>
+      {{ end }}
+      <div class="error-group">
+        <a class="error-group-link" href="/errors?stage={{ .Stage }}&archive={{ .Archive }}">{{ .Archive }}</a>
+        <span class="error-count">({{ .Count }})</span>
+      </div>
+    {{ end }}
+  {{ end }}
+{{ end }}
+`
+
+var authorMergeTmpl = `
+{{ define "title" }}Авторы / Возможные дубликаты{{ end }}
+{{ define "styles" }}
+  .merge-candidate {
+    margin-bottom: 10px;
+  }
+  .merge-candidate:nth-child(even) {
+    background-color: #ddd;
+  }
+{{ end }}
+{{ define "main" }}
+  <form class="merge-form" method="POST" action="/a/merge">
+    Перенести книги автора №<input type="text" name="from" size="6">
+    к автору №<input type="text" name="into" size="6">
+    <button type="submit">Объединить</button>
+  </form>
+  {{ if not .Candidates }}Похожих авторов не найдено.{{ end }}
+  {{ range .Candidates }}
+    <form class="merge-candidate" method="POST" action="/a/merge">
+      <input type="hidden" name="from" value="{{ .B.ID }}">
+      <input type="hidden" name="into" value="{{ .A.ID }}">
+      <div>
+        <a class="author-link" href="/a?id={{ .A.ID }}">{{ template "author_name" .A }}</a>
+        <span class="book-count">({{ .A.BookCount }})</span>
+      </div>
+      <div>
+        <a class="author-link" href="/a?id={{ .B.ID }}">{{ template "author_name" .B }}</a>
+        <span class="book-count">({{ .B.BookCount }})</span>
+      </div>
+      <button type="submit">Объединить</button>
+      <button type="submit" formaction="/a/merge?swap=1">Объединить, оставив второе имя</button>
+    </form>
   {{ end }}
 {{ end }}
 `
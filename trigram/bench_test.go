@@ -0,0 +1,141 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package trigram
+
+import (
+	"math/rand"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+)
+
+const benchDocs = 200000
+
+var (
+	benchOnce   sync.Once
+	benchTitles []string
+	benchIndex  *Index
+)
+
+// benchCorpus returns titles made of words from a vocabulary of made-up
+// Cyrillic and Latin words, with a few very common words among them.
+func benchCorpus() []string {
+	benchOnce.Do(func() {
+		rnd := rand.New(rand.NewSource(1))
+		syllables := [][]string{
+			strings.Fields("ба ве го да ко ли ма но пра ро са ти ус фе хо це ча шу ще эр юн яр"),
+			strings.Fields("ka re si to mu na ve lo pri dor ban tel gar mon"),
+		}
+		vocab := make([]string, 20000)
+		for i := range vocab {
+			ss := syllables[0]
+			if i%4 == 0 {
+				ss = syllables[1]
+			}
+			var w string
+			for j := rnd.Intn(3) + 2; j > 0; j-- {
+				w += ss[rnd.Intn(len(ss))]
+			}
+			vocab[i] = w
+		}
+		common := strings.Fields("и в на мир война история том часть the of")
+
+		benchTitles = make([]string, benchDocs)
+		for i := range benchTitles {
+			var ww []string
+			for j := rnd.Intn(5) + 2; j > 0; j-- {
+				if rnd.Intn(4) == 0 {
+					ww = append(ww, common[rnd.Intn(len(common))])
+				} else {
+					// Zipf-like: the first words are the most frequent.
+					ww = append(ww, vocab[int(float64(len(vocab))*rnd.Float64()*rnd.Float64())])
+				}
+			}
+			benchTitles[i] = strings.Join(ww, " ")
+		}
+
+		benchIndex = NewIndex()
+		for i, s := range benchTitles {
+			benchIndex.Add(uint32(i+1), s)
+		}
+	})
+	return benchTitles
+}
+
+func BenchmarkAdd(b *testing.B) {
+	titles := benchCorpus()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		idx := NewIndex()
+		for j, s := range titles {
+			idx.Add(uint32(j+1), s)
+		}
+	}
+}
+
+// BenchmarkMemory reports the heap used by an index of benchDocs titles.
+func BenchmarkMemory(b *testing.B) {
+	titles := benchCorpus()
+	var before, after runtime.MemStats
+	for i := 0; i < b.N; i++ {
+		runtime.GC()
+		runtime.ReadMemStats(&before)
+		idx := NewIndex()
+		for j, s := range titles {
+			idx.Add(uint32(j+1), s)
+		}
+		runtime.GC()
+		runtime.ReadMemStats(&after)
+		runtime.KeepAlive(idx)
+	}
+	b.ReportMetric(float64(after.HeapAlloc-before.HeapAlloc)/(1<<20), "MiB")
+}
+
+func benchmarkQuery(b *testing.B, n int) {
+	titles := benchCorpus()
+	rnd := rand.New(rand.NewSource(2))
+	queries := make([][]T, 100)
+	for i := range queries {
+		ww := strings.Fields(titles[rnd.Intn(len(titles))])
+		if len(ww) > n {
+			ww = ww[:n]
+		}
+		queries[i] = Extract(strings.Join(ww, " "))
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		benchIndex.QueryTrigrams(queries[i%len(queries)])
+	}
+}
+
+func BenchmarkQuery1Word(b *testing.B)  { benchmarkQuery(b, 1) }
+func BenchmarkQuery3Words(b *testing.B) { benchmarkQuery(b, 3) }
+func BenchmarkQuery6Words(b *testing.B) { benchmarkQuery(b, 6) }
+
+func BenchmarkRemove(b *testing.B) {
+	titles := benchCorpus()
+	idx := NewIndex()
+	for j, s := range titles {
+		idx.Add(uint32(j+1), s)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		idx.Remove(uint32(i%len(titles) + 1))
+	}
+}
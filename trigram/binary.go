@@ -0,0 +1,237 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package trigram
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"hash"
+	"hash/crc32"
+	"io"
+	"sort"
+)
+
+// The serialized index starts with the magic and the format version, which
+// must be incremented whenever the encoding or the trigrams extracted from
+// the strings change, and the checksum of the folding rules. Then come the
+// number of posting lists and, for each list in increasing order of the
+// keys, its key (the trigram along with the field), the number of IDs and
+// the delta-encoded IDs, all as varints. The index ends with the CRC-32 of
+// all the preceding bytes. The lengths of the fields are not stored, but
+// counted when the index is read, and the boosts are left as they are.
+const (
+	magic   = "TRGM"
+	version = 5
+)
+
+var (
+	ErrFormat   = errors.New("trigram: malformed index")
+	ErrVersion  = errors.New("trigram: unsupported index version")
+	ErrFolds    = errors.New("trigram: index made with other folding rules")
+	ErrChecksum = errors.New("trigram: index checksum mismatch")
+)
+
+// hashWriter writes to w, hashing and counting the bytes written.
+type hashWriter struct {
+	w io.Writer
+	h hash.Hash32
+	n int64
+}
+
+func (w *hashWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.h.Write(p[:n])
+	w.n += int64(n)
+	return n, err
+}
+
+// WriteTo writes the index to w in a binary format, which ReadFrom reads.
+func (idx *Index) WriteTo(w io.Writer) (int64, error) {
+	hw := &hashWriter{w: w, h: crc32.NewIEEE()}
+	bw := bufio.NewWriter(hw)
+
+	keys := make([]key, 0, len(idx.lists))
+	for k := range idx.lists {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+
+	var buf [binary.MaxVarintLen64]byte
+	putUvarint := func(x uint64) {
+		bw.Write(buf[:binary.PutUvarint(buf[:], x)])
+	}
+
+	bw.WriteString(magic)
+	putUvarint(version)
+	putUvarint(uint64(foldsSum))
+	putUvarint(uint64(len(keys)))
+	for _, k := range keys {
+		p := idx.lists[k]
+		putUvarint(uint64(k))
+		putUvarint(uint64(p.n))
+		prev := uint32(0)
+		c := p.cursor()
+		for c.next() {
+			putUvarint(uint64(c.id - prev))
+			prev = c.id
+		}
+	}
+
+	err := bw.Flush()
+	if err != nil {
+		return hw.n, err
+	}
+
+	var sum [4]byte
+	binary.LittleEndian.PutUint32(sum[:], hw.h.Sum32())
+	n, err := w.Write(sum[:])
+	return hw.n + int64(n), err
+}
+
+// hashReader reads bytes from r, hashing and counting them.
+type hashReader struct {
+	r   io.ByteReader
+	h   hash.Hash32
+	buf []byte
+	n   int64
+}
+
+func (r *hashReader) ReadByte() (byte, error) {
+	b, err := r.r.ReadByte()
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return 0, err
+	}
+	r.n++
+	r.buf = append(r.buf, b)
+	if len(r.buf) == cap(r.buf) {
+		r.sum()
+	}
+	return b, nil
+}
+
+func (r *hashReader) sum() uint32 {
+	r.h.Write(r.buf)
+	r.buf = r.buf[:0]
+	return r.h.Sum32()
+}
+
+// ReadFrom replaces the contents of the index with an index written by
+// WriteTo. It reads exactly the bytes of the index if r is an io.ByteReader,
+// so that several indexes can be read from one stream; otherwise r is
+// buffered. If an error is returned, the index is left as it was.
+func (idx *Index) ReadFrom(r io.Reader) (int64, error) {
+	br, ok := r.(io.ByteReader)
+	if !ok {
+		br = bufio.NewReader(r)
+	}
+	hr := &hashReader{r: br, h: crc32.NewIEEE(), buf: make([]byte, 0, 4096)}
+
+	for i := 0; i < len(magic); i++ {
+		b, err := hr.ReadByte()
+		if err != nil {
+			return hr.n, err
+		}
+		if b != magic[i] {
+			return hr.n, ErrFormat
+		}
+	}
+
+	v, err := binary.ReadUvarint(hr)
+	if err != nil {
+		return hr.n, err
+	}
+	if v != version {
+		return hr.n, ErrVersion
+	}
+
+	fs, err := binary.ReadUvarint(hr)
+	if err != nil {
+		return hr.n, err
+	}
+	if fs != uint64(foldsSum) {
+		return hr.n, ErrFolds
+	}
+
+	count, err := binary.ReadUvarint(hr)
+	if err != nil {
+		return hr.n, err
+	}
+	// The posting lists take no more memory than their bytes read, while the
+	// lengths of the fields are allocated up to the largest ID, so they are
+	// counted only once the checksum is verified.
+	lists := make(map[key]postings)
+	prev := uint64(0)
+	for i := uint64(0); i < count; i++ {
+		k, err := binary.ReadUvarint(hr)
+		if err != nil {
+			return hr.n, err
+		}
+		n, err := binary.ReadUvarint(hr)
+		if err != nil {
+			return hr.n, err
+		}
+		if k > 0xffffffff || key(k).field() >= MaxFields || i > 0 && k <= prev || n == 0 || n > 0xffffffff {
+			return hr.n, ErrFormat
+		}
+		prev = k
+
+		var p postings
+		id := uint64(0)
+		for ; n > 0; n-- {
+			delta, err := binary.ReadUvarint(hr)
+			if err != nil {
+				return hr.n, err
+			}
+			id += delta
+			if id > 0xffffffff || (delta == 0 && p.n > 0) {
+				return hr.n, ErrFormat
+			}
+			p.append(uint32(id))
+		}
+		lists[key(k)] = p
+	}
+
+	sum := hr.sum()
+	var b [4]byte
+	for i := range b {
+		b[i], err = br.ReadByte()
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return hr.n + int64(i), err
+		}
+	}
+	if binary.LittleEndian.Uint32(b[:]) != sum {
+		return hr.n + 4, ErrChecksum
+	}
+
+	idx.lists = lists
+	for f := range idx.fields {
+		idx.fields[f] = fieldStats{boost: idx.fields[f].boost}
+	}
+	for k, p := range lists {
+		stats := &idx.fields[k.field()]
+		c := p.cursor()
+		for c.next() {
+			stats.inc(c.id)
+		}
+	}
+
+	return hr.n + 4, nil
+}
@@ -0,0 +1,145 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package trigram
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"math/rand"
+	"reflect"
+	"runtime"
+	"testing"
+)
+
+func TestWriteReadFrom(t *testing.T) {
+	rnd := rand.New(rand.NewSource(7))
+	idx := build(randomDocs(rnd, 2000))
+	for id := range randomDocs(rnd, 300) {
+		idx.AddFieldTrigrams(id, 3, Extract(words[id%uint32(len(words))]))
+	}
+
+	var buf bytes.Buffer
+	n, err := idx.WriteTo(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != int64(buf.Len()) {
+		t.Errorf("WriteTo returned %d, wrote %d bytes", n, buf.Len())
+	}
+	buf.WriteString("trailing")
+
+	got := NewIndex()
+	got.Add(1, "что-то лишнее")
+	m, err := got.ReadFrom(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m != n {
+		t.Errorf("ReadFrom read %d bytes, want %d", m, n)
+	}
+	if !reflect.DeepEqual(got, idx) {
+		t.Error("index read differs from the one written")
+	}
+	if buf.String() != "trailing" {
+		t.Errorf("ReadFrom read past the index: %q left", buf.String())
+	}
+
+	data := make([]byte, n)
+	idx.WriteTo(bytes.NewBuffer(data[:0]))
+	data[len(data)/2] ^= 1
+	if _, err := NewIndex().ReadFrom(bytes.NewReader(data)); err == nil {
+		t.Error("a corrupted index was read without an error")
+	}
+}
+
+// written returns the index as written by WriteTo.
+func written(t *testing.T, idx *Index) []byte {
+	var buf bytes.Buffer
+	if _, err := idx.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// checkUnchanged checks that a failed ReadFrom left the index as it was.
+func checkUnchanged(t *testing.T, data []byte, want error) {
+	idx := NewIndex()
+	idx.Add(1, "Лев Толстой")
+	before := written(t, idx)
+
+	if _, err := idx.ReadFrom(bytes.NewReader(data)); err != want {
+		t.Errorf("want %v, got %v", want, err)
+	}
+	if !bytes.Equal(written(t, idx), before) {
+		t.Error("a failed ReadFrom changed the index")
+	}
+}
+
+func TestReadFromVersion(t *testing.T) {
+	idx := NewIndex()
+	idx.Add(1, "Лев Толстой")
+	data := written(t, idx)
+
+	// The version follows the magic.
+	if data[len(magic)] != version {
+		t.Fatalf("want the version %d after the magic, got %d", version, data[len(magic)])
+	}
+	data[len(magic)]--
+	checkUnchanged(t, data, ErrVersion)
+
+	data[len(magic)] += 2
+	checkUnchanged(t, data, ErrVersion)
+
+	copy(data, "GRTM")
+	checkUnchanged(t, data, ErrFormat)
+}
+
+func TestReadFromChecksum(t *testing.T) {
+	idx := NewIndex()
+	idx.Add(1, "Лев Толстой")
+	idx.Add(2, "Алексей Толстой")
+	data := written(t, idx)
+
+	data[len(data)-1] ^= 0xff
+	checkUnchanged(t, data, ErrChecksum)
+	data[len(data)-1] ^= 0xff
+
+	checkUnchanged(t, data[:len(data)-1], io.ErrUnexpectedEOF)
+	checkUnchanged(t, data[:len(data)/2], io.ErrUnexpectedEOF)
+}
+
+func TestReadFromLargeID(t *testing.T) {
+	// An index with a single ID near the maximum and a wrong checksum.
+	var data []byte
+	data = append(data, magic...)
+	data = binary.AppendUvarint(data, version)
+	data = binary.AppendUvarint(data, uint64(foldsSum))
+	data = binary.AppendUvarint(data, 1)
+	data = binary.AppendUvarint(data, uint64(mkKey(0, 1)))
+	data = binary.AppendUvarint(data, 1)
+	data = binary.AppendUvarint(data, 0xfffffff0)
+	sum := crc32.ChecksumIEEE(data)
+	data = binary.LittleEndian.AppendUint32(data, sum+1)
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	checkUnchanged(t, data, ErrChecksum)
+	runtime.ReadMemStats(&after)
+	if n := after.TotalAlloc - before.TotalAlloc; n > 1<<20 {
+		t.Errorf("ReadFrom allocated %d bytes before verifying the checksum", n)
+	}
+
+}
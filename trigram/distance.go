@@ -0,0 +1,124 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package trigram
+
+import (
+	"strings"
+	"unicode"
+)
+
+// Distance returns the Damerau-Levenshtein distance between a and b: the
+// least number of insertions, deletions and substitutions of runes, and
+// transpositions of adjacent runes, which turn a into b.
+func Distance(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	if len(ra) == 0 || len(rb) == 0 {
+		return len(ra) + len(rb)
+	}
+
+	// The algorithm of Lowrance and Wagner, on a matrix with an extra row
+	// and column of the maximum distance around it.
+	w := len(rb) + 2
+	d := make([]int, (len(ra)+2)*w)
+	inf := len(ra) + len(rb)
+	d[0] = inf
+	for i := 0; i <= len(ra); i++ {
+		d[(i+1)*w] = inf
+		d[(i+1)*w+1] = i
+	}
+	for j := 0; j <= len(rb); j++ {
+		d[j+1] = inf
+		d[w+j+1] = j
+	}
+
+	last := make(map[rune]int) // the last row where each rune of a was
+	for i := 1; i <= len(ra); i++ {
+		lastCol := 0 // the last column where b had the rune of this row
+		for j := 1; j <= len(rb); j++ {
+			k, l := last[rb[j-1]], lastCol
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+				lastCol = j
+			}
+			d[(i+1)*w+j+1] = minInt(
+				d[i*w+j]+cost,
+				d[(i+1)*w+j]+1,
+				d[i*w+j+1]+1,
+				d[k*w+l]+(i-k-1)+1+(j-l-1),
+			)
+		}
+		last[ra[i-1]] = i
+	}
+
+	return d[(len(ra)+1)*w+len(rb)+1]
+}
+
+func minInt(x int, y ...int) int {
+	for _, v := range y {
+		if v < x {
+			x = v
+		}
+	}
+	return x
+}
+
+// splitWords returns the words of s.
+func splitWords(s string) []string {
+	return strings.FieldsFunc(s, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// prefixDistance returns the distance between the query word q and the word
+// w, or the start of w as long as q, whichever is less, so that a word which
+// is typed in part is not far from the whole one.
+func prefixDistance(q, w string) int {
+	d := Distance(q, w)
+	if rw := []rune(w); len(rw) > len([]rune(q)) {
+		d = minInt(d, Distance(q, string(rw[:len([]rune(q))])))
+	}
+	return d
+}
+
+// WordDistance returns the distance between the words a and b, folded (see
+// Fold), or between their shadow forms (see Translit), whichever is less.
+func WordDistance(a, b string) int {
+	return minInt(Distance(Fold(a), Fold(b)), Distance(Translit(a), Translit(b)))
+}
+
+// WordsDistance returns how far the query is from the strings: the sum of the
+// distances between each word of the query and the closest word of any of
+// the strings, or the start of it, as in WordDistance.
+func WordsDistance(query string, ss ...string) int {
+	var folded, shadows []string
+	for _, s := range ss {
+		folded = append(folded, splitWords(Fold(s))...)
+		shadows = append(shadows, splitWords(Translit(s))...)
+	}
+
+	total := 0
+	for _, q := range splitWords(query) {
+		fq, sq := Fold(q), Translit(q)
+		best := len([]rune(fq))
+		for _, w := range folded {
+			best = minInt(best, prefixDistance(fq, w))
+		}
+		for _, w := range shadows {
+			best = minInt(best, prefixDistance(sq, w))
+		}
+		total += best
+	}
+	return total
+}
@@ -0,0 +1,108 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package trigram
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDistance(t *testing.T) {
+	for _, tc := range []struct {
+		a, b string
+		want int
+	}{
+		{"", "", 0},
+		{"", "мир", 3},
+		{"мир", "мир", 0},
+		{"Толкиен", "Толкин", 1},
+		{"Брэдбэри", "Брэдбери", 1},
+		{"Стругацикй", "Стругацкий", 1},
+		{"ca", "abc", 2}, // 3 with the restricted edit distance
+		{"kitten", "sitting", 3},
+		{"Азимов", "Озимов", 1},
+	} {
+		if got := Distance(tc.a, tc.b); got != tc.want {
+			t.Errorf("Distance(%q, %q) = %d, want %d", tc.a, tc.b, got, tc.want)
+		}
+		if got := Distance(tc.b, tc.a); got != tc.want {
+			t.Errorf("Distance(%q, %q) = %d, want %d", tc.b, tc.a, got, tc.want)
+		}
+	}
+}
+
+func TestWordsDistance(t *testing.T) {
+	for _, tc := range []struct {
+		query string
+		ss    []string
+		want  int
+	}{
+		{"Толкин", []string{"Джон Рональд Руэл Толкин"}, 0},
+		{"толкиен", []string{"Джон Рональд Руэл Толкин"}, 1},
+		{"Tolkien", []string{"Джон Рональд Руэл Толкин"}, 1},
+		{"Толст", []string{"Лев Толстой"}, 0},
+		{"Рэй Брэдбэри", []string{"Брэдбери", "Рэй"}, 0}, // bredberi
+		{"Рэй Бредбэри", []string{"Рэй Брэдбери"}, 0},
+		{"Азимоф", []string{"Айзек Азимов"}, 1},
+		{"Ёлка", []string{"Елка"}, 0},
+		{"война", []string{"Мир"}, 4}, // voina, mir
+	} {
+		if got := WordsDistance(tc.query, tc.ss...); got != tc.want {
+			t.Errorf("WordsDistance(%q, %q) = %d, want %d", tc.query, tc.ss, got, tc.want)
+		}
+	}
+}
+
+func TestQueryRelaxed(t *testing.T) {
+	idx := NewIndex()
+	idx.Add(1, "Толкин")
+	idx.Add(2, "Брэдбери")
+	idx.Add(3, "Толстой")
+	idx.Add(4, "Кинг")
+
+	for _, tc := range []struct {
+		query string
+		want  []uint32
+	}{
+		{"Толкиен", []uint32{1}},
+		{"Кнг", nil},
+	} {
+		if got := queryIDs(idx, tc.query); len(got) != 0 && tc.want != nil {
+			t.Errorf("%s: the strict query found %v", tc.query, got)
+		}
+		var got []uint32
+		for _, r := range idx.QueryRelaxed(Extract(tc.query), 1) {
+			got = append(got, r.ID)
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: want %v, got %v", tc.query, tc.want, got)
+		}
+	}
+
+	// A short query is not required more trigrams than by QueryFields.
+	short := NewIndex()
+	short.Add(1, "Якуб Колас")
+	tt := Extract("Я")
+	if rr := short.QueryFields(tt); len(rr) != 1 {
+		t.Errorf("Я: want QueryFields to find 1, got %v", rr)
+	}
+	if rr := short.QueryRelaxed(tt, 1); len(rr) != 1 {
+		t.Errorf("Я: want QueryRelaxed to find 1, got %v", rr)
+	}
+
+	// Enough results stop the relaxing.
+	if rr := idx.QueryRelaxed(Extract("Толкин"), 1); len(rr) != 1 || rr[0].ID != 1 {
+		t.Errorf("Толкин: want only 1, got %v", rr)
+	}
+}
@@ -0,0 +1,156 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package trigram
+
+import (
+	"hash/crc32"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// Before their trigrams are extracted, the strings are folded: lowercased,
+// decomposed (NFKD), which also turns the ligatures, the full-width forms and
+// the like into plain letters and digits, and stripped of the combining
+// marks, so that Émile and Emile, or ё and е, are the same. The folding rules
+// are applied to the letters first, for those which do not decompose (ß, ł)
+// or should not (й).
+
+// defaultFolds are the default folding rules.
+var defaultFolds = map[rune]string{
+	'й': "й", // not и
+	'ß': "ss",
+	'æ': "ae",
+	'œ': "oe",
+	'ø': "o",
+	'ł': "l",
+	'đ': "d",
+	'ð': "d",
+	'þ': "th",
+	'ħ': "h",
+	'ı': "i",
+}
+
+var (
+	folds      = defaultFolds
+	foldsSum   = sumFolds(defaultFolds)
+	asciiFolds = false // whether any of the folds is of an ASCII letter
+)
+
+// DefaultFolds returns a copy of the default folding rules.
+func DefaultFolds() map[rune]string {
+	m := make(map[rune]string, len(defaultFolds))
+	for r, s := range defaultFolds {
+		m[r] = s
+	}
+	return m
+}
+
+// SetFolds sets the folding rules: each letter, once lowercased, is replaced
+// with its string instead of being decomposed, so a letter folded into itself
+// is left as it is. It must be called before anything is indexed, and the
+// indexes written with other rules are not read.
+func SetFolds(m map[rune]string) {
+	folds = make(map[rune]string, len(m))
+	asciiFolds = false
+	for r, s := range m {
+		r = unicode.ToLower(r)
+		folds[r] = s
+		asciiFolds = asciiFolds || r < utf8.RuneSelf
+	}
+	foldsSum = sumFolds(folds)
+}
+
+// sumFolds returns the checksum of the folding rules, which is written with
+// the index.
+func sumFolds(m map[rune]string) uint32 {
+	rr := make([]rune, 0, len(m))
+	for r := range m {
+		rr = append(rr, r)
+	}
+	sort.Slice(rr, func(i, j int) bool { return rr[i] < rr[j] })
+
+	var b strings.Builder
+	for _, r := range rr {
+		b.WriteRune(r)
+		b.WriteByte('=')
+		b.WriteString(m[r])
+		b.WriteByte(0)
+	}
+	return crc32.ChecksumIEEE([]byte(b.String()))
+}
+
+// Fold returns s folded as it is before its trigrams are extracted.
+func Fold(s string) string {
+	if !asciiFolds && isASCII(s) {
+		return strings.ToLower(s)
+	}
+
+	// Composed first, so that a letter which is kept, like й, is kept even
+	// if it was written as и and a combining breve.
+	s = norm.NFC.String(s)
+	b := make([]byte, 0, len(s))
+	for _, r := range s {
+		b = appendFolded(b, r)
+	}
+	return string(b)
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+// appendFolded appends the folded rune to b.
+func appendFolded(b []byte, r rune) []byte {
+	r = unicode.ToLower(r)
+	if s, ok := folds[r]; ok {
+		return append(b, s...)
+	}
+	if r < utf8.RuneSelf {
+		return append(b, byte(r))
+	}
+
+	var buf [utf8.UTFMax]byte
+	n := utf8.EncodeRune(buf[:], r)
+	d := norm.NFKD.Properties(buf[:n]).Decomposition()
+	if d == nil {
+		if unicode.Is(unicode.Mn, r) {
+			return b
+		}
+		return utf8.AppendRune(b, r)
+	}
+
+	for len(d) > 0 {
+		r, n := utf8.DecodeRune(d)
+		d = d[n:]
+		if unicode.Is(unicode.Mn, r) {
+			continue
+		}
+		r = unicode.ToLower(r)
+		if s, ok := folds[r]; ok {
+			b = append(b, s...)
+		} else {
+			b = utf8.AppendRune(b, r)
+		}
+	}
+	return b
+}
@@ -0,0 +1,130 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package trigram
+
+import (
+	"bytes"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// foldCorpus are the strings which are written differently but must have the
+// same trigrams, and find each other.
+var foldCorpus = []struct{ a, b string }{
+	// French, German, Polish, Czech, Vietnamese.
+	{"Émile Zola", "Emile Zola"},
+	{"Les Misérables", "LES MISERABLES"},
+	{"Straße", "Strasse"},
+	{"Łódź", "Lodz"},
+	{"Karel Čapek", "Karel Capek"},
+	{"Nguyễn Du", "Nguyen Du"},
+	{"Ærø", "aero"},
+
+	// Russian, with ё and with the breve of й written separately.
+	{"Ёлка", "Елка"},
+	{"Толстой", "Толстой"},
+	{"Ёжик в тумане", "Ежик в тумане"},
+
+	// Ukrainian and Belarusian, precomposed and combining.
+	{"Україна", "Україна"},
+	{"Їжак", "Іжак"},
+	{"Ўсход", "Усход"},
+	{"Йосип", "Йосип"},
+
+	// Serbian and Macedonian, with the accents of the dictionaries.
+	{"При́ча о Ђо̀рђу", "Прича о Ђорђу"},
+	{"Ѓорѓи", "Ѓорѓи"},
+
+	// Greek.
+	{"Άλφα και Ωμέγα", "αλφα και ωμεγα"},
+
+	// Compatibility forms: full-width, ligatures, numerals, superscripts.
+	{"Ｔｏｌｓｔｏｙ １９９９", "Tolstoy 1999"},
+	{"ﬁnal ﬂight", "final flight"},
+	{"Ⅻ век", "XII век"},
+	{"E=mc²", "E=mc2"},
+}
+
+func sortedIDs(ids []uint32) []uint32 {
+	ids = append([]uint32(nil), ids...)
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+func sortedTrigrams(tt []T) []T {
+	tt = append([]T(nil), tt...)
+	sort.Slice(tt, func(i, j int) bool { return tt[i] < tt[j] })
+	return tt
+}
+
+func TestFoldCorpus(t *testing.T) {
+	idx := NewIndex()
+	for i, tc := range foldCorpus {
+		if a, b := Fold(tc.a), Fold(tc.b); a != b {
+			t.Errorf("Fold(%q) = %q, Fold(%q) = %q", tc.a, a, tc.b, b)
+		}
+		if a, b := sortedTrigrams(trigrams(tc.a)), sortedTrigrams(trigrams(tc.b)); !reflect.DeepEqual(a, b) {
+			t.Errorf("%q and %q have different trigrams", tc.a, tc.b)
+		}
+		idx.Add(uint32(2*i+1), tc.a)
+		idx.Add(uint32(2*i+2), tc.b)
+	}
+
+	for i, tc := range foldCorpus {
+		for _, q := range []string{tc.a, tc.b} {
+			ids := sortedIDs(queryIDs(idx, q))
+			if !contains(ids, uint32(2*i+1)) || !contains(ids, uint32(2*i+2)) {
+				t.Errorf("%q: want %d and %d among %v", q, 2*i+1, 2*i+2, ids)
+			}
+		}
+	}
+
+	for _, tc := range []struct{ a, b string }{
+		{"Толстой", "Толстои"},
+		{"Ґанок", "Ганок"},
+		{"Ђорђе", "Дорде"},
+	} {
+		if Fold(tc.a) == Fold(tc.b) {
+			t.Errorf("%q and %q are folded into the same %q", tc.a, tc.b, Fold(tc.a))
+		}
+	}
+}
+
+func TestSetFolds(t *testing.T) {
+	defer SetFolds(defaultFolds)
+
+	if got := Fold("Йод и ёж"); got != "йод и еж" {
+		t.Errorf("default folds: got %q", got)
+	}
+
+	var buf bytes.Buffer
+	idx := NewIndex()
+	idx.Add(1, "Йод")
+	if _, err := idx.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	folds := DefaultFolds()
+	delete(folds, 'й')
+	folds['Ё'] = "ё"
+	folds['w'] = "v"
+	SetFolds(folds)
+	if got := Fold("Йод и ёж, Wells"); got != "иод и ёж, vells" {
+		t.Errorf("changed folds: got %q", got)
+	}
+	if _, err := NewIndex().ReadFrom(bytes.NewReader(buf.Bytes())); err != ErrFolds {
+		t.Errorf("index made with other folds: want ErrFolds, got %v", err)
+	}
+}
@@ -0,0 +1,241 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package trigram
+
+import (
+	"encoding/binary"
+	"sort"
+)
+
+// blockSize is the number of IDs in a block of a posting list.
+const blockSize = 128
+
+// postings is a sorted list of IDs, stored as varints in blocks of blockSize
+// IDs. The first ID of a block is stored as is, the others as the difference
+// from the previous ID. For the lists longer than a block, the first ID and
+// the offset of every block are kept in skips, so that a cursor can skip the
+// blocks without decoding them.
+type postings struct {
+	data  []byte
+	skips []skip
+	n     uint32 // number of IDs
+	last  uint32 // last ID
+}
+
+type skip struct {
+	first  uint32
+	offset uint32
+}
+
+// newPostings returns a posting list of the sorted IDs.
+func newPostings(ids []uint32) postings {
+	var p postings
+	for _, id := range ids {
+		p.append(id)
+	}
+	return p
+}
+
+// append appends the ID, which must be greater than the last one.
+func (p *postings) append(id uint32) {
+	v := id
+	if p.n%blockSize == 0 {
+		if p.n == blockSize && len(p.skips) == 0 {
+			p.skips = append(p.skips, skip{p.first(), 0})
+		}
+		if p.n >= blockSize {
+			p.skips = append(p.skips, skip{id, uint32(len(p.data))})
+		}
+	} else {
+		v = id - p.last
+	}
+
+	var buf [binary.MaxVarintLen32]byte
+	p.data = append(p.data, buf[:binary.PutUvarint(buf[:], uint64(v))]...)
+	p.n++
+	p.last = id
+}
+
+func (p *postings) first() uint32 {
+	v, _ := binary.Uvarint(p.data)
+	return uint32(v)
+}
+
+// ids returns the IDs of the list.
+func (p *postings) ids() []uint32 {
+	ids := make([]uint32, 0, p.n)
+	c := p.cursor()
+	for c.next() {
+		ids = append(ids, c.id)
+	}
+	return ids
+}
+
+func (p *postings) contains(id uint32) bool {
+	if p.n == 0 || id > p.last {
+		return false
+	}
+	c := p.cursor()
+	return c.seek(id) && c.id == id
+}
+
+// insert inserts the ID unless it is already there, and reports whether it
+// was inserted.
+func (p *postings) insert(id uint32) bool {
+	if p.n == 0 || id > p.last {
+		p.append(id)
+		return true
+	}
+	if p.contains(id) {
+		return false
+	}
+
+	b := p.block(id)
+	ids := p.tail(b)
+	i := sort.Search(len(ids), func(i int) bool { return ids[i] >= id })
+	ids = append(ids, 0)
+	copy(ids[i+1:], ids[i:])
+	ids[i] = id
+	p.truncate(b)
+	for _, id := range ids {
+		p.append(id)
+	}
+	return true
+}
+
+// block returns the index of the block where the ID is or would be.
+func (p *postings) block(id uint32) int {
+	b := sort.Search(len(p.skips), func(i int) bool { return p.skips[i].first > id }) - 1
+	if b < 0 {
+		return 0
+	}
+	return b
+}
+
+// remove removes the sorted IDs, and reports whether any were removed.
+func (p *postings) remove(ids []uint32) bool {
+	if p.n == 0 || ids[0] > p.last {
+		return false
+	}
+
+	// Looking the IDs up is cheaper than decoding the whole list, unless
+	// there are many of them.
+	if len(ids) < 8 {
+		found := false
+		for _, id := range ids {
+			if p.contains(id) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	// Only the blocks from the one with the first ID on are re-encoded.
+	b := p.block(ids[0])
+	tail := p.tail(b)
+	kept := remove(tail, ids)
+	if len(kept) == len(tail) {
+		return false
+	}
+	p.truncate(b)
+	for _, id := range kept {
+		p.append(id)
+	}
+	if len(p.skips) == 1 {
+		p.skips = nil
+	}
+	return true
+}
+
+// tail returns the IDs from block b on.
+func (p *postings) tail(b int) []uint32 {
+	c := p.cursor()
+	if b > 0 {
+		c.pos = uint32(b) * blockSize
+		c.off = int(p.skips[b].offset)
+	}
+	ids := make([]uint32, 0, p.n-c.pos)
+	for c.next() {
+		ids = append(ids, c.id)
+	}
+	return ids
+}
+
+// truncate removes the IDs from block b on.
+func (p *postings) truncate(b int) {
+	if b == 0 {
+		*p = postings{data: p.data[:0]}
+		return
+	}
+	p.data = p.data[:p.skips[b].offset]
+	p.skips = p.skips[:b]
+	p.n = uint32(b) * blockSize
+}
+
+// cursor returns a cursor positioned before the first ID of the list.
+func (p *postings) cursor() cursor {
+	return cursor{p: p}
+}
+
+// cursor iterates over the IDs of a posting list in increasing order.
+type cursor struct {
+	p   *postings
+	pos uint32 // number of IDs read
+	off int    // offset of the next ID in p.data
+	id  uint32 // the current ID
+}
+
+// next moves to the next ID, and reports whether there is one.
+func (c *cursor) next() bool {
+	if c.pos == c.p.n {
+		return false
+	}
+
+	v, n := binary.Uvarint(c.p.data[c.off:])
+	c.off += n
+	if c.pos%blockSize == 0 {
+		c.id = uint32(v)
+	} else {
+		c.id += uint32(v)
+	}
+	c.pos++
+	return true
+}
+
+// seek moves to the first ID not less than id, and reports whether there
+// is one. The cursor never moves backwards.
+func (c *cursor) seek(id uint32) bool {
+	if c.pos > 0 && c.id >= id {
+		return true
+	}
+	if id > c.p.last {
+		c.pos = c.p.n
+		return false
+	}
+
+	if b := c.p.block(id); uint32(b)*blockSize > c.pos {
+		c.pos = uint32(b) * blockSize
+		c.off = int(c.p.skips[b].offset)
+	}
+
+	for c.next() {
+		if c.id >= id {
+			return true
+		}
+	}
+	return false
+}
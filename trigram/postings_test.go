@@ -0,0 +1,174 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package trigram
+
+import (
+	"math/rand"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// randomIDs returns n distinct sorted IDs below max.
+func randomIDs(rnd *rand.Rand, n, max int) []uint32 {
+	m := make(map[uint32]bool, n)
+	for len(m) < n {
+		m[uint32(rnd.Intn(max))] = true
+	}
+	ids := make([]uint32, 0, n)
+	for id := range m {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+func TestPostings(t *testing.T) {
+	rnd := rand.New(rand.NewSource(4))
+	for _, n := range []int{1, 2, blockSize - 1, blockSize, blockSize + 1, 1000} {
+		ids := randomIDs(rnd, n, 4*n+10)
+		ids[len(ids)-1] = 0xffffffff
+		p := newPostings(ids)
+
+		if got := p.ids(); !reflect.DeepEqual(got, ids) {
+			t.Fatalf("%d IDs: got %v back", n, got)
+		}
+		if want := (n-1)/blockSize + 1; n > blockSize && len(p.skips) != want {
+			t.Errorf("%d IDs: want %d skips, got %d", n, want, len(p.skips))
+		}
+
+		for id := uint32(0); id < uint32(4*n+12); id++ {
+			if got, want := p.contains(id), contains(ids, id); got != want {
+				t.Fatalf("%d IDs: contains(%d) = %v, want %v", n, id, got, want)
+			}
+		}
+
+		// Seeking forward by random steps from a single cursor.
+		c := p.cursor()
+		for id := uint32(0); id < uint32(4*n+12); id += uint32(rnd.Intn(300)) {
+			i := sort.Search(len(ids), func(i int) bool { return ids[i] >= id })
+			ok := c.seek(id)
+			if ok != (i < len(ids)) || ok && c.id != ids[i] {
+				t.Fatalf("%d IDs: seek(%d) = %v, %d", n, id, ok, c.id)
+			}
+		}
+	}
+}
+
+func TestPostingsInsertRemove(t *testing.T) {
+	rnd := rand.New(rand.NewSource(5))
+	ids := randomIDs(rnd, 600, 3000)
+
+	var p postings
+	for _, i := range rnd.Perm(len(ids)) {
+		p.insert(ids[i])
+	}
+	if !reflect.DeepEqual(p, newPostings(ids)) {
+		t.Fatal("inserting in random order differs from appending in order")
+	}
+
+	removed := randomIDs(rnd, 100, 3000)
+	p.remove(removed)
+	if want := newPostings(remove(append([]uint32(nil), ids...), removed)); !reflect.DeepEqual(p, want) {
+		t.Error("removing IDs differs from making the list without them")
+	}
+}
+
+// naiveQuery returns the IDs which are in at least threshold of the lists.
+func naiveQuery(lists [][]uint32, threshold int) []uint32 {
+	m := make(map[uint32]int)
+	for _, ids := range lists {
+		for _, id := range ids {
+			m[id]++
+		}
+	}
+	var ids []uint32
+	for id, n := range m {
+		if n >= threshold {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+// newTerms makes a term of each list, the IDs of which are split between two
+// fields at random.
+func newTerms(rnd *rand.Rand, lists [][]uint32) []*term {
+	stats := &[2]fieldStats{{boost: 1}, {boost: 1}}
+	split := make([][2][]uint32, len(lists))
+	for i, ids := range lists {
+		for _, id := range ids {
+			f := rnd.Intn(2)
+			split[i][f] = append(split[i][f], id)
+			stats[f].inc(id)
+		}
+	}
+
+	terms := make([]*term, len(lists))
+	for i := range split {
+		terms[i] = new(term)
+		for f, ids := range split[i] {
+			if len(ids) > 0 {
+				p := newPostings(ids)
+				terms[i].add(&p, &stats[f])
+			}
+		}
+	}
+	return terms
+}
+
+func TestMatch(t *testing.T) {
+	rnd := rand.New(rand.NewSource(6))
+	for iter := 0; iter < 50; iter++ {
+		k := rnd.Intn(8) + 1
+		lists := make([][]uint32, k)
+		for i := range lists {
+			lists[i] = randomIDs(rnd, rnd.Intn(1500)+1, 5000)
+		}
+
+		for threshold := 1; threshold <= k+1; threshold++ {
+			ids, scores := match(newTerms(rnd, lists), threshold)
+			if want := naiveQuery(lists, threshold); !reflect.DeepEqual(ids, want) {
+				t.Fatalf("%d lists, threshold %d: got %d IDs, want %d", k, threshold, len(ids), len(want))
+			}
+			for i, s := range scores {
+				if s <= 0 {
+					t.Fatalf("%d lists, threshold %d: ID %d has the score of %v", k, threshold, ids[i], s)
+				}
+			}
+		}
+	}
+}
+
+func TestQueryTrigrams(t *testing.T) {
+	idx := NewIndex()
+	idx.Add(1, "Лев Толстой")
+	idx.Add(2, "Алексей Толстой")
+	idx.Add(3, "Алексей Толстой (младший)")
+	idx.Add(4, "Достоевский")
+
+	if got := queryIDs(idx, "Алексей Толстой"); !reflect.DeepEqual(got, []uint32{2, 3}) {
+		t.Errorf("Алексей Толстой: want [2 3], got %v", got)
+	}
+	if got := queryIDs(idx, "Толстой"); !reflect.DeepEqual(got, []uint32{1, 2, 3}) {
+		t.Errorf("Толстой: want [1 2 3], got %v", got)
+	}
+	if rr := idx.QueryAll(Extract("Алексей Толстой")); len(rr) != 2 || rr[0].ID != 2 || rr[1].ID != 3 {
+		t.Errorf("all of Алексей Толстой: want [2 3], got %v", rr)
+	}
+	if got := idx.QueryAll(Extract("Толстой Шмолстой")); len(got) != 0 {
+		t.Errorf("all of Толстой Шмолстой: want nothing, got %v", got)
+	}
+}
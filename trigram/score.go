@@ -0,0 +1,265 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package trigram
+
+import (
+	"math"
+	"sort"
+)
+
+// The IDs are scored like in BM25, a trigram counting as a term which
+// occurs once: each matching trigram adds its IDF in the field, scaled down
+// for the IDs longer than the average in that field, and multiplied by the
+// boost of the field.
+const (
+	bm25K1 = 1.2
+	bm25B  = 0.75
+)
+
+// fieldStats are the lengths of the IDs in a field, in trigrams.
+type fieldStats struct {
+	boost   float64
+	lengths []uint8 // indexed by ID, up to 255
+	docs    uint32  // number of IDs having the field
+	total   uint64  // sum of the lengths
+}
+
+// inc increments the length of the ID.
+func (s *fieldStats) inc(id uint32) {
+	if int(id) >= len(s.lengths) {
+		s.lengths = append(s.lengths, make([]uint8, int(id)+1-len(s.lengths))...)
+	}
+	l := s.lengths[id]
+	if l == 0 {
+		s.docs++
+	}
+	if l < math.MaxUint8 {
+		s.lengths[id]++
+		s.total++
+	}
+}
+
+// clear clears the length of the ID. The lengths are trimmed so that they
+// do not depend on the IDs removed before.
+func (s *fieldStats) clear(id uint32) {
+	if int(id) >= len(s.lengths) || s.lengths[id] == 0 {
+		return
+	}
+	s.docs--
+	s.total -= uint64(s.lengths[id])
+	s.lengths[id] = 0
+
+	n := len(s.lengths)
+	for n > 0 && s.lengths[n-1] == 0 {
+		n--
+	}
+	if n == 0 {
+		s.lengths = nil
+	} else {
+		s.lengths = s.lengths[:n]
+	}
+}
+
+// idf returns the inverse document frequency of a trigram which df IDs have.
+func (s *fieldStats) idf(df uint32) float64 {
+	return math.Log(1 + (float64(s.docs)-float64(df)+0.5)/(float64(df)+0.5))
+}
+
+// norm returns the length normalization factor of the ID, which is 1 for
+// the IDs of the average length.
+func (s *fieldStats) norm(id uint32) float64 {
+	avg := float64(s.total) / float64(s.docs)
+	return (bm25K1 + 1) / (1 + bm25K1*(1-bm25B+bm25B*float64(s.lengths[id])/avg))
+}
+
+// term is a trigram of a query: the union of its posting lists in the
+// fields searched.
+type term struct {
+	parts   []termPart
+	n       uint32 // number of IDs in all the lists
+	id      uint32 // the current ID
+	started bool
+	done    bool
+}
+
+type termPart struct {
+	c     cursor
+	stats *fieldStats
+	w     float64 // weight of the trigram in the field
+	live  bool
+}
+
+func (t *term) add(p *postings, stats *fieldStats) {
+	t.parts = append(t.parts, termPart{
+		c:     p.cursor(),
+		stats: stats,
+		w:     stats.boost * stats.idf(p.n),
+		live:  true,
+	})
+	t.n += p.n
+}
+
+// next moves to the next ID in any of the lists, and reports whether there
+// is one.
+func (t *term) next() bool {
+	if t.done {
+		return false
+	}
+	for i := range t.parts {
+		p := &t.parts[i]
+		if p.live && (!t.started || p.c.id == t.id) {
+			p.live = p.c.next()
+		}
+	}
+	t.started = true
+	return t.min()
+}
+
+// seek moves to the first ID not less than id, and reports whether there
+// is one.
+func (t *term) seek(id uint32) bool {
+	if t.done {
+		return false
+	}
+	if t.started && t.id >= id {
+		return true
+	}
+	for i := range t.parts {
+		p := &t.parts[i]
+		if p.live {
+			p.live = p.c.seek(id)
+		}
+	}
+	t.started = true
+	return t.min()
+}
+
+func (t *term) min() bool {
+	t.done = true
+	for i := range t.parts {
+		p := &t.parts[i]
+		if p.live && (t.done || p.c.id < t.id) {
+			t.id = p.c.id
+			t.done = false
+		}
+	}
+	return !t.done
+}
+
+// score returns the score of the current ID for the trigram.
+func (t *term) score() float64 {
+	s := 0.0
+	for i := range t.parts {
+		p := &t.parts[i]
+		if p.live && p.c.id == t.id {
+			s += p.w * p.stats.norm(t.id)
+		}
+	}
+	return s
+}
+
+// match returns the IDs which have at least threshold of the terms, along
+// with their scores. An ID having threshold of the terms has at least one
+// of any len(terms)-threshold+1 of them, so the candidates are taken from
+// the shortest terms, and looked up in the others.
+func match(terms []*term, threshold int) ([]uint32, []float64) {
+	if threshold < 1 {
+		threshold = 1
+	}
+	if len(terms) < threshold {
+		return nil, nil
+	}
+	sort.SliceStable(terms, func(i, j int) bool { return terms[i].n < terms[j].n })
+
+	// A k-way merge of the shortest terms.
+	k := len(terms) - threshold + 1
+	h := termHeap(make([]*term, 0, k))
+	for _, t := range terms[:k] {
+		if t.next() {
+			h = append(h, t)
+		}
+	}
+	h.init()
+
+	var ids []uint32
+	var scores []float64
+	for len(h) > 0 {
+		id := h[0].id
+		n, score := 0, 0.0
+		for len(h) > 0 && h[0].id == id {
+			n++
+			score += h[0].score()
+			if h[0].next() {
+				h.fix()
+			} else {
+				h.pop()
+			}
+		}
+
+		for i := k; i < len(terms) && n+len(terms)-i >= threshold; i++ {
+			t := terms[i]
+			if t.seek(id) && t.id == id {
+				n++
+				score += t.score()
+			}
+		}
+
+		if n >= threshold {
+			ids = append(ids, id)
+			scores = append(scores, score)
+		}
+	}
+
+	return ids, scores
+}
+
+// termHeap is a min-heap of terms ordered by their current IDs.
+type termHeap []*term
+
+func (h termHeap) init() {
+	for i := len(h)/2 - 1; i >= 0; i-- {
+		h.down(i)
+	}
+}
+
+// fix restores the heap after the ID of the top term has increased.
+func (h termHeap) fix() {
+	h.down(0)
+}
+
+func (h *termHeap) pop() {
+	old := *h
+	n := len(old) - 1
+	old[0] = old[n]
+	*h = old[:n]
+	h.down(0)
+}
+
+func (h termHeap) down(i int) {
+	for {
+		l := 2*i + 1
+		if l >= len(h) {
+			return
+		}
+		m := l
+		if r := l + 1; r < len(h) && h[r].id < h[l].id {
+			m = r
+		}
+		if h[i].id <= h[m].id {
+			return
+		}
+		h[i], h[m] = h[m], h[i]
+		i = m
+	}
+}
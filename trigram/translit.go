@@ -0,0 +1,98 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package trigram
+
+import (
+	"strings"
+	"unicode"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// The shadow form of a string is its Cyrillic letters transliterated into
+// Latin, and then the spellings which differ between the transliteration
+// schemes folded into one: Стругацкий, Strugatsky, Strugatskij and
+// Strugackij all become strugacki.
+
+// translitRunes transliterates the Cyrillic letters, and the letters with
+// diacritics used by GOST 7.79 and ISO 9, into plain Latin.
+var translitRunes = map[rune]string{
+	'а': "a", 'б': "b", 'в': "v", 'г': "g", 'д': "d", 'е': "e", 'ё': "e",
+	'ж': "zh", 'з': "z", 'и': "i", 'й': "i", 'к': "k", 'л': "l", 'м': "m",
+	'н': "n", 'о': "o", 'п': "p", 'р': "r", 'с': "s", 'т': "t", 'у': "u",
+	'ф': "f", 'х': "h", 'ц': "c", 'ч': "ch", 'ш': "sh", 'щ': "sh", 'ъ': "",
+	'ы': "i", 'ь': "", 'э': "e", 'ю': "iu", 'я': "ia",
+
+	// Ukrainian, Belarusian, Serbian and Macedonian.
+	'і': "i", 'ї': "i", 'є': "e", 'ґ': "g", 'ў': "u", 'ј': "i", 'љ': "l",
+	'њ': "n", 'ћ': "c", 'ђ': "d", 'џ': "dzh", 'ѓ': "g", 'ќ': "k", 'ѕ': "dz",
+
+	'š': "sh", 'ž': "zh", 'č': "ch", 'ŝ': "sh", 'ë': "e", 'ê': "e", 'è': "e",
+	'ï': "i", 'ì': "i", 'û': "iu", 'ù': "u", 'â': "ia", 'à': "a", 'ǵ': "g",
+	'ǩ': "k", 'ʺ': "", 'ʹ': "", 'ʼ': "",
+}
+
+// translitFolder folds the spellings of the same sounds in the informal, the
+// English and the German schemes. j and y are folded into i, and so are the
+// endings -ij, -iy and -y, once the repeated letters are collapsed; yo and ye
+// (Pyotr, Dostoyevsky) are folded into e, as ё and е are.
+var translitFolder = strings.NewReplacer(
+	"shch", "sh",
+	"tsch", "ch",
+	"sch", "sh",
+	"tch", "ch",
+	"kh", "h",
+	"ts", "c",
+	"tz", "c",
+	"yo", "e",
+	"jo", "e",
+	"io", "e",
+	"ye", "e",
+	"je", "e",
+	"ie", "e",
+	"j", "i",
+	"y", "i",
+	"w", "v",
+	"x", "ks",
+)
+
+// Translit returns the shadow form of s, which is the same for the Cyrillic
+// string and its common transliterations. The letters which are not
+// transliterated are folded (see Fold).
+func Translit(s string) string {
+	s = norm.NFC.String(s)
+	b := make([]byte, 0, len(s))
+	for _, r := range s {
+		r = unicode.ToLower(r)
+		if t, ok := translitRunes[r]; ok {
+			b = append(b, t...)
+		} else {
+			b = appendFolded(b, r)
+		}
+	}
+
+	// The repeated letters are collapsed only in Latin.
+	b = []byte(translitFolder.Replace(string(b)))
+	var prev byte
+	n := 0
+	for _, c := range b {
+		if c == prev && 'a' <= c && c <= 'z' {
+			continue
+		}
+		b[n] = c
+		n++
+		prev = c
+	}
+	return string(b[:n])
+}
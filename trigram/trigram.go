@@ -17,21 +17,60 @@ package trigram
 import (
 	"hash/crc32"
 	"sort"
+	"strings"
 	"unicode"
 	"unicode/utf8"
 )
 
-// T is a trigram.
+// T is a trigram. The trigrams of the shadow form of a string (see Translit)
+// have the shadow bit set, and are otherwise the same as those of a string.
+// A trigram is a 23-bit hash below the shadow bit, so that a trigram and its
+// shadow are always distinct and both fit in the 24 bits of a key; the price
+// is twice as many collisions between the hashes of different trigrams, which
+// at most add a few false candidates.
 type T uint32
 
-const tAllIDs T = 0xffffffff
+const shadow T = 1 << 23
 
-// Index is a trigram index.
-type Index map[T][]uint32
+// Field is a part of the strings indexed under an ID, such as a title or an
+// author's name, which is matched and scored separately.
+type Field uint8
 
-// NewIndex returns a new trigram index.
-func NewIndex() Index {
-	return make(Index)
+// MaxFields is the maximum number of fields in an index.
+const MaxFields = 8
+
+// key is a trigram in a field: the field is kept in the upper bits, above
+// the 24 bits of the trigram.
+type key uint32
+
+func mkKey(f Field, t T) key {
+	return key(f)<<24 | key(t)
+}
+
+func (k key) field() Field {
+	return Field(k >> 24)
+}
+
+// Index is a trigram index. The IDs having each trigram in each field are
+// kept in a compressed posting list.
+type Index struct {
+	lists  map[key]postings
+	fields [MaxFields]fieldStats
+}
+
+// NewIndex returns a new trigram index, in which all the fields have the
+// boost of 1.
+func NewIndex() *Index {
+	idx := &Index{lists: make(map[key]postings)}
+	for f := range idx.fields {
+		idx.fields[f].boost = 1
+	}
+	return idx
+}
+
+// SetBoost sets the weight of the matches in the field.
+func (idx *Index) SetBoost(f Field, boost float64) {
+	idx.fields[f].boost = boost
 }
 
 func mkT(rr [3]rune) T {
@@ -39,30 +78,41 @@ func mkT(rr [3]rune) T {
 	n := utf8.EncodeRune(p[0:], rr[0])
 	n += utf8.EncodeRune(p[n:], rr[1])
 	n += utf8.EncodeRune(p[n:], rr[2])
-	return T((crc32.ChecksumIEEE(p[:n]) >> 6) & 0xffffff)
+	return T((crc32.ChecksumIEEE(p[:n]) >> 6) & 0x7fffff)
 }
 
-func normalize(r rune) rune {
-	if r == 'ё' {
-		return 'е'
+func hasTrigram(tt []T, t T) bool {
+	for _, v := range tt {
+		if v == t {
+			return true
+		}
 	}
-	return r
+	return false
 }
 
 func appendUnique(tt []T, t T) []T {
-	for _, v := range tt {
-		if v == t {
-			return tt
-		}
+	if hasTrigram(tt, t) {
+		return tt
 	}
 	return append(tt, t)
 }
 
-// Extract returns a slice of all the unique trigrams in s.
+// Extract returns a slice of all the unique trigrams in s, followed by those
+// of its shadow form.
 func Extract(s string) []T {
+	tt := trigrams(s)
+	for _, t := range trigrams(Translit(s)) {
+		tt = appendUnique(tt, t|shadow)
+	}
+	return tt
+}
+
+// trigrams returns the unique trigrams of the folded s (see Fold).
+func trigrams(s string) []T {
 	if s == "" {
 		return nil
 	}
+	s = Fold(s)
 
 	rr := [3]rune{' ', ' ', ' '}
 	tt := make([]T, 0, len(s))
@@ -80,7 +130,7 @@ func Extract(s string) []T {
 		i += size
 
 		if unicode.IsLetter(r) {
-			rr[2] = normalize(unicode.ToLower(r))
+			rr[2] = r
 		} else if unicode.IsDigit(r) {
 			rr[2] = r
 		} else if rr[1] != ' ' && unicode.IsSpace(r) {
@@ -102,90 +152,274 @@ func Extract(s string) []T {
 	return tt
 }
 
-// Add adds a string under the given ID.
-func (idx Index) Add(id uint32, s string) {
+// ExtractWords returns a slice of the unique trigrams of the words in s, and
+// of their shadow forms, leaving out the trigram which marks the start of
+// each word as the start of the string. All of them are found in any string
+// which has the words of s in a row.
+func ExtractWords(s string) []T {
+	var tt []T
+	for _, w := range strings.Fields(s) {
+		if wt := trigrams(w); len(wt) > 0 {
+			for _, t := range wt[1:] {
+				tt = appendUnique(tt, t)
+			}
+		}
+		if wt := trigrams(Translit(w)); len(wt) > 0 {
+			for _, t := range wt[1:] {
+				tt = appendUnique(tt, t|shadow)
+			}
+		}
+	}
+	return tt
+}
+
+// Add adds a string under the given ID, in the field 0.
+func (idx *Index) Add(id uint32, s string) {
 	idx.AddTrigrams(id, Extract(s))
 }
 
-// AddTrigrams adds a slice of trigrams under the given ID.
-func (idx Index) AddTrigrams(id uint32, tt []T) {
-	if len(tt) == 0 {
-		return
+// AddTrigrams adds a slice of trigrams under the given ID, in the field 0.
+func (idx *Index) AddTrigrams(id uint32, tt []T) {
+	idx.AddFieldTrigrams(id, 0, tt)
+}
+
+// AddFieldTrigrams adds a slice of trigrams under the given ID in the field.
+// The IDs can be added in any order, but adding them in increasing order is
+// the fastest. The shadow trigrams which are also among the trigrams of the
+// strings themselves, as for a Latin string the shadow form of which is the
+// same, are not added: the shadow trigrams of a query are looked for among
+// both.
+func (idx *Index) AddFieldTrigrams(id uint32, f Field, tt []T) {
+	stats := &idx.fields[f]
+	for _, t := range tt {
+		if t&shadow != 0 && hasTrigram(tt, t&^shadow) {
+			continue
+		}
+		k := mkKey(f, t)
+		p := idx.lists[k]
+		if p.insert(id) {
+			idx.lists[k] = p
+			stats.inc(id)
+		}
 	}
+}
 
-	allIDs := idx[tAllIDs]
-	l := len(allIDs)
-	if l > 0 && allIDs[l-1] > id {
-		panic("out of order")
+// Remove removes the IDs from the index. Every posting list is looked at,
+// so it is much faster to remove many IDs at once than one by one.
+func (idx *Index) Remove(ids ...uint32) {
+	if len(ids) == 0 {
+		return
 	}
-	if l == 0 || allIDs[l-1] != id {
-		idx[tAllIDs] = append(allIDs, id)
+
+	sorted := make([]uint32, len(ids))
+	copy(sorted, ids)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	for k, p := range idx.lists {
+		if !p.remove(sorted) {
+			continue
+		}
+		if p.n == 0 {
+			delete(idx.lists, k)
+		} else {
+			idx.lists[k] = p
+		}
 	}
 
-	for _, t := range tt {
-		idxt := idx[t]
-		l := len(idxt)
-		if l == 0 || idxt[l-1] != id {
-			idx[t] = append(idxt, id)
+	for f := range idx.fields {
+		for _, id := range ids {
+			idx.fields[f].clear(id)
 		}
 	}
 }
 
-// Query returns a slice of IDs that match the trigrams in the query s.
-func (idx Index) Query(s string) []uint32 {
-	return idx.QueryTrigrams(Extract(s))
+// Update replaces the trigrams of the ID with tt, in the field 0.
+func (idx *Index) Update(id uint32, tt []T) {
+	idx.Remove(id)
+	idx.AddTrigrams(id, tt)
 }
 
-type byRelevance struct {
-	ids []uint32
-	rel []uint32
+func contains(ids []uint32, id uint32) bool {
+	i := sort.Search(len(ids), func(i int) bool { return ids[i] >= id })
+	return i < len(ids) && ids[i] == id
 }
 
-func (p byRelevance) Len() int           { return len(p.ids) }
-func (p byRelevance) Less(i, j int) bool { return p.rel[i] > p.rel[j] }
-func (p byRelevance) Swap(i, j int) {
-	p.ids[i], p.ids[j] = p.ids[j], p.ids[i]
-	p.rel[i], p.rel[j] = p.rel[j], p.rel[i]
-}
+// remove removes the sorted IDs from the sorted list in place. The IDs are
+// looked up in the list or the other way round, whichever is shorter.
+func remove(list, ids []uint32) []uint32 {
+	if len(list) <= len(ids) {
+		n := 0
+		for _, id := range list {
+			if !contains(ids, id) {
+				list[n] = id
+				n++
+			}
+		}
+		return list[:n]
+	}
 
-func min(a, b int) int {
-	if a < b {
-		return a
+	n, i := 0, 0
+	for _, id := range ids {
+		k := i + sort.Search(len(list)-i, func(k int) bool { return list[i+k] >= id })
+		if k == len(list) {
+			break
+		}
+		if list[k] != id {
+			continue
+		}
+		n += copy(list[n:], list[i:k])
+		i = k + 1
 	}
-	return b
+	if i == 0 {
+		return list
+	}
+	n += copy(list[n:], list[i:])
+	return list[:n]
 }
 
-// QueryTrigrams returns a slice of IDs that match the given set of trigrams.
-func (idx Index) QueryTrigrams(tt []T) []uint32 {
-	if len(tt) == 0 {
-		return nil
+// Result is an ID found by a query. The better the ID matches the query,
+// the higher its score.
+type Result struct {
+	ID    uint32
+	Score float64
+}
+
+// Query returns the IDs that match the trigrams in the query s.
+func (idx *Index) Query(s string) []Result {
+	return idx.QueryTrigrams(Extract(s))
+}
+
+// terms returns the terms of the trigrams found in any of the fields, or in
+// any field at all if no fields are given. A shadow trigram is also looked
+// for without the shadow bit.
+func (idx *Index) terms(tt []T, fields []Field) []*term {
+	if len(fields) == 0 {
+		fields = allFields[:]
 	}
 
-	l := 0
+	terms := make([]*term, 0, len(tt))
 	for _, t := range tt {
-		l += len(idx[t])
+		vv, n := [2]T{t, t &^ shadow}, 1
+		if t&shadow != 0 {
+			n = 2
+		}
+
+		var tm *term
+		for _, f := range fields {
+			for _, v := range vv[:n] {
+				p, ok := idx.lists[mkKey(f, v)]
+				if !ok {
+					continue
+				}
+				if tm == nil {
+					tm = new(term)
+					terms = append(terms, tm)
+				}
+				tm.add(&p, &idx.fields[f])
+			}
+		}
+	}
+	return terms
+}
+
+var allFields = func() (ff [MaxFields]Field) {
+	for f := range ff {
+		ff[f] = Field(f)
 	}
-	l = min(l, len(idx[tAllIDs]))
+	return
+}()
 
-	m := make(map[uint32]uint32, l)
+// query returns the IDs which have at least the threshold of either the
+// trigrams of the strings in the fields, or of the shadow trigrams, the best
+// matches first. The IDs found by both keep the better score.
+func (idx *Index) query(tt []T, fields []Field, threshold func(n int) int) []Result {
+	var plain, shadows []T
 	for _, t := range tt {
-		for _, id := range idx[t] {
-			m[id]++
+		if t&shadow == 0 {
+			plain = append(plain, t)
+		} else {
+			shadows = append(shadows, t)
 		}
 	}
 
-	threshold := uint32(float64(len(tt)) * 0.75)
-	ids := make([]uint32, 0, len(m))
-	rel := make([]uint32, 0, len(m))
-	for id := range m {
-		r := m[id]
-		if r >= threshold {
-			ids = append(ids, id)
-			rel = append(rel, r)
+	scores := make(map[uint32]float64)
+	for _, tt := range [][]T{plain, shadows} {
+		if len(tt) == 0 {
+			continue
+		}
+		ids, ss := match(idx.terms(tt, fields), threshold(len(tt)))
+		for i, id := range ids {
+			if ss[i] > scores[id] {
+				scores[id] = ss[i]
+			}
 		}
 	}
+	if len(scores) == 0 {
+		return nil
+	}
+
+	results := make([]Result, 0, len(scores))
+	for id, score := range scores {
+		results = append(results, Result{id, score})
+	}
+	sort.Slice(results, func(i, j int) bool {
+		a, b := results[i], results[j]
+		return a.Score > b.Score || a.Score == b.Score && a.ID < b.ID
+	})
+
+	return results
+}
+
+// QueryTrigrams returns the IDs that match the given set of trigrams: those
+// which have at least 3/4 of them, or of their shadow trigrams, in any of the
+// fields, the best matches first. The rarer a trigram is in a field, the
+// more it adds to the score, and the matches in shorter strings score higher.
+func (idx *Index) QueryTrigrams(tt []T) []Result {
+	return idx.QueryFields(tt)
+}
 
-	sort.Sort(byRelevance{ids, rel})
+// QueryFields is QueryTrigrams looking only in the given fields.
+func (idx *Index) QueryFields(tt []T, fields ...Field) []Result {
+	return idx.query(tt, fields, strictThreshold)
+}
+
+// strictThreshold is the number of the n trigrams of a query which
+// QueryFields requires.
+func strictThreshold(n int) int {
+	return n * 3 / 4
+}
+
+// relaxedRatios are the ratios of the trigrams of a query which QueryRelaxed
+// requires in turn.
+var relaxedRatios = []float64{0.75, 0.6, 0.5}
+
+// minRelaxed is the least number of trigrams QueryRelaxed requires.
+const minRelaxed = 3
+
+// QueryRelaxed is QueryFields which, while fewer than n IDs are found,
+// requires fewer of the trigrams, down to a half of them but no fewer than
+// three, so that a misspelled query still finds something. It never requires
+// more of them than QueryFields does.
+func (idx *Index) QueryRelaxed(tt []T, n int, fields ...Field) []Result {
+	var results []Result
+	for _, ratio := range relaxedRatios {
+		results = idx.query(tt, fields, func(m int) int {
+			t := int(float64(m) * ratio)
+			if t < minRelaxed {
+				t = minInt(minRelaxed, m)
+			}
+			return minInt(t, strictThreshold(m))
+		})
+		if len(results) >= n {
+			break
+		}
+	}
+	return results
+}
 
-	return ids
+// QueryAll returns the IDs which have all of the trigrams, or all of the
+// shadow trigrams, each in any of the given fields, or in any field if none
+// are given, the best matches first.
+func (idx *Index) QueryAll(tt []T, fields ...Field) []Result {
+	return idx.query(tt, fields, func(n int) int { return n })
 }
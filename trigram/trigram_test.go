@@ -0,0 +1,373 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package trigram
+
+import (
+	"math/rand"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+var words = strings.Fields("война мир полдень звезда дорога тень город море night star road ёлка")
+
+// randomDocs returns n random strings keyed by distinct random IDs.
+func randomDocs(rnd *rand.Rand, n int) map[uint32]string {
+	docs := make(map[uint32]string, n)
+	for len(docs) < n {
+		var ww []string
+		for i := rnd.Intn(4) + 1; i > 0; i-- {
+			ww = append(ww, words[rnd.Intn(len(words))])
+		}
+		docs[uint32(rnd.Intn(10*n))+1] = strings.Join(ww, " ")
+	}
+	return docs
+}
+
+// build indexes the docs in increasing order of their IDs.
+func build(docs map[uint32]string) *Index {
+	ids := make([]uint32, 0, len(docs))
+	for id := range docs {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	idx := NewIndex()
+	for _, id := range ids {
+		idx.Add(id, docs[id])
+	}
+	return idx
+}
+
+// queryIDs returns the IDs found by idx.Query.
+func queryIDs(idx *Index, s string) []uint32 {
+	var ids []uint32
+	for _, r := range idx.Query(s) {
+		ids = append(ids, r.ID)
+	}
+	return ids
+}
+
+func checkSorted(t *testing.T, idx *Index) {
+	t.Helper()
+	for k, p := range idx.lists {
+		ids := p.ids()
+		if len(ids) != int(p.n) || len(ids) == 0 || ids[len(ids)-1] != p.last {
+			t.Fatalf("posting list of %x is inconsistent: %v, n = %d, last = %d", k, ids, p.n, p.last)
+		}
+		for i := 1; i < len(ids); i++ {
+			if ids[i-1] >= ids[i] {
+				t.Fatalf("posting list of %x is not sorted: %v", k, ids)
+			}
+		}
+	}
+}
+
+func TestAddOutOfOrder(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	docs := randomDocs(rnd, 200)
+
+	idx := NewIndex()
+	for id, s := range docs { // random order
+		idx.Add(id, s)
+	}
+	idx.Add(1, "")
+
+	checkSorted(t, idx)
+	if want := build(docs); !reflect.DeepEqual(idx, want) {
+		t.Error("index built out of order differs from the one built in order")
+	}
+}
+
+func TestAddTwice(t *testing.T) {
+	idx := NewIndex()
+	idx.Add(2, "мир")
+	idx.Add(1, "мир")
+	idx.Add(2, "мир")
+
+	for k, p := range idx.lists {
+		if got := p.ids(); !reflect.DeepEqual(got, []uint32{1, 2}) {
+			t.Errorf("%x: want IDs [1 2], got %v", k, got)
+		}
+	}
+}
+
+func TestRemove(t *testing.T) {
+	idx := NewIndex()
+	idx.Add(1, "война и мир")
+	idx.Add(2, "мир")
+	idx.Add(3, "война")
+
+	idx.Remove(2)
+	if got := queryIDs(idx, "мир"); !reflect.DeepEqual(got, []uint32{1}) {
+		t.Errorf("мир: want [1], got %v", got)
+	}
+
+	idx.Remove(1, 3)
+	if len(idx.lists) != 0 || !reflect.DeepEqual(idx, NewIndex()) {
+		t.Errorf("want an empty index, got %v", idx)
+	}
+
+	idx.Remove(4)
+}
+
+func TestRemoveMany(t *testing.T) {
+	rnd := rand.New(rand.NewSource(2))
+	for _, n := range []int{1, 10, 500} {
+		docs := randomDocs(rnd, 1000)
+		idx := build(docs)
+
+		var removed []uint32
+		for id := range docs {
+			if len(removed) == n {
+				break
+			}
+			removed = append(removed, id)
+			delete(docs, id)
+		}
+		removed = append(removed, 0, 100000) // not in the index
+		idx.Remove(removed...)
+
+		checkSorted(t, idx)
+		if want := build(docs); !reflect.DeepEqual(idx, want) {
+			t.Errorf("removing %d IDs: index differs from the one built without them", n)
+		}
+	}
+}
+
+func TestUpdate(t *testing.T) {
+	rnd := rand.New(rand.NewSource(3))
+	docs := randomDocs(rnd, 500)
+	idx := build(docs)
+
+	i := 0
+	for id := range docs {
+		if i == 50 {
+			break
+		}
+		i++
+		s := words[rnd.Intn(len(words))]
+		docs[id] = s
+		idx.Update(id, Extract(s))
+	}
+
+	checkSorted(t, idx)
+	if want := build(docs); !reflect.DeepEqual(idx, want) {
+		t.Error("updated index differs from the one built from the updated strings")
+	}
+}
+
+func TestUpdateQuery(t *testing.T) {
+	idx := NewIndex()
+	idx.Add(1, "Лев Толстой")
+	idx.Add(2, "Алексей Толстой")
+
+	idx.Update(1, Extract("Фёдор Достоевский"))
+	if got := queryIDs(idx, "Толстой"); !reflect.DeepEqual(got, []uint32{2}) {
+		t.Errorf("Толстой: want [2], got %v", got)
+	}
+	if got := queryIDs(idx, "Федор Достоевский"); !reflect.DeepEqual(got, []uint32{1}) {
+		t.Errorf("Федор Достоевский: want [1], got %v", got)
+	}
+
+	idx.Update(1, nil)
+	if got := queryIDs(idx, "Достоевский"); len(got) != 0 {
+		t.Errorf("Достоевский: want nothing, got %v", got)
+	}
+	if want := build(map[uint32]string{2: "Алексей Толстой"}); !reflect.DeepEqual(idx, want) {
+		t.Error("index differs from the one with the remaining ID only")
+	}
+}
+
+func TestScore(t *testing.T) {
+	idx := NewIndex()
+	idx.Add(1, "Пикник на обочине и другие повести")
+	idx.Add(2, "Пикник на обочине")
+	if got := queryIDs(idx, "пикник на обочине"); !reflect.DeepEqual(got, []uint32{2, 1}) {
+		t.Errorf("a shorter title should score higher: got %v", got)
+	}
+
+	// Both IDs have 3 of the 4 trigrams, but the trigram 4 is rarer.
+	idx = NewIndex()
+	idx.AddTrigrams(1, []T{1, 2, 3})
+	idx.AddTrigrams(2, []T{1, 2, 4})
+	for id := uint32(3); id < 20; id++ {
+		idx.AddTrigrams(id, []T{3})
+	}
+	rr := idx.QueryTrigrams([]T{1, 2, 3, 4})
+	if len(rr) != 2 || rr[0].ID != 2 || rr[1].ID != 1 || rr[0].Score <= rr[1].Score {
+		t.Errorf("a rarer trigram should score higher: got %v", rr)
+	}
+
+	idx = NewIndex()
+	idx.AddFieldTrigrams(1, 0, Extract("мир"))
+	idx.AddFieldTrigrams(2, 1, Extract("мир"))
+	rr = idx.Query("мир")
+	if len(rr) != 2 || rr[0].Score != rr[1].Score {
+		t.Errorf("the same match in two fields should score the same: got %v", rr)
+	}
+	idx.SetBoost(1, 2)
+	if got := queryIDs(idx, "мир"); !reflect.DeepEqual(got, []uint32{2, 1}) {
+		t.Errorf("a match in a boosted field should score higher: got %v", got)
+	}
+}
+
+func TestQueryFields(t *testing.T) {
+	idx := NewIndex()
+	idx.AddFieldTrigrams(1, 0, Extract("Полдень, XXII век"))
+	idx.AddFieldTrigrams(1, 2, Extract("Мир Полудня"))
+	idx.AddFieldTrigrams(2, 0, Extract("Жук в муравейнике"))
+	idx.AddFieldTrigrams(2, 2, Extract("Мир Полудня"))
+	idx.AddFieldTrigrams(3, 1, Extract("Полдень"))
+
+	for _, tc := range []struct {
+		fields []Field
+		want   []uint32
+	}{
+		{nil, []uint32{1, 3}},
+		{[]Field{0}, []uint32{1}},
+		{[]Field{1}, []uint32{3}},
+		{[]Field{0, 1}, []uint32{1, 3}},
+		{[]Field{2}, nil},
+	} {
+		var got []uint32
+		for _, r := range idx.QueryFields(Extract("полдень"), tc.fields...) {
+			got = append(got, r.ID)
+		}
+		sort.Slice(got, func(i, j int) bool { return got[i] < got[j] })
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("fields %v: want %v, got %v", tc.fields, tc.want, got)
+		}
+	}
+
+	if rr := idx.QueryAll(Extract("мир полудня"), 2); len(rr) != 2 {
+		t.Errorf("all of мир полудня in the field 2: want 2 IDs, got %v", rr)
+	}
+	if rr := idx.QueryAll(Extract("мир полудня"), 0, 1); len(rr) != 0 {
+		t.Errorf("all of мир полудня in the fields 0 and 1: want nothing, got %v", rr)
+	}
+}
+
+func TestExtractWords(t *testing.T) {
+	idx := NewIndex()
+	idx.Add(1, "Звезда полдень звезда")
+	idx.Add(2, "Полдень, звезда")
+	idx.Add(3, "Полночь, звезда")
+
+	var got []uint32
+	for _, r := range idx.QueryAll(ExtractWords("полдень звезда")) {
+		got = append(got, r.ID)
+	}
+	sort.Slice(got, func(i, j int) bool { return got[i] < got[j] })
+	if want := []uint32{1, 2}; !reflect.DeepEqual(got, want) {
+		t.Errorf("all of the words полдень звезда: want %v, got %v", want, got)
+	}
+}
+
+func TestTranslit(t *testing.T) {
+	for _, tc := range []struct{ in, want string }{
+		{"Стругацкий", "strugacki"},
+		{"Strugatsky", "strugacki"},
+		{"Strugatskiy", "strugacki"},
+		{"Strugackij", "strugacki"},
+		{"Чехов", "chehov"},
+		{"Chekhov", "chehov"},
+		{"Čehov", "chehov"},
+		{"Щедрин", "shedrin"},
+		{"Shchedrin", "shedrin"},
+		{"Ŝedrin", "shedrin"},
+		{"Юрий Цветаева", "iuri cvetaeva"},
+		{"Yury Tsvetaeva", "iuri cvetaeva"},
+		{"Jurij Cvetaeva", "iuri cvetaeva"},
+		{"Лев Толстой", "lev tolstoi"},
+		{"Lev Tolstoy", "lev tolstoi"},
+		{"Пётр Достоевский", "petr dostoevski"},
+		{"Pyotr Dostoyevsky", "petr dostoevski"},
+		{"Евгений", "evgeni"},
+		{"Yevgeny", "evgeni"},
+		{"Война и мир, 1999", "voina i mir, 1999"},
+	} {
+		if got := Translit(tc.in); got != tc.want {
+			t.Errorf("Translit(%q) = %q, want %q", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestShadowDistinct(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i < 100000; i++ {
+		rr := [3]rune{rune(rnd.Intn(0x500)), rune(rnd.Intn(0x500)), rune(rnd.Intn(0x500))}
+		if tr := mkT(rr); tr&shadow != 0 {
+			t.Fatalf("mkT(%q) = %x has the shadow bit set", rr, tr)
+		}
+	}
+
+	// The shadow form of a Latin string is the same as the string, yet
+	// none of its trigrams is lost to the shadow ones, and the keys keep
+	// the field.
+	for _, s := range []string{"night star", "Лев Толстой"} {
+		tt := Extract(s)
+		if n := len(trigrams(s)) + len(trigrams(Translit(s))); len(tt) != n {
+			t.Errorf("%s: want %d distinct trigrams, got %d", s, n, len(tt))
+		}
+
+		idx := NewIndex()
+		idx.AddFieldTrigrams(1, MaxFields-1, tt)
+		for k := range idx.lists {
+			if k.field() != MaxFields-1 || !hasTrigram(tt, T(k&0xffffff)) {
+				t.Errorf("%s: key %x is not one of the trigrams in field %d", s, k, MaxFields-1)
+			}
+		}
+	}
+}
+
+func TestQueryTranslit(t *testing.T) {
+	idx := NewIndex()
+	idx.Add(1, "Аркадий и Борис Стругацкие")
+	idx.Add(2, "Arkady and Boris Strugatsky")
+	idx.Add(3, "Лев Толстой")
+	idx.Add(4, "Night Star")
+	idx.Add(5, "Fyodor Dostoevsky")
+
+	for _, tc := range []struct {
+		query string
+		want  []uint32
+	}{
+		{"Стругацкий", []uint32{1, 2}},
+		{"Strugatskij", []uint32{1, 2}},
+		{"Arkadij", []uint32{1, 2}},
+		{"Tolstoy", []uint32{3}},
+		{"Толстой", []uint32{3}},
+		{"night star", []uint32{4}},
+		{"Достоевский", []uint32{5}},
+		{"Фёдор Достоевский", []uint32{5}},
+	} {
+		got := queryIDs(idx, tc.query)
+		sort.Slice(got, func(i, j int) bool { return got[i] < got[j] })
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: want %v, got %v", tc.query, tc.want, got)
+		}
+	}
+
+	// The shadow form of a Latin string is often the same as the string,
+	// and then it is not indexed twice.
+	idx = NewIndex()
+	idx.Add(1, "Night Star")
+	for k := range idx.lists {
+		if T(k)&shadow != 0 {
+			t.Errorf("shadow trigram %x of Night Star is indexed", k)
+		}
+	}
+}
@@ -0,0 +1,262 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var (
+	watch         = flag.Bool("watch", false, "Keep watching for new and changed files while serving")
+	watchInterval = flag.Duration("watch-interval", 5*time.Minute, "Rescan interval in watch mode")
+)
+
+// settleTime is how long the watcher waits after a change notification
+// before rescanning, so that a file being copied has a chance to be
+// completed.
+const settleTime = 5 * time.Second
+
+// watchedDirs returns the directories in which changes are to be watched for.
+func watchedDirs(paths []string) []string {
+	var dirs []string
+	for _, path := range paths {
+		fi, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+
+		if !fi.IsDir() {
+			dirs = append(dirs, filepath.Dir(path))
+			continue
+		}
+
+		if !*recursive {
+			continue
+		}
+
+		filepath.Walk(path, func(path string, fi os.FileInfo, err error) error {
+			if err == nil && fi.IsDir() {
+				dirs = append(dirs, path)
+			}
+			return nil
+		})
+	}
+
+	return dirs
+}
+
+// watcher keeps track of the directories watched for changes.
+type watcher struct {
+	n       *notifier
+	paths   []string
+	watched map[string]bool
+}
+
+// watch starts watching the directories which are not watched yet.
+func (w *watcher) watch(dirs []string) {
+	if w.n == nil {
+		return
+	}
+
+	for _, dir := range dirs {
+		if w.watched[dir] {
+			continue
+		}
+		if err := w.n.Add(dir); err != nil {
+			log.Printf("%s: watch: %v", dir, err)
+			continue
+		}
+		w.watched[dir] = true
+	}
+}
+
+// allArchives returns all the archives, including those of the INPX catalog.
+func (w *watcher) allArchives() []string {
+	names := findArchives(w.paths)
+	if *inpxPath != "" {
+		names = append(names, catalogArchives()...)
+	}
+	return names
+}
+
+// changedArchives returns the archives to be rescanned after changes in dirs
+// were reported: the archives given in paths which are in dirs, those in
+// dirs below a directory given in paths, with -r, and those in the new
+// directories below them, which are watched from now on.
+func (w *watcher) changedArchives(dirs []string) []string {
+	var names []string
+	add := func(name string) {
+		names = append(names, name)
+	}
+
+	changed := make(map[string]bool, len(dirs))
+	for _, dir := range dirs {
+		changed[dir] = true
+	}
+
+	for _, path := range w.paths {
+		fi, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+
+		if !fi.IsDir() {
+			if changed[filepath.Dir(path)] && (isZIP(path) || isFB2(path)) {
+				add(path)
+			}
+			continue
+		}
+
+		if !*recursive {
+			continue
+		}
+
+		root := filepath.Clean(path)
+		for _, dir := range dirs {
+			if d := filepath.Clean(dir); d != root && !strings.HasPrefix(d, root+string(filepath.Separator)) {
+				continue
+			}
+
+			entries, err := os.ReadDir(dir)
+			if err != nil {
+				// The directory is gone; it is watched again if it
+				// is made anew.
+				delete(w.watched, dir)
+				continue
+			}
+
+			for _, e := range entries {
+				name := filepath.Join(dir, e.Name())
+				if !e.IsDir() {
+					if e.Type().IsRegular() && (isZIP(name) || isFB2(name)) {
+						add(name)
+					}
+					continue
+				}
+
+				if w.watched[name] {
+					continue
+				}
+				filepath.Walk(name, walker(add))
+				w.watch(watchedDirs([]string{name}))
+			}
+		}
+	}
+
+	if *inpxPath != "" && changed[filepath.Dir(*inpxPath)] {
+		names = append(names, catalogArchives()...)
+	}
+
+	return names
+}
+
+// reloadCatalog reads the INPX catalog again if it has changed. The books of
+// the archives which are described differently or no longer described are
+// removed, and the former archives are returned to be imported anew.
+func reloadCatalog() []string {
+	if *inpxPath == "" {
+		return nil
+	}
+
+	changed, dropped, err := loadCatalog(*inpxPath)
+	if err != nil {
+		log.Printf("%s: %v", *inpxPath, err)
+		return nil
+	}
+	if len(changed)+len(dropped) == 0 {
+		return nil
+	}
+
+	log.Printf("%s: the catalog has changed for %d archive(s), %d archive(s) dropped", *inpxPath, len(changed), len(dropped))
+	err = store.RemoveArchives(append(changed, dropped...))
+	if err != nil {
+		log.Printf("%s: %v", *inpxPath, err)
+		return nil
+	}
+
+	return changed
+}
+
+// watchArchives rescans the directories in which changes are reported by the
+// file system, or all of paths every watchInterval if notifications are not
+// available, and indexes the new and changed archives. The INPX catalog is
+// read again when it changes.
+func watchArchives(paths []string, books chan<- book, flush chan<- chan flushResult) {
+	n, err := newNotifier()
+	if err != nil {
+		log.Printf("Change notifications are not available (%v), polling every %v", err, *watchInterval)
+	}
+
+	w := &watcher{
+		n:       n,
+		paths:   paths,
+		watched: make(map[string]bool),
+	}
+	w.watch(watchedDirs(paths))
+	if *inpxPath != "" {
+		w.watch([]string{filepath.Dir(*inpxPath)})
+	}
+
+	tick := time.NewTicker(*watchInterval)
+	defer tick.Stop()
+
+	for {
+		// The ticker is only listened to when polling.
+		var poll <-chan time.Time
+		if w.n == nil {
+			poll = tick.C
+		}
+
+		var names []string
+		select {
+		case <-poll:
+			names = append(reloadCatalog(), w.allArchives()...)
+		case _, ok := <-w.n.Changes():
+			if !ok {
+				log.Printf("Change notifications stopped, polling every %v", *watchInterval)
+				w.n = nil
+				continue
+			}
+			time.Sleep(settleTime)
+
+			dirs, all := w.n.Changed()
+			names = reloadCatalog()
+			if all {
+				names = append(names, w.allArchives()...)
+			} else {
+				names = append(names, w.changedArchives(dirs)...)
+			}
+		}
+
+		start := time.Now()
+
+		pending, indexedEntries, err := store.ScanArchives(names)
+		if err != nil {
+			log.Printf("Rescan failed: %v", err)
+			continue
+		}
+
+		if len(pending) == 0 {
+			continue
+		}
+
+		indexed := indexArchives(pending, indexedEntries, books, flush)
+		log.Printf("Indexed %d file(s) in %v", indexed, time.Since(start))
+	}
+}
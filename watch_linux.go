@@ -0,0 +1,130 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+const inotifyMask = syscall.IN_CLOSE_WRITE | syscall.IN_CREATE | syscall.IN_DELETE |
+	syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO | syscall.IN_DELETE_SELF
+
+// notifier reports changes in the watched directories using inotify.
+type notifier struct {
+	fd int
+	c  chan bool
+
+	mu       sync.Mutex
+	dirs     map[int32]string // the watched directories by watch descriptor
+	changed  map[string]bool
+	overflow bool
+}
+
+func newNotifier() (*notifier, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+
+	n := &notifier{
+		fd:      fd,
+		c:       make(chan bool, 1),
+		dirs:    make(map[int32]string),
+		changed: make(map[string]bool),
+	}
+	go n.read()
+
+	return n, nil
+}
+
+func (n *notifier) read() {
+	buf := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+	for {
+		size, err := syscall.Read(n.fd, buf)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			close(n.c)
+			return
+		}
+
+		n.mu.Lock()
+		for off := 0; off+syscall.SizeofInotifyEvent <= size; {
+			ev := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[off]))
+			if ev.Mask&syscall.IN_Q_OVERFLOW != 0 {
+				n.overflow = true
+			} else if dir, ok := n.dirs[ev.Wd]; ok {
+				n.changed[dir] = true
+			}
+			if ev.Mask&syscall.IN_IGNORED != 0 {
+				delete(n.dirs, ev.Wd)
+			}
+			off += syscall.SizeofInotifyEvent + int(ev.Len)
+		}
+		n.mu.Unlock()
+
+		select {
+		case n.c <- true:
+		default:
+		}
+	}
+}
+
+// Add starts watching dir. Adding a directory more than once is harmless.
+func (n *notifier) Add(dir string) error {
+	wd, err := syscall.InotifyAddWatch(n.fd, dir, inotifyMask)
+	if err != nil {
+		return err
+	}
+
+	n.mu.Lock()
+	n.dirs[int32(wd)] = dir
+	n.mu.Unlock()
+
+	return nil
+}
+
+// Changes returns a channel which receives a value when something has
+// changed in the watched directories. It is nil if n is nil.
+func (n *notifier) Changes() <-chan bool {
+	if n == nil {
+		return nil
+	}
+	return n.c
+}
+
+// Changed returns the directories in which something has changed since the
+// last call, and discards the pending notification. all is true if some of
+// the changes were lost, and everything must be rescanned.
+func (n *notifier) Changed() (dirs []string, all bool) {
+	select {
+	case <-n.c:
+	default:
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	for dir := range n.changed {
+		dirs = append(dirs, dir)
+	}
+	all = n.overflow
+	n.changed = make(map[string]bool)
+	n.overflow = false
+
+	return dirs, all
+}
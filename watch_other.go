@@ -0,0 +1,33 @@
+// This program is free software: you can redistribute it and/or modify it
+// under the terms of the GNU General Public License as published by the Free
+// Software Foundation, either version 3 of the License, or (at your option)
+// any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General
+// Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+//go:build !linux
+// +build !linux
+
+package main
+
+import "errors"
+
+// notifier is a stub for the systems without inotify; the watcher falls
+// back to polling.
+type notifier struct{}
+
+func newNotifier() (*notifier, error) {
+	return nil, errors.New("not supported on this system")
+}
+
+func (n *notifier) Add(dir string) error { return nil }
+
+func (n *notifier) Changes() <-chan bool { return nil }
+
+func (n *notifier) Changed() (dirs []string, all bool) { return nil, true }
@@ -38,6 +38,9 @@ var (
 	ErrSkip    = errors.New("skip this book")
 )
 
+// descLimit is how much of a book is read to parse its description.
+const descLimit = 16384
+
 var imageCache = cache.New(time.Minute, 10*time.Second)
 
 type genre struct {
@@ -57,20 +60,79 @@ type author struct {
 	ID         uint32
 }
 
+// Sequence kinds.
+const (
+	seqSeries    = iota // a series, as given in title-info
+	seqPublisher        // a publisher's series, as given in publish-info
+)
+
 type sequence struct {
 	Name      string
-	Number    int
+	Number    string
+	Position  float64
+	Kind      int
+	ParentID  uint32     `db:"parent_id"`
+	Parent    string     `db:"-"`
+	Children  []sequence `db:"-"`
 	BookCount int
 	ID        uint32
 }
 
+type publishInfo struct {
+	Publisher string
+	City      string
+	Year      string
+	ISBN      string
+}
+
+type documentInfo struct {
+	ID          string `db:"doc_id"`
+	Version     string
+	ProgramUsed string `db:"program_used"`
+	Date        string
+}
+
 type fb2desc struct {
-	Genres      []genre
-	Authors     []author
-	Translators []author
-	Sequences   []sequence
-	Title       string
-	Lang        string
+	Genres       []genre
+	Authors      []author
+	Translators  []author
+	Sequences    []sequence
+	Title        string
+	Lang         string
+	RawLang      string `db:"raw_lang"`
+	SrcLang      string `db:"src_lang"`
+	Date         string
+	Keywords     string
+	Annotation   string
+	PublishInfo  publishInfo
+	DocumentInfo documentInfo
+}
+
+// newDecoder returns a decoder of the FB2 data. Unless enc is empty, the
+// data is read in that encoding and the XML declaration is ignored.
+func newDecoder(r io.Reader, enc string) *xml.Decoder {
+	if enc == "" {
+		d := xml.NewDecoder(r)
+		d.CharsetReader = charset.NewReader
+		return d
+	}
+
+	if enc != "utf-8" {
+		if cr, err := charset.NewReader(enc, r); err == nil {
+			r = cr
+		}
+	}
+	d := xml.NewDecoder(r)
+	d.CharsetReader = func(_ string, r io.Reader) (io.Reader, error) {
+		return r, nil
+	}
+	return d
+}
+
+// sectionAnchor returns the name of the anchor which the HTML version of a
+// book has before its n-th section.
+func sectionAnchor(n int) string {
+	return fmt.Sprintf("section-%d", n)
 }
 
 func skip(d *xml.Decoder, name xml.Name) error {
@@ -118,6 +180,40 @@ func text(d *xml.Decoder, name xml.Name) string {
 	}
 }
 
+// plainText returns the text content of the element, with paragraphs
+// separated by newlines.
+func plainText(d *xml.Decoder, name xml.Name) (string, error) {
+	var buf bytes.Buffer
+	lvl := 0
+
+	for {
+		tok, err := d.Token()
+		if err != nil {
+			return "", err
+		}
+
+		switch tok := tok.(type) {
+		case xml.StartElement:
+			if tok.Name == name {
+				lvl++
+			}
+		case xml.EndElement:
+			switch tok.Name.Local {
+			case "p", "v", "subtitle", "text-author", "empty-line":
+				buf.WriteByte('\n')
+			}
+			if tok.Name == name {
+				if lvl == 0 {
+					return strings.TrimSpace(buf.String()), nil
+				}
+				lvl--
+			}
+		case xml.CharData:
+			buf.Write(tok)
+		}
+	}
+}
+
 func attr(e xml.StartElement, local string) string {
 	for _, a := range e.Attr {
 		if a.Name.Local == local {
@@ -127,26 +223,6 @@ func attr(e xml.StartElement, local string) string {
 	return ""
 }
 
-func lower(b byte) bool {
-	return 'a' <= b && b <= 'z'
-}
-
-func validLanguage(lang string) bool {
-	return len(lang) == 2 && lower(lang[0]) && lower(lang[1])
-}
-
-func languageAllowed(lang string) bool {
-	if len(allowedLanguages) == 0 {
-		return validLanguage(lang)
-	}
-	for _, l := range allowedLanguages {
-		if l == lang {
-			return true
-		}
-	}
-	return false
-}
-
 func validGenre(s string) bool {
 	if s == "" {
 		return false
@@ -159,13 +235,38 @@ func validGenre(s string) bool {
 	return true
 }
 
-func ParseDesc(r io.Reader) (*fb2desc, error) {
-	d := xml.NewDecoder(io.LimitReader(r, 16384))
-	d.CharsetReader = charset.NewReader
+// sequencePosition returns the leading decimal number of the number in a
+// sequence, such as 1.5 for "1.5" or 3 for "3-4", by which the books in the
+// sequence are ordered.
+func sequencePosition(number string) float64 {
+	end := 0
+	dot := false
+	for ; end < len(number); end++ {
+		c := number[end]
+		if c == '.' || c == ',' {
+			if dot || end == 0 {
+				break
+			}
+			dot = true
+		} else if c < '0' || c > '9' {
+			break
+		}
+	}
+
+	s := strings.Replace(strings.TrimRight(number[:end], ".,"), ",", ".", 1)
+	pos, _ := strconv.ParseFloat(s, 64)
+	return pos
+}
+
+func ParseDesc(r io.Reader, enc string) (*fb2desc, error) {
+	d := newDecoder(io.LimitReader(r, descLimit), enc)
 
 	var a author
 	var desc fb2desc
 	inTitleInfo := false
+	inPublishInfo := false
+	inDocumentInfo := false
+	var sequences []string // the names of the enclosing sequence elements
 loop:
 	for {
 		tok, err := d.Token()
@@ -183,6 +284,10 @@ loop:
 				// do nothing
 			case "title-info":
 				inTitleInfo = true
+			case "publish-info":
+				inPublishInfo = true
+			case "document-info":
+				inDocumentInfo = true
 			case "genre":
 				g := normalizeGenre(text(d, tok.Name))
 				if validGenre(g) {
@@ -203,19 +308,97 @@ loop:
 			case "book-title":
 				desc.Title = text(d, tok.Name)
 			case "lang":
-				desc.Lang = text(d, tok.Name)
-				if !languageAllowed(desc.Lang) {
+				desc.RawLang = text(d, tok.Name)
+				desc.Lang = normalizeLanguage(desc.RawLang)
+				if !bookLanguageAllowed(desc.RawLang, desc.Lang) {
 					return nil, ErrSkip
 				}
+			case "annotation":
+				if !inTitleInfo {
+					err := skip(d, tok.Name)
+					if err != nil {
+						break loop
+					}
+					continue
+				}
+				desc.Annotation, err = plainText(d, tok.Name)
+				if err != nil {
+					break loop
+				}
+			case "src-lang":
+				desc.SrcLang = text(d, tok.Name)
+				if l := normalizeLanguage(desc.SrcLang); l != "" {
+					desc.SrcLang = l
+				}
+			case "keywords":
+				desc.Keywords = text(d, tok.Name)
+			case "date":
+				value := attr(tok, "value")
+				date := text(d, tok.Name)
+				if date == "" {
+					date = value
+				}
+				if inDocumentInfo {
+					desc.DocumentInfo.Date = date
+				} else if inTitleInfo {
+					desc.Date = date
+				}
+			case "publisher", "city", "year", "isbn":
+				if !inPublishInfo {
+					err := skip(d, tok.Name)
+					if err != nil {
+						break loop
+					}
+					continue
+				}
+				switch s := text(d, tok.Name); tok.Name.Local {
+				case "publisher":
+					desc.PublishInfo.Publisher = s
+				case "city":
+					desc.PublishInfo.City = s
+				case "year":
+					desc.PublishInfo.Year = s
+				case "isbn":
+					desc.PublishInfo.ISBN = s
+				}
+			case "id", "version", "program-used":
+				if !inDocumentInfo {
+					err := skip(d, tok.Name)
+					if err != nil {
+						break loop
+					}
+					continue
+				}
+				switch s := text(d, tok.Name); tok.Name.Local {
+				case "id":
+					desc.DocumentInfo.ID = s
+				case "version":
+					desc.DocumentInfo.Version = s
+				case "program-used":
+					desc.DocumentInfo.ProgramUsed = s
+				}
 			case "sequence":
-				name := attr(tok, "name")
+				name := strings.TrimSpace(attr(tok, "name"))
 				if name != "" {
-					number, _ := strconv.Atoi(attr(tok, "number"))
-					desc.Sequences = append(desc.Sequences, sequence{
+					s := sequence{
 						Name:   name,
-						Number: number,
-					})
+						Number: strings.TrimSpace(attr(tok, "number")),
+					}
+					s.Position = sequencePosition(s.Number)
+					if inPublishInfo {
+						s.Kind = seqPublisher
+					}
+					for i := len(sequences) - 1; i >= 0; i-- {
+						if sequences[i] != "" {
+							if sequences[i] != name {
+								s.Parent = sequences[i]
+							}
+							break
+						}
+					}
+					desc.Sequences = append(desc.Sequences, s)
 				}
+				sequences = append(sequences, name)
 			default:
 				err := skip(d, tok.Name)
 				if err != nil {
@@ -228,6 +411,14 @@ loop:
 				break loop
 			case "title-info":
 				inTitleInfo = false
+			case "publish-info":
+				inPublishInfo = false
+			case "document-info":
+				inDocumentInfo = false
+			case "sequence":
+				if len(sequences) > 0 {
+					sequences = sequences[:len(sequences)-1]
+				}
 			case "author":
 				if inTitleInfo && (a != author{}) {
 					desc.Authors = append(desc.Authors, a)
@@ -240,6 +431,11 @@ loop:
 		}
 	}
 
+	// A book may have no lang element at all.
+	if !bookLanguageAllowed(desc.RawLang, desc.Lang) {
+		return nil, ErrSkip
+	}
+
 	if desc.Title == "" {
 		return nil, ErrNoTitle
 	}
@@ -357,14 +553,13 @@ func (b *book) makeImageName(href string) string {
 }
 
 func (b *book) AnnotationAndCover() (string, string, error) {
-	r, err := b.OpenDeflate()
+	r, err := b.Open()
 	if err != nil {
 		return "", "", err
 	}
 	defer r.Close()
 
-	d := xml.NewDecoder(r)
-	d.CharsetReader = charset.NewReader
+	d := newDecoder(r, b.Encoding)
 
 	var ann string
 	var imageHref string
@@ -434,18 +629,97 @@ func (b *book) AnnotationAndCover() (string, string, error) {
 	}
 }
 
+// textSection is the text of a section of a book. Section 0 holds the text
+// which is not in any section.
+type textSection struct {
+	Section int
+	Text    string
+}
+
+// bodyText returns the text of the book bodies, section by section. The
+// sections are numbered in the same way as the anchors made by HTML.
+func bodyText(r io.Reader, enc string) ([]textSection, error) {
+	d := newDecoder(r, enc)
+
+	var sections []textSection
+	var buf bytes.Buffer
+	var parents []int
+	cur, n := 0, 0
+	inBody := false
+
+	flushText := func() {
+		if t := strings.TrimSpace(buf.String()); t != "" {
+			sections = append(sections, textSection{
+				Section: cur,
+				Text:    t,
+			})
+		}
+		buf.Reset()
+	}
+
+	for {
+		tok, err := d.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		switch tok := tok.(type) {
+		case xml.StartElement:
+			switch tok.Name.Local {
+			case "description", "binary":
+				err := skip(d, tok.Name)
+				if err != nil {
+					return nil, err
+				}
+			case "body":
+				inBody = true
+			case "section":
+				flushText()
+				parents = append(parents, cur)
+				n++
+				cur = n
+			}
+		case xml.EndElement:
+			switch tok.Name.Local {
+			case "body":
+				flushText()
+				inBody = false
+			case "section":
+				flushText()
+				if len(parents) > 0 {
+					cur = parents[len(parents)-1]
+					parents = parents[:len(parents)-1]
+				}
+			case "p", "v", "subtitle", "title", "text-author":
+				buf.WriteByte('\n')
+			}
+		case xml.CharData:
+			if inBody {
+				buf.Write(tok)
+			}
+		}
+	}
+
+	flushText()
+
+	return sections, nil
+}
+
 func (b *book) HTML() (string, error) {
-	r, err := b.OpenDeflate()
+	r, err := b.Open()
 	if err != nil {
 		return "", err
 	}
 	defer r.Close()
 
-	d := xml.NewDecoder(r)
-	d.CharsetReader = charset.NewReader
+	d := newDecoder(r, b.Encoding)
 
 	images := make(map[string]string)
 	var buf bytes.Buffer
+	sections := 0
 
 	for {
 		tok, err := d.Token()
@@ -464,6 +738,10 @@ func (b *book) HTML() (string, error) {
 			case "body":
 				buf.WriteString(`<div class="body">`)
 			case "section":
+				sections++
+				buf.WriteString(`<a name="`)
+				buf.WriteString(sectionAnchor(sections))
+				buf.WriteString(`"></a>`)
 				id := attr(tok, "id")
 				if id != "" {
 					buf.WriteString(`<a name="`)
@@ -579,14 +857,13 @@ func (b *book) HTML() (string, error) {
 }
 
 func (b *book) Image(sum uint32) ([]byte, error) {
-	r, err := b.OpenDeflate()
+	r, err := b.Open()
 	if err != nil {
 		return nil, err
 	}
 	defer r.Close()
 
-	d := xml.NewDecoder(r)
-	d.CharsetReader = charset.NewReader
+	d := newDecoder(r, b.Encoding)
 
 	for {
 		tok, err := d.Token()
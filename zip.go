@@ -15,13 +15,40 @@ package main
 
 import (
 	"archive/zip"
+	"bytes"
+	"compress/bzip2"
 	"compress/flate"
+	"errors"
+	"fmt"
 	"io"
-	"log"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strings"
 	"sync"
 )
 
+// BZIP2 is the compression method number of bzip2 in ZIP archives.
+const BZIP2 uint16 = 12
+
+var ErrUnsupportedMethod = errors.New("unsupported compression method")
+
+func init() {
+	zip.RegisterDecompressor(BZIP2, func(r io.Reader) io.ReadCloser {
+		return ioutil.NopCloser(bzip2.NewReader(r))
+	})
+}
+
+func supportedMethod(method uint16) bool {
+	return method == zip.Store || method == zip.Deflate || method == BZIP2
+}
+
+// Book source kinds.
+const (
+	kindZIP  = iota // an entry in a ZIP archive
+	kindFile        // a plain FB2 file
+)
+
 type book struct {
 	Archive          string
 	Filename         string
@@ -29,8 +56,21 @@ type book struct {
 	CompressedSize   int64 `db:"compressed_size"`
 	UncompressedSize int64 `db:"uncompressed_size"`
 	fb2desc
-	CRC32 uint32
-	ID    uint32
+	CRC32  uint32
+	ID     uint32
+	Method uint16
+	Kind   int
+
+	// The encoding the book is read in, if its XML declaration is wrong.
+	Encoding string
+
+	// The text of the book, extracted only in the full-text mode.
+	Text []textSection `db:"-"`
+
+	// Catalog data, known only for the books imported from INPX.
+	LibID   string `db:"lib_id"`
+	Added   string
+	Deleted bool
 }
 
 type readCloser struct {
@@ -38,29 +78,46 @@ type readCloser struct {
 	io.Closer
 }
 
-func (b *book) Open() (io.ReadCloser, error) {
+// OpenRaw returns a reader of the book as it is stored in the archive.
+func (b *book) OpenRaw() (io.ReadCloser, error) {
 	f, err := os.Open(b.Archive)
 	if err != nil {
 		return nil, err
 	}
 
+	if b.Kind == kindFile {
+		return f, nil
+	}
+
 	sr := io.NewSectionReader(f, b.Offset, b.CompressedSize)
 
 	return readCloser{sr, f}, nil
 }
 
-func (b *book) OpenDeflate() (io.ReadCloser, error) {
-	r, err := b.Open()
+// Open returns a reader of the uncompressed book.
+func (b *book) Open() (io.ReadCloser, error) {
+	if !supportedMethod(b.Method) {
+		return nil, ErrUnsupportedMethod
+	}
+
+	r, err := b.OpenRaw()
 	if err != nil {
 		return nil, err
 	}
 
-	fr := flate.NewReader(r)
+	switch b.Method {
+	case zip.Deflate:
+		return readCloser{flate.NewReader(r), r}, nil
+	case BZIP2:
+		return readCloser{bzip2.NewReader(r), r}, nil
+	}
 
-	return readCloser{fr, r.(readCloser).Closer}, nil
+	return r, nil
 }
 
-func indexZIP(name string, results chan<- book) error {
+// indexZIP indexes the books in the archive, skipping the entries which are
+// already indexed.
+func indexZIP(name string, indexed map[string]bool, results chan<- book) error {
 	r, err := zip.OpenReader(name)
 	if err != nil {
 		return err
@@ -77,19 +134,28 @@ func indexZIP(name string, results chan<- book) error {
 			for f := range jobs {
 				rc, err := f.Open()
 				if err != nil {
-					log.Printf("%s/%s: open: %v", name, f.Name, err)
+					reportIndexError(name, f.Name, stageOpen, err)
 					continue
 				}
 
-				desc, err := ParseDesc(rc)
+				desc, enc, err := readDesc(rc)
+				rc.Close()
 				if err == ErrSkip {
 					continue
 				}
 				if err != nil {
-					log.Printf("%s/%s: FB2 description: %v", name, f.Name, err)
+					reportIndexError(name, f.Name, descStage(err), err)
 					continue
 				}
 
+				var text []textSection
+				if *fullText {
+					text, enc, err = extractText(f.Open, enc)
+					if err != nil {
+						reportIndexError(name, f.Name, stageText, err)
+					}
+				}
+
 				offset, _ := f.DataOffset()
 				results <- book{
 					Archive:          name,
@@ -99,16 +165,22 @@ func indexZIP(name string, results chan<- book) error {
 					CompressedSize:   int64(f.CompressedSize64),
 					UncompressedSize: int64(f.UncompressedSize64),
 					CRC32:            f.CRC32,
+					Method:           f.Method,
+					Encoding:         enc,
+					Text:             text,
 				}
 			}
 		}()
 	}
 
 	for _, f := range r.File {
-		if f.Method == zip.Deflate {
+		if indexed[f.Name] {
+			continue
+		}
+		if supportedMethod(f.Method) {
 			jobs <- f
 		} else {
-			log.Printf("%s/%s: unsupported compression method", name, f.Name)
+			reportIndexError(name, f.Name, stageCompression, fmt.Errorf("%v %d", ErrUnsupportedMethod, f.Method))
 		}
 	}
 
@@ -117,3 +189,158 @@ func indexZIP(name string, results chan<- book) error {
 
 	return nil
 }
+
+func isZIP(name string) bool {
+	return strings.HasSuffix(name, ".zip")
+}
+
+func isFB2(name string) bool {
+	return strings.HasSuffix(name, ".fb2")
+}
+
+// indexFile indexes a plain FB2 file.
+func indexFile(name string, results chan<- book) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	desc, enc, err := readDesc(f)
+	if err == ErrSkip {
+		return nil
+	}
+	if err != nil {
+		reportIndexError(name, filepath.Base(name), descStage(err), err)
+		return nil
+	}
+
+	var text []textSection
+	if *fullText {
+		text, enc, err = extractText(func() (io.ReadCloser, error) {
+			return os.Open(name)
+		}, enc)
+		if err != nil {
+			reportIndexError(name, filepath.Base(name), stageText, err)
+		}
+	}
+
+	results <- book{
+		Archive:          name,
+		Filename:         filepath.Base(name),
+		fb2desc:          *desc,
+		CompressedSize:   fi.Size(),
+		UncompressedSize: fi.Size(),
+		Method:           zip.Store,
+		Kind:             kindFile,
+		Encoding:         enc,
+		Text:             text,
+	}
+
+	return nil
+}
+
+// readDesc parses the description of a book. If the declared encoding fails
+// to decode it, the encoding is detected from the data and returned along with
+// the description parsed in it.
+func readDesc(r io.Reader) (*fb2desc, string, error) {
+	head, err := ioutil.ReadAll(io.LimitReader(r, descLimit))
+	if err != nil {
+		return nil, "", err
+	}
+
+	desc, err := ParseDesc(bytes.NewReader(head), "")
+	if err == ErrSkip || err == ErrNoTitle || err == nil && !desc.garbled() {
+		return desc, "", err
+	}
+
+	enc := detectEncoding(head)
+	if enc == "" {
+		return desc, "", err
+	}
+
+	desc2, err2 := ParseDesc(bytes.NewReader(head), enc)
+	if err2 != nil && err2 != ErrSkip {
+		return desc, "", err
+	}
+
+	return desc2, enc, err2
+}
+
+// rereadBook returns the book with its description parsed again in the
+// encoding enc, or as when it was indexed if enc is empty, and, with
+// -fulltext, its text extracted again. If desc is false, only the text is.
+func rereadBook(b book, enc string, desc bool) (book, error) {
+	if desc {
+		r, err := b.Open()
+		if err != nil {
+			return b, err
+		}
+
+		var d *fb2desc
+		if enc == "" {
+			d, enc, err = readDesc(r)
+		} else {
+			d, err = ParseDesc(io.LimitReader(r, descLimit), enc)
+		}
+		r.Close()
+		if err != nil {
+			return b, err
+		}
+		b.fb2desc = *d
+	}
+
+	b.Encoding = enc
+	if *fullText {
+		text, enc, err := extractText(b.Open, enc)
+		if err != nil {
+			return b, err
+		}
+		b.Text, b.Encoding = text, enc
+	}
+
+	return b, nil
+}
+
+// extractText returns the text of the book opened with open, read in the
+// encoding enc. If enc is empty and the declared encoding fails, the encoding
+// is detected from the data. It returns the encoding used.
+func extractText(open func() (io.ReadCloser, error), enc string) ([]textSection, string, error) {
+	r, err := open()
+	if err != nil {
+		return nil, enc, err
+	}
+	text, err := bodyText(r, enc)
+	r.Close()
+	if err == nil || enc != "" {
+		return text, enc, err
+	}
+
+	r, err2 := open()
+	if err2 != nil {
+		return nil, "", err
+	}
+	defer r.Close()
+
+	head, err2 := ioutil.ReadAll(io.LimitReader(r, descLimit))
+	if err2 != nil {
+		return nil, "", err
+	}
+
+	enc = detectEncoding(head)
+	if enc == "" {
+		return nil, "", err
+	}
+
+	text, err2 = bodyText(io.MultiReader(bytes.NewReader(head), r), enc)
+	if err2 != nil {
+		return nil, "", err
+	}
+
+	return text, enc, nil
+}